@@ -1,10 +1,20 @@
 package main
 
 import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
 	"prayago-metricsalert/internal/agent"
 )
 
 func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
 	agent := agent.NewAgent(agent.NewAgentConfig())
-	agent.Run()
+	if err := agent.Run(ctx); err != nil {
+		os.Exit(1)
+	}
 }
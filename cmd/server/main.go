@@ -1,34 +1,43 @@
 package main
 
 import (
-	// "fmt"
+	"context"
 	"os"
 	"os/signal"
 	"prayago-metricsalert/internal/logger"
 	"prayago-metricsalert/internal/server"
 	"syscall"
-	"time"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(runMigrate(os.Args[2:]))
+	}
+
 	logger.LogSugar.Infoln("Starting server")
-	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	config := server.NewServerConfig()
+	srvr := server.NewServer(config)
 
-	var srvr server.Server
+	served := make(chan error, 1)
 	go func() {
-		config := server.NewServerConfig()
-		srvr = server.NewServer(config)
-		err := srvr.StartServer()
-		logger.LogSugar.Error("Failed to start server:", err)
-		logger.LogSugar.Fatalf("Failed to start server:%v", err)
+		served <- srvr.StartServer()
 	}()
 
-	<-stop
+	select {
+	case err := <-served:
+		// сервер не запустился, но хранилище все равно закрываем: в нем может быть журнал
+		logger.LogSugar.Errorln("Failed to start server:", err)
+		srvr.Shutdown(context.Background())
+		os.Exit(1)
+	case <-ctx.Done():
+	}
 
 	logger.LogSugar.Infoln("Stoping server")
-	srvr.Stop()
-
-	time.Sleep(2 * time.Second)
+	if err := srvr.Shutdown(context.Background()); err != nil {
+		os.Exit(1)
+	}
 	logger.LogSugar.Infoln("Server exit")
 }
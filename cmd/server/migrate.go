@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"prayago-metricsalert/internal/storage/db"
+	"time"
+)
+
+const migrateUsage = `usage: server migrate [-d dsn] [-steps n] up|down|status
+
+  up      apply all pending migrations
+  down    revert the last -steps applied migrations (default 1)
+  status  list migrations and whether they are applied
+`
+
+// runMigrate -- подкоманда "server migrate", возвращает код выхода
+func runMigrate(args []string) int {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), migrateUsage)
+		flags.PrintDefaults()
+	}
+	d := flags.String("d", "", "database connection string")
+	steps := flags.Int("steps", 1, "how many migrations to revert with down")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if envDataBaseDsn := os.Getenv("DATABASE_DSN"); envDataBaseDsn != "" {
+		*d = envDataBaseDsn
+	}
+	if *d == "" || flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	conn, err := sql.Open("pgx", *d)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer conn.Close()
+
+	migrator, err := db.NewMigrator(conn)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	ctx := context.Background()
+	switch command := flags.Arg(0); command {
+	case "up", "down":
+		var done []db.Migration
+		if command == "up" {
+			done, err = migrator.Up(ctx)
+		} else {
+			done, err = migrator.Down(ctx, *steps)
+		}
+		for _, migration := range done {
+			fmt.Printf("%s %04d_%s\n", command, migration.Version, migration.Name)
+		}
+		if len(done) == 0 && err == nil {
+			fmt.Println("nothing to do")
+		}
+	case "status":
+		var statuses []db.MigrationStatus
+		statuses, err = migrator.Status(ctx)
+		for _, status := range statuses {
+			applied := "pending"
+			if status.Applied {
+				applied = "applied " + status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%s\t%s\n", status.Version, status.Name, applied)
+		}
+	default:
+		flags.Usage()
+		return 2
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,7 @@
+//go:build sqlite
+
+package main
+
+// драйвер sqlite на cgo, поэтому бэкенд sqlite:// подключается только при сборке
+// с -tags sqlite, остальным сборкам C компилятор не нужен
+import _ "prayago-metricsalert/internal/storage/sqlite"
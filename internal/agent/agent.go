@@ -3,64 +3,40 @@ package agent
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/rsa"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"math/rand"
+	"io"
 	"net/http"
+	"net/url"
+	"prayago-metricsalert/internal/encryption"
 	"prayago-metricsalert/internal/logger"
 	"prayago-metricsalert/internal/metrics"
-	"reflect"
-	"runtime"
-	"strconv"
+	"prayago-metricsalert/internal/signing"
+	"sync"
 	"time"
 
 	"github.com/go-resty/resty/v2"
 )
 
-var needfulMemStats = [...]string{
-	"Alloc",
-	"BuckHashSys",
-	"Frees",
-	"GCCPUFraction",
-	"GCSys",
-	"HeapAlloc",
-	"HeapIdle",
-	"HeapInuse",
-	"HeapObjects",
-	"HeapReleased",
-	"HeapSys",
-	"LastGC",
-	"Lookups",
-	"MCacheInuse",
-	"MCacheSys",
-	"MSpanInuse",
-	"MSpanSys",
-	"Mallocs",
-	"NextGC",
-	"NumForcedGC",
-	"NumGC",
-	"OtherSys",
-	"PauseTotalNs",
-	"StackInuse",
-	"StackSys",
-	"Sys",
-	"TotalAlloc",
-}
-
 type Metric = metrics.Metric
 
 type Agent struct {
-	config      AgentConfig
-	memStats    runtime.MemStats
-	metrics     map[string]Metric
-	pollCount   Metric
-	randomValue Metric
-	client      *resty.Client
+	config     AgentConfig
+	mu         sync.Mutex // опрос и отправка идут в разных горутинах
+	collectors []Collector
+	collected  map[string][]Metric // метрики последнего удачного опроса по имени сборщика
+	labels     metrics.Labels
+	client     *resty.Client
+	transport  Transport
+	publicKey  *rsa.PublicKey // открытый ключ сервера, nil -- тело не шифруется
+	spool      *spool         // неотправленные пачки, nil -- не сохраняются
 }
 
-const pollCount = "PollCount"
-const randomValue = "RandomValue"
+// finalSendTimeout -- сколько при остановке ждем последнюю отправку вместе с повторами
+const finalSendTimeout = 10 * time.Second
 
 var updateMetricURI string
 var batchUpdateMetricsURI string
@@ -91,167 +67,311 @@ func NewAgent(config AgentConfig) *Agent {
 			},
 		)
 
-	return &Agent{
-		config:      config,
-		metrics:     make(map[string]Metric),
-		pollCount:   metrics.NewMetric("PollCount", metrics.CounterMetric),
-		randomValue: metrics.NewMetric("RandomValue", metrics.GaugeMetric),
-		client:      client,
+	var labels metrics.Labels
+	if config.hostLabel != "" {
+		labels = metrics.Labels{"host": config.hostLabel}
+	}
+
+	agent := &Agent{
+		config:     config,
+		collectors: newCollectors(config),
+		collected:  make(map[string][]Metric),
+		labels:     labels,
+		client:     client,
+	}
+	transport, err := newTransport(config, agent)
+	if err != nil {
+		logger.LogSugar.Fatalf("Ошибка режима отправки: %v", err)
+	}
+	agent.transport = transport
+	if config.spoolDir != "" {
+		spool, err := openSpool(config.spoolDir, config.spoolMaxSize, config.spoolMaxAge)
+		if err != nil {
+			logger.LogSugar.Fatalf("Ошибка открытия каталога %s: %v", config.spoolDir, err)
+		}
+		agent.spool = spool
+		agent.collectors = append(agent.collectors, spoolCollector{spool})
+	}
+	if config.cryptoKey != "" {
+		publicKey, err := encryption.LoadPublicKey(config.cryptoKey)
+		if err != nil {
+			logger.LogSugar.Fatalf("Ошибка чтения ключа %s: %v", config.cryptoKey, err)
+		}
+		agent.publicKey = publicKey
 	}
+
+	return agent
 }
 
-func (agent *Agent) Run() {
+// sendJob -- один запрос к серверу, их выполняет пул из rateLimit воркеров
+type sendJob func(ctx context.Context)
+
+// Run опрашивает и отправляет метрики, пока не отменят ctx, потом отправляет
+// последнюю пачку, чтобы последний опрос не потерялся. Ошибка -- если последняя пачка не ушла.
+func (agent *Agent) Run(ctx context.Context) error {
 	logger.LogSugar.Infoln("Agent started")
-	go agent.startPolling()
-	go agent.startSending()
-	for {
-		time.Sleep(1 * time.Second)
+
+	// очередь не длиннее пула: если сервер не успевает, отправка пропускает тики,
+	// а не копит запросы, опрос же от отправки не зависит совсем
+	rateLimit := max(agent.config.rateLimit, 1)
+	jobs := make(chan sendJob, rateLimit)
+
+	var wg sync.WaitGroup
+	for i := 0; i < rateLimit; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			agent.startWorker(ctx, jobs)
+		}()
+	}
+	for _, collector := range agent.collectors {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			agent.startCollecting(ctx, collector)
+		}()
 	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		agent.startSending(ctx, jobs)
+	}()
+	<-ctx.Done()
+	wg.Wait()
+
+	logger.LogSugar.Infoln("Agent stopping, sending final batch")
+	finalCtx, cancel := context.WithTimeout(context.Background(), finalSendTimeout)
+	defer cancel()
+	if err := agent.transport.Send(finalCtx, agent.snapshot()); err != nil {
+		logger.LogSugar.Errorln("Final batch was not sent:", err)
+		return err
+	}
+
+	logger.LogSugar.Infoln("Agent stopped")
+	return nil
 }
 
-func (agent *Agent) startPolling() {
-	logger.LogSugar.Infoln("Agent started polling", agent.config.pollInterval)
+func (agent *Agent) startSending(ctx context.Context, jobs chan<- sendJob) {
+	logger.LogSugar.Infoln("Agent started sending", agent.config.reportInterval, "rate limit", agent.config.rateLimit)
+	ticker := time.NewTicker(agent.config.reportInterval)
+	defer ticker.Stop()
 	for {
-		time.Sleep(agent.config.pollInterval)
-		agent.updateMetrics()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, job := range agent.sendJobs() {
+				select {
+				case <-ctx.Done():
+					return
+				case jobs <- job:
+				}
+			}
+		}
 	}
 }
 
-func (agent *Agent) startSending() {
-	logger.LogSugar.Infoln("Agent started sending", agent.config.reportInterval)
+// startWorker выполняет запросы из очереди, пока не отменят ctx, недоделанные отбрасываются
+func (agent *Agent) startWorker(ctx context.Context, jobs <-chan sendJob) {
 	for {
-		time.Sleep(agent.config.reportInterval)
-		agent.sendMetrics()
-		agent.sendJSONMetrics()
-		agent.sendMetricsBatch()
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-jobs:
+			job(ctx)
+		}
 	}
 }
 
-func (agent *Agent) updateMetrics() {
-	// fmt.Printf("Agent updated metrics.\r\n")
-
-	runtime.ReadMemStats(&agent.memStats)
-	reflectedMemStats := reflect.ValueOf(agent.memStats)
-
-	// I want it to be simple: I have the list of needed metrics, so I just loop over the MemStats
-	// to get only those values I need.
-	// I know that some people use JSON to bypass Go limitation on dynamic field name lookup in structs,
-	// but I'm doing it in my way ;)
-	for _, mName := range needfulMemStats {
-		value := reflect.Indirect(reflectedMemStats).FieldByName(mName)
-		valueFloat64, _ := strconv.ParseFloat(fmt.Sprintf("%v", value), 64)
-		if metric, present := agent.metrics[mName]; present {
-			metric.Value = &valueFloat64
-			agent.metrics[mName] = metric
-		} else {
-			agent.metrics[mName] = Metric{ID: mName, MType: metrics.GaugeMetric, Value: &valueFloat64}
-		}
+// sendJobs -- все запросы одного отчета по одному снимку метрик, каждая метрика
+// уходит ровно один раз, иначе сервер прибавит counter несколько раз
+func (agent *Agent) sendJobs() []sendJob {
+	snapshot := agent.snapshot()
+	size := agent.transport.MaxBatch()
+	if size <= 0 {
+		size = max(len(snapshot), 1)
+	}
+
+	var jobs []sendJob
+	for start := 0; start < len(snapshot); start += size {
+		batch := snapshot[start:min(start+size, len(snapshot))]
+		jobs = append(jobs, func(ctx context.Context) {
+			agent.transport.Send(ctx, batch)
+		})
 	}
 
-	*agent.pollCount.Delta++
-	*agent.randomValue.Value = rand.Float64()
-	// fmt.Printf("%v \r\n\r\n", agent.metrics)
+	return jobs
 }
 
-func (agent *Agent) sendMetrics() {
-	var url string
-	for _, metric := range agent.metrics {
-		url = fmt.Sprintf("http://%s/update/%s/%s/%v",
-			agent.config.serverAddress,
-			metric.MType, metric.ID, *metric.Value,
-		)
-		doPostMetric(agent.client, url)
+// updateMetrics опрашивает все сборщики разом, не дожидаясь их интервалов
+func (agent *Agent) updateMetrics() {
+	for _, collector := range agent.collectors {
+		agent.collect(context.Background(), collector)
 	}
+}
 
-	// pollCount
-	url = fmt.Sprintf("http://%s/update/%s/%s/%v",
-		agent.config.serverAddress,
-		metrics.CounterMetric, pollCount, *agent.pollCount.Delta,
-	)
-	doPostMetric(agent.client, url)
-	// randomValue
-	url = fmt.Sprintf("http://%s/update/%s/%s/%v",
-		agent.config.serverAddress,
-		metrics.GaugeMetric, randomValue, *agent.randomValue.Value,
-	)
-	doPostMetric(agent.client, url)
+// snapshot -- копии метрик последнего опроса, отправка не держит блокировку опроса
+func (agent *Agent) snapshot() []Metric {
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+
+	var snapshot []Metric
+	for _, collector := range agent.collectors {
+		for _, metric := range agent.collected[collector.Name()] {
+			snapshot = append(snapshot, metric.Clone())
+		}
+	}
+
+	return snapshot
 }
 
-func doPostMetric(client *resty.Client, url string) {
-	_, err := client.R().SetHeader("Content-Type", "text/plain").Post(url)
+func (agent *Agent) doPostMetric(ctx context.Context, metric Metric) error {
+	url := fmt.Sprintf("http://%s/update/%s/%s/%v%s",
+		agent.config.serverAddress,
+		metric.MType, metric.ID, metric.GetValue(), labelsQueryString(metric.Labels),
+	)
+	resp, err := agent.client.R().SetContext(ctx).SetHeader("Content-Type", "text/plain").Post(url)
 	if err != nil {
 		logger.LogSugar.Errorf("doPostMetric(): url=%v, error=%v", url, err)
-		return
+		return err
 	}
+	if resp.StatusCode() != http.StatusOK {
+		logger.LogSugar.Infoln("doPostMetric", "status:", resp.StatusCode())
+		return fmt.Errorf("server responded with status %d", resp.StatusCode())
+	}
+
+	return nil
 }
 
-func (agent *Agent) sendJSONMetrics() {
-	for _, metric := range agent.metrics {
-		doSendJSONMetric(agent.client, metric)
+// метки в URL передаются query параметром labels=name:value
+func labelsQueryString(labels metrics.Labels) string {
+	if len(labels) == 0 {
+		return ""
 	}
 
-	doSendJSONMetric(agent.client, agent.pollCount)
-	doSendJSONMetric(agent.client, agent.randomValue)
+	return "?labels=" + url.QueryEscape(metrics.FormatLabels(labels))
 }
 
-func doSendJSONMetric(client *resty.Client, metric Metric) {
+func (agent *Agent) doSendJSONMetric(ctx context.Context, metric Metric) error {
 	jsonValue, err := json.Marshal(metric)
 	if err != nil {
 		logger.LogSugar.Errorln("doSendJSONMetric", err)
-		return
+		return err
 	}
 
-	doPostJSON(*client, updateMetricURI, jsonValue)
+	return agent.doPostJSON(ctx, updateMetricURI, jsonValue)
 }
 
-func (agent *Agent) sendMetricsBatch() {
-	var metricsSlice = make([]Metric, 0)
-	for _, metric := range agent.metrics {
-		metricsSlice = append(metricsSlice, metric)
-	}
-	metricsSlice = append(metricsSlice, agent.pollCount, agent.randomValue)
-
-	jsonValue, err := json.Marshal(metricsSlice)
+// sendMetricsBatch со спулом сначала дотправляет накопленные пачки,
+// а если сервер недоступен, откладывает пачку на диск
+func (agent *Agent) sendMetricsBatch(ctx context.Context, batch []Metric) error {
+	jsonValue, err := json.Marshal(batch)
 	if err != nil {
 		logger.LogSugar.Errorln("sendMetricsBatch", err)
-		return
+		return err
 	}
 
-	// logger.LogSugar.Infoln("sendMetricsBatch: metrics=", string(jsonValue))
-	doPostJSON(*agent.client, batchUpdateMetricsURI, jsonValue)
-}
+	gzipped, err := gzipBody(jsonValue)
+	if agent.spool == nil || err != nil {
+		return agent.doPostJSON(ctx, batchUpdateMetricsURI, jsonValue)
+	}
 
-func doPostJSON(client resty.Client, url string, jsonValue []byte) {
-	var gzippedBytes bytes.Buffer
-	gzipper := gzip.NewWriter(&gzippedBytes)
-	gzipOk := false
-	if _, err := gzipper.Write(jsonValue); err == nil {
-		if err := gzipper.Close(); err == nil {
-			gzipOk = true
+	return agent.spool.deliver(gzipped, func(body []byte) error {
+		plain, err := gunzipBody(body)
+		if err != nil {
+			return err
 		}
+		return agent.postJSON(ctx, batchUpdateMetricsURI, plain, body)
+	})
+}
+
+func (agent *Agent) doPostJSON(ctx context.Context, url string, jsonValue []byte) error {
+	gzipped, err := gzipBody(jsonValue)
+	if err != nil {
+		gzipped = nil
 	}
 
-	var resp *resty.Response
-	var err error
-	req := client.R()
+	return agent.postJSON(ctx, url, jsonValue, gzipped)
+}
+
+// postJSON с ключом подписывает несжатое тело и проверяет подпись ответа сервера,
+// с открытым ключом сервера шифрует уже сжатое тело. gzipped -- сжатый jsonValue или nil.
+// Ошибки, после которых пачку стоит повторить, оборачивают errServerUnavailable.
+func (agent *Agent) postJSON(ctx context.Context, url string, jsonValue []byte, gzipped []byte) error {
+	key := agent.config.key
+
+	req := agent.client.R().SetContext(ctx)
 	req.SetHeader("Content-Type", "application/json")
-	if gzipOk {
+	if key != "" {
+		req.SetHeader(signing.Header, signing.Sign([]byte(key), jsonValue))
+	}
+
+	body := jsonValue
+	if gzipped != nil {
 		req.SetHeader("Content-Encoding", "gzip")
-		req.SetBody(&gzippedBytes)
-		resp, err = req.Post(url)
-	} else {
-		req.SetBody(bytes.NewBuffer(jsonValue))
-		resp, err = req.Post(url)
+		body = gzipped
 	}
 
+	if agent.publicKey != nil {
+		encrypted, err := encryption.Encrypt(agent.publicKey, body)
+		if err != nil {
+			logger.LogSugar.Errorln("doPostJSON", "encryption error", err)
+			return err
+		}
+		req.SetHeader(encryption.Header, encryption.Scheme)
+		body = encrypted
+	}
+
+	// []byte, а не Reader: повторная попытка resty отправит тело заново
+	req.SetBody(body)
+	resp, err := req.Post(url)
 	if err != nil {
 		logger.LogSugar.Errorln("doPostJSON", "error", err)
-		return
+		// запрос оборвали мы сами, например при остановке, и сервер мог его уже применить
+		if ctx.Err() != nil {
+			return fmt.Errorf("%w: %v", ctx.Err(), err)
+		}
+		return fmt.Errorf("%w: %v", errServerUnavailable, err)
 	} else {
 		logger.LogSugar.Infoln("doPostJSON", "response:", string(resp.Body()))
 	}
 
 	if resp.StatusCode() != http.StatusOK {
 		logger.LogSugar.Infoln("doPostJSON", "status:", resp.StatusCode())
+		err := fmt.Errorf("server responded with status %d", resp.StatusCode())
+		if resp.StatusCode() >= http.StatusInternalServerError || resp.StatusCode() == http.StatusTooManyRequests {
+			return fmt.Errorf("%w: %v", errServerUnavailable, err)
+		}
+		return err
+	}
+
+	if key != "" && !signing.Verify([]byte(key), resp.Body(), resp.Header().Get(signing.Header)) {
+		logger.LogSugar.Errorln("doPostJSON", "wrong response signature")
+		return errors.New("wrong " + signing.Header + " signature of server response")
+	}
+
+	return nil
+}
+
+func gzipBody(data []byte) ([]byte, error) {
+	var gzippedBytes bytes.Buffer
+	gzipper := gzip.NewWriter(&gzippedBytes)
+	if _, err := gzipper.Write(data); err != nil {
+		return nil, err
+	}
+	if err := gzipper.Close(); err != nil {
+		return nil, err
 	}
+
+	return gzippedBytes.Bytes(), nil
+}
+
+func gunzipBody(data []byte) ([]byte, error) {
+	gzipRdr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer gzipRdr.Close()
+
+	return io.ReadAll(gzipRdr)
 }
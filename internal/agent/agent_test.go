@@ -1,16 +1,180 @@
 package agent
 
 import (
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"prayago-metricsalert/internal/alerts"
+	"prayago-metricsalert/internal/metrics"
+	"prayago-metricsalert/internal/server"
+	"prayago-metricsalert/internal/signing"
+	"prayago-metricsalert/internal/storage"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestUpdateMetrics(t *testing.T) {
 	agent := NewAgent(NewAgentConfig())
 	agent.updateMetrics()
 
-	assert.NotEmpty(t, agent.metrics)
-	assert.NotEmpty(t, agent.randomValue.Value)
-	assert.NotEmpty(t, agent.pollCount.Delta, 1)
+	snapshot := agent.snapshot()
+	assert.NotEmpty(t, snapshot)
+	assert.NotNil(t, findMetric(snapshot, randomValue).Value)
+	assert.Equal(t, int64(1), *findMetric(snapshot, pollCount).Delta)
+	assert.NotNil(t, findMetric(snapshot, "Alloc").Value)
+
+	// метка host по умолчанию -- имя машины
+	for _, metric := range snapshot {
+		assert.Equal(t, agent.config.hostLabel, metric.Labels["host"])
+	}
+}
+
+func TestRunSendsFinalBatch(t *testing.T) {
+	var mu sync.Mutex
+	var batches int
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if req.URL.Path == "/updates/" {
+			batches++
+		}
+		res.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	config := AgentConfig{
+		serverAddress:  strings.TrimPrefix(srv.URL, "http://"),
+		reportInterval: time.Hour, // до остановки не отправляется ничего
+		pollInterval:   10 * time.Millisecond,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.NoError(t, NewAgent(config).Run(ctx))
+	mu.Lock()
+	assert.Equal(t, 1, batches)
+	mu.Unlock()
+
+	// последняя пачка не ушла -- Run сообщает об ошибке
+	mu.Lock()
+	status = http.StatusInternalServerError
+	mu.Unlock()
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Error(t, NewAgent(config).Run(ctx))
+}
+
+func TestSendMetricsBatchSigned(t *testing.T) {
+	const key = "secret"
+	responseKey := key
+	srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		gzipRdr, err := gzip.NewReader(req.Body)
+		require.NoError(t, err)
+		body, err := io.ReadAll(gzipRdr)
+		require.NoError(t, err)
+		// подписано несжатое тело
+		assert.True(t, signing.Verify([]byte(key), body, req.Header.Get(signing.Header)))
+
+		response := []byte("[]")
+		res.Header().Set(signing.Header, signing.Sign([]byte(responseKey), response))
+		res.Write(response)
+	}))
+	defer srv.Close()
+
+	agent := NewAgent(AgentConfig{serverAddress: strings.TrimPrefix(srv.URL, "http://"), key: key})
+	agent.updateMetrics()
+	require.NoError(t, agent.sendMetricsBatch(context.Background(), agent.snapshot()))
+
+	// ответ подписан чужим ключом
+	responseKey = "other"
+	assert.Error(t, agent.sendMetricsBatch(context.Background(), agent.snapshot()))
+}
+
+// агент и сервер с одними ключами понимают друг друга: подпись, сжатие и шифрование
+func TestSendMetricsBatchToServer(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	pkix, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	publicKeyPath := filepath.Join(t.TempDir(), "public.pem")
+	require.NoError(t, os.WriteFile(publicKeyPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkix}), 0600))
+
+	store := storage.NewStorage(storage.StorageConfig{DSN: "memory://"})
+	router := server.GetRouter(store, alerts.NewEngineWithRules(alerts.EngineConfig{}, store, nil, nil),
+		server.RouterOptions{Key: "secret", PrivateKey: key})
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	agent := NewAgent(AgentConfig{
+		serverAddress: strings.TrimPrefix(srv.URL, "http://"),
+		key:           "secret",
+		cryptoKey:     publicKeyPath,
+	})
+	agent.updateMetrics()
+	require.NoError(t, agent.sendMetricsBatch(context.Background(), agent.snapshot()))
+
+	value, err := store.GetMetric(metrics.SeriesKey("PollCount", nil))
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), value.GetValue())
+}
+
+func TestRateLimit(t *testing.T) {
+	const rateLimit = 3
+	var inFlight, maxInFlight atomic.Int32
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		current := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			seen := maxInFlight.Load()
+			if current <= seen || maxInFlight.CompareAndSwap(seen, current) {
+				break
+			}
+		}
+		// медленный сервер
+		select {
+		case <-release:
+		case <-req.Context().Done():
+		case <-time.After(100 * time.Millisecond):
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	agent := NewAgent(AgentConfig{
+		serverAddress:  strings.TrimPrefix(srv.URL, "http://"),
+		reportInterval: 10 * time.Millisecond,
+		pollInterval:   10 * time.Millisecond,
+		rateLimit:      rateLimit,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- agent.Run(ctx)
+	}()
+
+	time.Sleep(500 * time.Millisecond)
+	// до остановки: потом прерванные запросы и последняя пачка могут на миг пересечься
+	assert.Equal(t, int32(rateLimit), maxInFlight.Load())
+	cancel()
+	require.NoError(t, <-stopped)
+
+	// опрос не ждал сервер
+	assert.Greater(t, *findMetric(agent.snapshot(), pollCount).Delta, int64(20))
 }
@@ -0,0 +1,145 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"prayago-metricsalert/internal/logger"
+	"prayago-metricsalert/internal/metrics"
+)
+
+// Collector -- источник метрик агента. Каждый сборщик опрашивается в своей горутине
+// со своим интервалом, ошибка или паника одного сборщика остальным не мешает.
+// Collect вызывается только из этой горутины, так что сборщику не нужны свои блокировки.
+type Collector interface {
+	Name() string
+	Interval() time.Duration // 0 -- интервал опроса агента, -p
+	Collect(ctx context.Context) ([]Metric, error)
+}
+
+// CollectorFactory создает сборщик по настройкам агента
+type CollectorFactory func(config AgentConfig) (Collector, error)
+
+// ErrCollectorUnsupported -- сборщику на этой машине собирать нечего,
+// например нет procfs, агент работает без него и не считает это ошибкой
+var ErrCollectorUnsupported = errors.New("collector is not supported")
+
+type registeredCollector struct {
+	name    string
+	factory CollectorFactory
+}
+
+var (
+	collectorsMu sync.RWMutex
+	collectors   []registeredCollector // в порядке регистрации, в нем же метрики уходят на сервер
+)
+
+// RegisterCollector регистрирует сборщик, обычно вызывается из init(),
+// агент создает все зарегистрированные сборщики в NewAgent
+func RegisterCollector(name string, factory CollectorFactory) {
+	collectorsMu.Lock()
+	defer collectorsMu.Unlock()
+
+	for _, registered := range collectors {
+		if registered.name == name {
+			panic(fmt.Sprintf("agent collector %s is already registered", name))
+		}
+	}
+	collectors = append(collectors, registeredCollector{name: name, factory: factory})
+}
+
+func CollectorNames() []string {
+	collectorsMu.RLock()
+	defer collectorsMu.RUnlock()
+
+	names := make([]string, 0, len(collectors))
+	for _, registered := range collectors {
+		names = append(names, registered.name)
+	}
+
+	return names
+}
+
+// newCollectors создает зарегистрированные сборщики, без тех, что не смогли создаться
+func newCollectors(config AgentConfig) []Collector {
+	collectorsMu.RLock()
+	defer collectorsMu.RUnlock()
+
+	created := make([]Collector, 0, len(collectors))
+	for _, registered := range collectors {
+		collector, err := registered.factory(config)
+		switch {
+		case errors.Is(err, ErrCollectorUnsupported):
+			logger.LogSugar.Infoln("Collector is disabled:", registered.name, err)
+		case err != nil:
+			logger.LogSugar.Errorln("Error creating collector:", registered.name, err)
+		default:
+			created = append(created, collector)
+		}
+	}
+
+	return created
+}
+
+func (agent *Agent) startCollecting(ctx context.Context, collector Collector) {
+	interval := collector.Interval()
+	if interval <= 0 {
+		interval = agent.config.pollInterval
+	}
+	logger.LogSugar.Infoln("Agent started collecting", collector.Name(), interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			agent.collect(ctx, collector)
+		}
+	}
+}
+
+// collect заменяет метрики сборщика новыми. Если сборщик упал или вернул ошибку,
+// на сервер уходят его метрики с прошлого удачного опроса.
+func (agent *Agent) collect(ctx context.Context, collector Collector) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			logger.LogSugar.Errorln("Collector panicked:", collector.Name(), recovered)
+		}
+	}()
+
+	collected, err := collector.Collect(ctx)
+	if err != nil {
+		logger.LogSugar.Warnln("Collector failed:", collector.Name(), err)
+		return
+	}
+
+	for i := range collected {
+		collected[i].Labels = agent.withHostLabel(collected[i].Labels)
+	}
+
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+	agent.collected[collector.Name()] = collected
+}
+
+// withHostLabel добавляет метки агента к меткам метрики, свои метки сборщика важнее
+func (agent *Agent) withHostLabel(labels metrics.Labels) metrics.Labels {
+	if len(labels) == 0 {
+		return agent.labels
+	}
+
+	merged := agent.labels.Clone()
+	if merged == nil {
+		merged = make(metrics.Labels, len(labels))
+	}
+	for name, value := range labels {
+		merged[name] = value
+	}
+
+	return merged
+}
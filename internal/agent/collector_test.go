@@ -0,0 +1,110 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"prayago-metricsalert/internal/metrics"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCollector -- gauge со значением, сколько раз его опросили,
+// fail решает, чем закончится очередной опрос
+type testCollector struct {
+	name     string
+	interval time.Duration
+	calls    float64
+	fail     func(calls float64) error
+}
+
+func (c *testCollector) Name() string {
+	return c.name
+}
+
+func (c *testCollector) Interval() time.Duration {
+	return c.interval
+}
+
+func (c *testCollector) Collect(ctx context.Context) ([]Metric, error) {
+	c.calls++
+	if c.fail != nil {
+		if err := c.fail(c.calls); err != nil {
+			return nil, err
+		}
+	}
+	calls := c.calls
+
+	return []Metric{{ID: c.name, MType: metrics.GaugeMetric, Value: &calls, Labels: metrics.Labels{"collector": c.name}}}, nil
+}
+
+func findMetric(snapshot []Metric, id string) *Metric {
+	for _, metric := range snapshot {
+		if metric.ID == id {
+			return &metric
+		}
+	}
+
+	return nil
+}
+
+func TestCollectorIsolation(t *testing.T) {
+	failing := &testCollector{name: "failing", fail: func(calls float64) error {
+		if calls > 1 {
+			return errors.New("broken")
+		}
+		return nil
+	}}
+	panicking := &testCollector{name: "panicking", fail: func(calls float64) error {
+		panic("collector bug")
+	}}
+	healthy := &testCollector{name: "healthy"}
+
+	agent := NewAgent(AgentConfig{hostLabel: "web1"})
+	agent.collectors = []Collector{failing, panicking, healthy}
+	agent.updateMetrics()
+	agent.updateMetrics()
+
+	snapshot := agent.snapshot()
+	require.Len(t, snapshot, 2)
+	// сломанный сборщик отдает значение с прошлого удачного опроса
+	assert.Equal(t, 1.0, findMetric(snapshot, "failing").GetValue())
+	assert.Equal(t, 2.0, findMetric(snapshot, "healthy").GetValue())
+	assert.Nil(t, findMetric(snapshot, "panicking"))
+
+	// к своим меткам сборщика добавляется host
+	assert.Equal(t, metrics.Labels{"collector": "healthy", "host": "web1"}, findMetric(snapshot, "healthy").Labels)
+}
+
+func TestCollectorIntervals(t *testing.T) {
+	fast := &testCollector{name: "fast", interval: 10 * time.Millisecond}
+	slow := &testCollector{name: "slow", interval: time.Hour}
+	byAgent := &testCollector{name: "by-agent"}
+
+	agent := NewAgent(AgentConfig{pollInterval: 20 * time.Millisecond})
+	agent.collectors = []Collector{fast, slow, byAgent}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	for _, collector := range agent.collectors {
+		go agent.startCollecting(ctx, collector)
+	}
+	<-ctx.Done()
+
+	snapshot := agent.snapshot()
+	assert.Greater(t, findMetric(snapshot, "fast").GetValue(), 10.0)
+	assert.Nil(t, findMetric(snapshot, "slow"))
+	assert.Greater(t, findMetric(snapshot, "by-agent").GetValue(), 5.0)
+}
+
+func TestRegisterCollector(t *testing.T) {
+	assert.Equal(t, []string{"memstats", "pollcount", "random", "procfs"}, CollectorNames())
+	assert.Panics(t, func() {
+		RegisterCollector("memstats", func(config AgentConfig) (Collector, error) {
+			return memStatsCollector{}, nil
+		})
+	})
+}
@@ -2,6 +2,7 @@ package agent
 
 import (
 	"flag"
+	"fmt"
 	"os"
 	"prayago-metricsalert/internal/logger"
 	"strconv"
@@ -12,15 +13,37 @@ type AgentConfig struct {
 	serverAddress  string
 	reportInterval time.Duration
 	pollInterval   time.Duration
+	hostLabel      string
+	key            string // ключ подписи HashSHA256, пустой -- запросы не подписываются
+	cryptoKey      string // путь к открытому ключу RSA сервера в PEM, пустой -- тело не шифруется
+	rateLimit      int    // сколько запросов к серверу идут одновременно
+	spoolDir       string // каталог для пачек, не отправленных из-за недоступности сервера, пустой -- не сохраняются
+	spoolMaxSize   int64  // байт
+	spoolMaxAge    time.Duration
+	mode           string // url, json или batch, см. newTransport
 }
 
 func NewAgentConfig() AgentConfig {
 	a := flag.String("a", "localhost:8080", "server address and port")
 	r := flag.Int("r", 10, "metrics sending interval")
 	p := flag.Int("p", 2, "metrics poll(udpate) interval")
+	// по умолчанию метка host -- имя машины, /value/{mtype}/{mname} без ?labels= все равно
+	// найдет метрику, если она шлется с одного хоста
+	hostname, _ := os.Hostname()
+	host := flag.String("host", hostname, "host label value attached to every metric, empty disables the label")
+	k := flag.String("k", "", "shared key to sign requests with HashSHA256, empty disables signing")
+	cryptoKey := flag.String("crypto-key", "", "server RSA public key PEM file to encrypt requests, empty disables encryption")
+	l := flag.Int("l", 1, "max concurrent requests to the server")
+	spoolDir := flag.String("spool-dir", "", "directory to keep batches the server did not accept, empty disables the spool")
+	spoolMaxSize := flag.Int("spool-max-size", 10, "spool size limit, MiB; the oldest batches are dropped first")
+	spoolMaxAge := flag.Int("spool-max-age", 3600, "drop spooled batches older than this, sec")
+	mode := flag.String("mode", modeBatch, "how to send metrics: url, json or batch; the spool works in batch mode only, url mode can not be used with -k or -crypto-key")
 	flag.Parse()
 
-	config := AgentConfig{*a, time.Duration(*r) * time.Second, time.Duration(*p) * time.Second}
+	config := AgentConfig{
+		*a, time.Duration(*r) * time.Second, time.Duration(*p) * time.Second, *host, *k, *cryptoKey, *l,
+		*spoolDir, int64(*spoolMaxSize) << 20, time.Duration(*spoolMaxAge) * time.Second, *mode,
+	}
 
 	if envServerAddress := os.Getenv("ADDRESS"); envServerAddress != "" {
 		config.serverAddress = envServerAddress
@@ -36,7 +59,52 @@ func NewAgentConfig() AgentConfig {
 		}
 	}
 
+	if envRateLimit := os.Getenv("RATE_LIMIT"); envRateLimit != "" {
+		if rateLimitInt, err := strconv.Atoi(envRateLimit); err == nil {
+			config.rateLimit = rateLimitInt
+		}
+	}
+
+	if envMode := os.Getenv("MODE"); envMode != "" {
+		config.mode = envMode
+	}
+	if envSpoolDir := os.Getenv("SPOOL_DIR"); envSpoolDir != "" {
+		config.spoolDir = envSpoolDir
+	}
+	if envSpoolMaxSize := os.Getenv("SPOOL_MAX_SIZE"); envSpoolMaxSize != "" {
+		if spoolMaxSizeInt, err := strconv.Atoi(envSpoolMaxSize); err == nil {
+			config.spoolMaxSize = int64(spoolMaxSizeInt) << 20
+		}
+	}
+	if envSpoolMaxAge := os.Getenv("SPOOL_MAX_AGE"); envSpoolMaxAge != "" {
+		if spoolMaxAgeInt, err := strconv.Atoi(envSpoolMaxAge); err == nil {
+			config.spoolMaxAge = time.Duration(spoolMaxAgeInt) * time.Second
+		}
+	}
+
+	if envHostLabel, present := os.LookupEnv("HOST_LABEL"); present {
+		config.hostLabel = envHostLabel
+	}
+
+	if envKey := os.Getenv("KEY"); envKey != "" {
+		config.key = envKey
+	}
+
+	if envCryptoKey := os.Getenv("CRYPTO_KEY"); envCryptoKey != "" {
+		config.cryptoKey = envCryptoKey
+	}
+
 	logger.LogSugar.Infoln("Agent config:", config)
 
 	return config
 }
+
+// String прячет ключ: конфиг пишется в лог
+func (config AgentConfig) String() string {
+	if config.key != "" {
+		config.key = "***"
+	}
+
+	type plainConfig AgentConfig
+	return fmt.Sprintf("%v", plainConfig(config))
+}
@@ -0,0 +1,125 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"runtime"
+	"strconv"
+	"time"
+
+	"prayago-metricsalert/internal/metrics"
+)
+
+var needfulMemStats = [...]string{
+	"Alloc",
+	"BuckHashSys",
+	"Frees",
+	"GCCPUFraction",
+	"GCSys",
+	"HeapAlloc",
+	"HeapIdle",
+	"HeapInuse",
+	"HeapObjects",
+	"HeapReleased",
+	"HeapSys",
+	"LastGC",
+	"Lookups",
+	"MCacheInuse",
+	"MCacheSys",
+	"MSpanInuse",
+	"MSpanSys",
+	"Mallocs",
+	"NextGC",
+	"NumForcedGC",
+	"NumGC",
+	"OtherSys",
+	"PauseTotalNs",
+	"StackInuse",
+	"StackSys",
+	"Sys",
+	"TotalAlloc",
+}
+
+const pollCount = "PollCount"
+const randomValue = "RandomValue"
+
+func init() {
+	RegisterCollector("memstats", func(config AgentConfig) (Collector, error) {
+		return memStatsCollector{}, nil
+	})
+	RegisterCollector("pollcount", func(config AgentConfig) (Collector, error) {
+		return &pollCountCollector{}, nil
+	})
+	RegisterCollector("random", func(config AgentConfig) (Collector, error) {
+		return randomCollector{}, nil
+	})
+}
+
+// memStatsCollector -- gauge из runtime.MemStats, только поля из needfulMemStats
+type memStatsCollector struct{}
+
+func (memStatsCollector) Name() string {
+	return "memstats"
+}
+
+func (memStatsCollector) Interval() time.Duration {
+	return 0
+}
+
+func (memStatsCollector) Collect(ctx context.Context) ([]Metric, error) {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	reflectedMemStats := reflect.ValueOf(memStats)
+
+	// I want it to be simple: I have the list of needed metrics, so I just loop over the MemStats
+	// to get only those values I need.
+	// I know that some people use JSON to bypass Go limitation on dynamic field name lookup in structs,
+	// but I'm doing it in my way ;)
+	collected := make([]Metric, 0, len(needfulMemStats))
+	for _, mName := range needfulMemStats {
+		value := reflect.Indirect(reflectedMemStats).FieldByName(mName)
+		valueFloat64, _ := strconv.ParseFloat(fmt.Sprintf("%v", value), 64)
+		collected = append(collected, Metric{ID: mName, MType: metrics.GaugeMetric, Value: &valueFloat64})
+	}
+
+	return collected, nil
+}
+
+// pollCountCollector -- counter PollCount, сколько раз он сам опрошен с запуска агента
+type pollCountCollector struct {
+	count int64
+}
+
+func (c *pollCountCollector) Name() string {
+	return "pollcount"
+}
+
+func (c *pollCountCollector) Interval() time.Duration {
+	return 0
+}
+
+func (c *pollCountCollector) Collect(ctx context.Context) ([]Metric, error) {
+	c.count++
+	count := c.count
+
+	return []Metric{{ID: pollCount, MType: metrics.CounterMetric, Delta: &count}}, nil
+}
+
+// randomCollector -- gauge RandomValue, случайное число при каждом опросе
+type randomCollector struct{}
+
+func (randomCollector) Name() string {
+	return "random"
+}
+
+func (randomCollector) Interval() time.Duration {
+	return 0
+}
+
+func (randomCollector) Collect(ctx context.Context) ([]Metric, error) {
+	value := rand.Float64()
+
+	return []Metric{{ID: randomValue, MType: metrics.GaugeMetric, Value: &value}}, nil
+}
@@ -0,0 +1,217 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"prayago-metricsalert/internal/metrics"
+)
+
+const defaultProcRoot = "/proc"
+
+// cpuTimes -- счетчики одного ядра из /proc/stat, в тиках с загрузки
+type cpuTimes struct {
+	idle  uint64 // idle + iowait
+	total uint64 // user nice system idle iowait irq softirq steal, guest уже внутри user
+}
+
+// procCollector -- метрики машины из procfs: память, загрузка каждого ядра и load average.
+// root -- корень procfs, в тестах -- каталог с файлами-образцами.
+type procCollector struct {
+	root    string
+	prevCPU []cpuTimes
+}
+
+func init() {
+	RegisterCollector("procfs", func(config AgentConfig) (Collector, error) {
+		c := newProcCollector(defaultProcRoot)
+		// procfs не появится и не починится, так что без нее сборщик не нужен вовсе;
+		// заодно первый опрос запомнит счетчики ядер
+		if _, err := c.collect(); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCollectorUnsupported, err)
+		}
+		return c, nil
+	})
+}
+
+func newProcCollector(root string) *procCollector {
+	return &procCollector{root: root}
+}
+
+func (c *procCollector) Name() string {
+	return "procfs"
+}
+
+func (c *procCollector) Interval() time.Duration {
+	return 0
+}
+
+func (c *procCollector) Collect(ctx context.Context) ([]Metric, error) {
+	return c.collect()
+}
+
+// collect отдает gauge TotalMemory и FreeMemory в байтах, CPUutilizationN в процентах
+// (N с 1, за время с прошлого collect, в первый раз -- с загрузки) и LoadAverage1/5/15
+func (c *procCollector) collect() ([]Metric, error) {
+	var collected []Metric
+	gauge := func(name string, value float64) {
+		collected = append(collected, Metric{ID: name, MType: metrics.GaugeMetric, Value: &value})
+	}
+
+	memInfo, err := c.readMemInfo()
+	if err != nil {
+		return nil, err
+	}
+	gauge("TotalMemory", float64(memInfo["MemTotal"]))
+	gauge("FreeMemory", float64(memInfo["MemFree"]))
+
+	cpus, err := c.readCPUTimes()
+	if err != nil {
+		return nil, err
+	}
+	for i, cpu := range cpus {
+		gauge("CPUutilization"+strconv.Itoa(i+1), c.utilization(i, cpu))
+	}
+	c.prevCPU = cpus
+
+	load, err := c.readLoadAvg()
+	if err != nil {
+		return nil, err
+	}
+	gauge("LoadAverage1", load[0])
+	gauge("LoadAverage5", load[1])
+	gauge("LoadAverage15", load[2])
+
+	return collected, nil
+}
+
+func (c *procCollector) utilization(i int, cpu cpuTimes) float64 {
+	var prev cpuTimes
+	if i < len(c.prevCPU) {
+		prev = c.prevCPU[i]
+	}
+
+	// счетчики сбросились, например ядро выключали -- считаем с нуля
+	if cpu.total < prev.total || cpu.idle < prev.idle {
+		prev = cpuTimes{}
+	}
+	total := cpu.total - prev.total
+	if total == 0 {
+		return 0
+	}
+
+	return 100 * float64(total-(cpu.idle-prev.idle)) / float64(total)
+}
+
+// readMemInfo отдает поля /proc/meminfo в байтах
+func (c *procCollector) readMemInfo() (map[string]uint64, error) {
+	memInfo := make(map[string]uint64)
+	err := c.scanLines("meminfo", func(fields []string) error {
+		if len(fields) < 2 {
+			return nil
+		}
+		value, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return err
+		}
+		if len(fields) > 2 && fields[2] == "kB" {
+			value *= 1024
+		}
+		memInfo[strings.TrimSuffix(fields[0], ":")] = value
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range []string{"MemTotal", "MemFree"} {
+		if _, present := memInfo[name]; !present {
+			return nil, fmt.Errorf("meminfo has no %s", name)
+		}
+	}
+
+	return memInfo, nil
+}
+
+// readCPUTimes отдает строки cpu0, cpu1, ... из /proc/stat, общую строку cpu пропускает
+func (c *procCollector) readCPUTimes() ([]cpuTimes, error) {
+	var cpus []cpuTimes
+	err := c.scanLines("stat", func(fields []string) error {
+		if !strings.HasPrefix(fields[0], "cpu") || fields[0] == "cpu" {
+			return nil
+		}
+		if len(fields) < 5 {
+			return fmt.Errorf("stat: short line %s", fields[0])
+		}
+
+		var cpu cpuTimes
+		for i, field := range fields[1:min(len(fields), 9)] {
+			value, err := strconv.ParseUint(field, 10, 64)
+			if err != nil {
+				return fmt.Errorf("stat: %s: %w", fields[0], err)
+			}
+			cpu.total += value
+			if i == 3 || i == 4 { // idle, iowait
+				cpu.idle += value
+			}
+		}
+		cpus = append(cpus, cpu)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(cpus) == 0 {
+		return nil, fmt.Errorf("stat has no cpu lines")
+	}
+
+	return cpus, nil
+}
+
+func (c *procCollector) readLoadAvg() ([3]float64, error) {
+	var load [3]float64
+	data, err := os.ReadFile(filepath.Join(c.root, "loadavg"))
+	if err != nil {
+		return load, err
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) < 3 {
+		return load, fmt.Errorf("loadavg: unexpected format %q", data)
+	}
+	for i := range load {
+		if load[i], err = strconv.ParseFloat(fields[i], 64); err != nil {
+			return load, fmt.Errorf("loadavg: %w", err)
+		}
+	}
+
+	return load, nil
+}
+
+// scanLines зовет parse для каждой непустой строки файла, разбитой на поля
+func (c *procCollector) scanLines(name string, parse func(fields []string) error) error {
+	file, err := os.Open(filepath.Join(c.root, name))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if err := parse(fields); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
@@ -0,0 +1,63 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func collectedValues(t *testing.T, c *procCollector) map[string]float64 {
+	collected, err := c.collect()
+	require.NoError(t, err)
+
+	values := make(map[string]float64, len(collected))
+	for _, metric := range collected {
+		values[metric.ID] = metric.GetValueField()
+	}
+
+	return values
+}
+
+func TestProcCollector(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"meminfo", "stat", "loadavg"} {
+		data, err := os.ReadFile(filepath.Join("testdata", "proc", name))
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(root, name), data, 0644))
+	}
+	c := newProcCollector(root)
+
+	// в первый раз загрузка ядер -- с момента загрузки машины
+	values := collectedValues(t, c)
+	assert.Equal(t, float64(16318208*1024), values["TotalMemory"])
+	assert.Equal(t, float64(2097152*1024), values["FreeMemory"])
+	assert.InDelta(t, 40.0, values["CPUutilization1"], 0.001)
+	assert.InDelta(t, 100.0/3, values["CPUutilization2"], 0.001)
+	assert.NotContains(t, values, "CPUutilization3")
+	assert.Equal(t, 0.52, values["LoadAverage1"])
+	assert.Equal(t, 0.58, values["LoadAverage5"])
+	assert.Equal(t, 0.59, values["LoadAverage15"])
+
+	// дальше -- за время с прошлого опроса: cpu0 +100 тиков, из них 25 простоя, cpu1 стоял
+	stat := `cpu  4075 0 2000 12025 1000 0 1000 0 0 0
+cpu0 1075 0 500 3025 0 0 500 0 0 0
+cpu1 3000 0 1500 9000 1000 0 500 0 0 0
+`
+	require.NoError(t, os.WriteFile(filepath.Join(root, "stat"), []byte(stat), 0644))
+	values = collectedValues(t, c)
+	assert.InDelta(t, 75.0, values["CPUutilization1"], 0.001)
+	assert.Equal(t, 0.0, values["CPUutilization2"])
+}
+
+func TestProcCollectorErrors(t *testing.T) {
+	_, err := newProcCollector(t.TempDir()).collect()
+	assert.Error(t, err)
+
+	root := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(root, "meminfo"), []byte("MemTotal: abc kB\n"), 0644))
+	_, err = newProcCollector(root).collect()
+	assert.Error(t, err)
+}
@@ -0,0 +1,206 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"prayago-metricsalert/internal/fileutil"
+	"prayago-metricsalert/internal/logger"
+	"prayago-metricsalert/internal/metrics"
+)
+
+// errServerUnavailable -- пачку стоит отправить позже: сервер не ответил или ответил 5xx.
+// На 4xx повтор не поможет, такие пачки в очередь не попадают.
+var errServerUnavailable = errors.New("server unavailable")
+
+const spoolExt = ".json.gz"
+
+type spoolFile struct {
+	name    string
+	created time.Time
+	size    int64
+}
+
+// spool -- очередь неотправленных пачек на диске, по файлу на пачку, имя -- время создания
+// в наносекундах, так что порядок файлов -- порядок пачек. Пачки хранятся сжатыми, как их
+// отправляет postJSON. Очередь ограничена размером и возрастом, при переполнении
+// выбрасываются самые старые пачки. Выброшенные, в том числе отклоненные сервером
+// при повторной отправке, считаются в dropped.
+type spool struct {
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+
+	mu    sync.Mutex // держится и на время отправки, чтобы пачки уходили по порядку
+	files []spoolFile
+	size  int64
+	last  int64
+
+	// для stats без mu: отправка может идти долго
+	queued  atomic.Int64
+	dropped atomic.Int64
+}
+
+// openSpool подхватывает пачки, не отправленные прошлым запуском агента
+func openSpool(dir string, maxBytes int64, maxAge time.Duration) (*spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &spool{dir: dir, maxBytes: maxBytes, maxAge: maxAge}
+	for _, entry := range entries {
+		name := entry.Name()
+		// недописанная пачка: агент упал между записью и переименованием
+		if fileutil.IsTemp(name) {
+			if err := os.Remove(filepath.Join(dir, name)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		created, err := strconv.ParseInt(strings.TrimSuffix(name, spoolExt), 10, 64)
+		if entry.IsDir() || !strings.HasSuffix(name, spoolExt) || err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		s.files = append(s.files, spoolFile{name: name, created: time.Unix(0, created), size: info.Size()})
+		s.size += info.Size()
+		s.last = max(s.last, created)
+	}
+	s.queued.Store(int64(len(s.files)))
+	sort.Slice(s.files, func(i, j int) bool {
+		return s.files[i].name < s.files[j].name
+	})
+
+	return s, nil
+}
+
+// deliver отправляет сначала накопленные пачки, потом body. Если сервер недоступен,
+// все неотправленное, включая body, остается в очереди до следующего раза.
+// Если отправку отменили, очередь не меняется, а body в нее не попадает: сервер мог
+// пачку уже применить, а при остановке агента ее метрики уйдут последней пачкой.
+func (s *spool) deliver(body []byte, send func(body []byte) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.dropExpired(time.Now())
+	for len(s.files) > 0 {
+		file := s.files[0]
+		queued, err := os.ReadFile(filepath.Join(s.dir, file.name))
+		if err == nil {
+			err = send(queued)
+		}
+		if cancelled(err) {
+			return err
+		}
+		if errors.Is(err, errServerUnavailable) {
+			return errors.Join(err, s.push(body))
+		}
+		if err != nil {
+			s.drop("rejected: " + err.Error())
+			continue
+		}
+		s.remove()
+	}
+
+	err := send(body)
+	if errors.Is(err, errServerUnavailable) {
+		return errors.Join(err, s.push(body))
+	}
+
+	return err
+}
+
+func cancelled(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// push кладет пачку в конец очереди и выбрасывает самые старые, пока очередь не влезет в maxBytes
+func (s *spool) push(body []byte) error {
+	created := max(time.Now().UnixNano(), s.last+1)
+	name := fmt.Sprintf("%020d%s", created, spoolExt)
+
+	if err := fileutil.WriteAtomic(filepath.Join(s.dir, name), body, nil); err != nil {
+		return err
+	}
+
+	s.files = append(s.files, spoolFile{name: name, created: time.Unix(0, created), size: int64(len(body))})
+	s.size += int64(len(body))
+	s.last = created
+	s.queued.Add(1)
+
+	for s.maxBytes > 0 && s.size > s.maxBytes && len(s.files) > 0 {
+		s.drop("spool is full")
+	}
+	logger.LogSugar.Infoln("Batch is spooled:", name, "queued", len(s.files), "bytes", s.size)
+
+	return nil
+}
+
+func (s *spool) dropExpired(now time.Time) {
+	for s.maxAge > 0 && len(s.files) > 0 && now.Sub(s.files[0].created) > s.maxAge {
+		s.drop("batch is too old")
+	}
+}
+
+func (s *spool) drop(reason string) {
+	dropped := s.dropped.Add(1)
+	logger.LogSugar.Warnln("Dropping spooled batch:", s.files[0].name, reason, "dropped total", dropped)
+	s.remove()
+}
+
+func (s *spool) remove() {
+	file := s.files[0]
+	if err := os.Remove(filepath.Join(s.dir, file.name)); err != nil && !os.IsNotExist(err) {
+		logger.LogSugar.Errorln("Error removing spooled batch:", err)
+	}
+	s.files = s.files[1:]
+	s.size -= file.size
+	s.queued.Add(-1)
+}
+
+// stats -- сколько пачек ждут отправки и сколько выброшено с запуска агента
+func (s *spool) stats() (queued int64, dropped int64) {
+	return s.queued.Load(), s.dropped.Load()
+}
+
+// spoolCollector -- gauge SpoolQueued и SpoolDropped: сколько пачек ждут отправки на диске
+// и сколько выброшено из-за ограничений спула с запуска агента
+type spoolCollector struct {
+	spool *spool
+}
+
+func (c spoolCollector) Name() string {
+	return "spool"
+}
+
+func (c spoolCollector) Interval() time.Duration {
+	return 0
+}
+
+func (c spoolCollector) Collect(ctx context.Context) ([]Metric, error) {
+	queued, dropped := c.spool.stats()
+	queuedValue, droppedValue := float64(queued), float64(dropped)
+
+	return []Metric{
+		{ID: "SpoolQueued", MType: metrics.GaugeMetric, Value: &queuedValue},
+		{ID: "SpoolDropped", MType: metrics.GaugeMetric, Value: &droppedValue},
+	}, nil
+}
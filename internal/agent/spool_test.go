@@ -0,0 +1,207 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"prayago-metricsalert/internal/fileutil"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// сервер недоступен -- пачки копятся на диске, сервер вернулся -- уходят по порядку
+func TestSpoolReplaysInOrder(t *testing.T) {
+	var mu sync.Mutex
+	status := http.StatusServiceUnavailable
+	var received []string
+	srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if status == http.StatusOK {
+			body, err := gunzipRequest(req)
+			require.NoError(t, err)
+			received = append(received, body)
+		}
+		res.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	agent := NewAgent(AgentConfig{
+		serverAddress: strings.TrimPrefix(srv.URL, "http://"),
+		spoolDir:      dir,
+		spoolMaxSize:  1 << 20,
+		spoolMaxAge:   time.Hour,
+	})
+
+	for i := 1; i <= 3; i++ {
+		err := agent.sendMetricsBatch(context.Background(), batchOf(i))
+		assert.ErrorIs(t, err, errServerUnavailable)
+	}
+	queued, dropped := agent.spool.stats()
+	assert.Equal(t, int64(3), queued)
+	assert.Zero(t, dropped)
+
+	// очередь переживает перезапуск агента
+	agent.spool, _ = openSpool(dir, 1<<20, time.Hour)
+	queued, _ = agent.spool.stats()
+	assert.Equal(t, int64(3), queued)
+
+	mu.Lock()
+	status = http.StatusOK
+	mu.Unlock()
+	require.NoError(t, agent.sendMetricsBatch(context.Background(), batchOf(4)))
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, received, 4)
+	for i, body := range received {
+		assert.Contains(t, body, fmt.Sprintf(`"value":%d`, i+1))
+	}
+	queued, _ = agent.spool.stats()
+	assert.Zero(t, queued)
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+// на 4xx повтор не поможет, пачка не сохраняется
+func TestSpoolSkipsRejectedBatch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	agent := NewAgent(AgentConfig{serverAddress: strings.TrimPrefix(srv.URL, "http://"), spoolDir: t.TempDir()})
+	err := agent.sendMetricsBatch(context.Background(), batchOf(1))
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, errServerUnavailable)
+
+	queued, _ := agent.spool.stats()
+	assert.Zero(t, queued)
+}
+
+func TestSpoolLimits(t *testing.T) {
+	unavailable := func([]byte) error { return errServerUnavailable }
+	body := []byte("0123456789")
+
+	// в 25 байт влезают две пачки, самые старые выбрасываются
+	s, err := openSpool(t.TempDir(), 25, 0)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		assert.ErrorIs(t, s.deliver(body, unavailable), errServerUnavailable)
+	}
+	queued, dropped := s.stats()
+	assert.Equal(t, int64(2), queued)
+	assert.Equal(t, int64(3), dropped)
+
+	// устаревшие пачки выбрасываются перед отправкой
+	s, err = openSpool(t.TempDir(), 0, time.Minute)
+	require.NoError(t, err)
+	require.ErrorIs(t, s.deliver(body, unavailable), errServerUnavailable)
+	s.files[0].created = time.Now().Add(-time.Hour)
+
+	var sent int
+	require.NoError(t, s.deliver(body, func([]byte) error {
+		sent++
+		return nil
+	}))
+	assert.Equal(t, 1, sent)
+	queued, dropped = s.stats()
+	assert.Zero(t, queued)
+	assert.Equal(t, int64(1), dropped)
+}
+
+// пачка из очереди, которую сервер потом отклонил, тоже считается выброшенной
+func TestSpoolDropsRejectedQueuedBatch(t *testing.T) {
+	s, err := openSpool(t.TempDir(), 0, 0)
+	require.NoError(t, err)
+	require.ErrorIs(t, s.deliver([]byte("queued"), func([]byte) error { return errServerUnavailable }), errServerUnavailable)
+
+	var sent []string
+	require.NoError(t, s.deliver([]byte("fresh"), func(body []byte) error {
+		sent = append(sent, string(body))
+		if string(body) == "queued" {
+			return errors.New("server responded with status 400")
+		}
+		return nil
+	}))
+	assert.Equal(t, []string{"queued", "fresh"}, sent)
+	queued, dropped := s.stats()
+	assert.Zero(t, queued)
+	assert.Equal(t, int64(1), dropped)
+}
+
+// недописанные при падении файлы удаляются, целые пачки остаются в очереди
+func TestSpoolRemovesTmpFiles(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openSpool(dir, 0, 0)
+	require.NoError(t, err)
+	require.ErrorIs(t, s.deliver([]byte("batch"), func([]byte) error { return errServerUnavailable }), errServerUnavailable)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "00000000000000000001"+spoolExt+fileutil.TmpSuffix+"123"), []byte("torn"), 0644))
+
+	s, err = openSpool(dir, 0, 0)
+	require.NoError(t, err)
+	queued, _ := s.stats()
+	assert.Equal(t, int64(1), queued)
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.Equal(t, s.files[0].name, files[0].Name())
+}
+
+// отмененная отправка не попадает в очередь и не трогает ее
+func TestSpoolSkipsCancelledBatch(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		select {
+		case <-release:
+		case <-req.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	agent := NewAgent(AgentConfig{serverAddress: strings.TrimPrefix(srv.URL, "http://"), spoolDir: t.TempDir()})
+	queuedBatch, err := gzipBody([]byte(`[{"id":"Alloc","type":"gauge","value":0}]`))
+	require.NoError(t, err)
+	require.NoError(t, agent.spool.push(queuedBatch))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = agent.sendMetricsBatch(ctx, batchOf(1))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.NotErrorIs(t, err, errServerUnavailable)
+
+	queued, dropped := agent.spool.stats()
+	assert.Equal(t, int64(1), queued)
+	assert.Zero(t, dropped)
+}
+
+func batchOf(value int) []Metric {
+	v := float64(value)
+	return []Metric{{ID: "Alloc", MType: "gauge", Value: &v}}
+}
+
+func gunzipRequest(req *http.Request) (string, error) {
+	if req.Header.Get("Content-Encoding") != "gzip" {
+		return "", errors.New("request is not gzipped")
+	}
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return "", err
+	}
+	plain, err := gunzipBody(body)
+	return string(plain), err
+}
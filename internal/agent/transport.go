@@ -0,0 +1,86 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// режимы отправки, -mode
+const (
+	modeURL   = "url"   // POST /update/{type}/{name}/{value}, по запросу на метрику
+	modeJSON  = "json"  // POST /update/ с JSON, по запросу на метрику
+	modeBatch = "batch" // POST /updates/ со всеми метриками разом, со спулом, если он включен
+)
+
+// Transport -- способ доставки метрик на сервер. Отчет делится на запросы
+// по MaxBatch метрик, запросы уходят в пул воркеров по отдельности.
+type Transport interface {
+	MaxBatch() int // 0 -- весь отчет одним запросом
+	Send(ctx context.Context, batch []Metric) error
+}
+
+// newTransport -- транспорт для режима config.mode, пустой режим -- batch.
+// В адресе не подписать и не зашифровать значение, так что режим url
+// с ключом подписи или шифрования -- ошибка, а не молча открытые запросы.
+func newTransport(config AgentConfig, agent *Agent) (Transport, error) {
+	switch mode := config.mode; mode {
+	case modeURL:
+		if config.key != "" || config.cryptoKey != "" {
+			return nil, fmt.Errorf("transport mode %s can not sign or encrypt requests, use %s or %s with -k and -crypto-key", modeURL, modeJSON, modeBatch)
+		}
+		return urlTransport{agent}, nil
+	case modeJSON:
+		return jsonTransport{agent}, nil
+	case modeBatch, "":
+		return batchTransport{agent}, nil
+	default:
+		return nil, fmt.Errorf("unknown transport mode %q, expected %s, %s or %s", mode, modeURL, modeJSON, modeBatch)
+	}
+}
+
+type urlTransport struct {
+	agent *Agent
+}
+
+func (t urlTransport) MaxBatch() int {
+	return 1
+}
+
+func (t urlTransport) Send(ctx context.Context, batch []Metric) error {
+	var errs []error
+	for _, metric := range batch {
+		errs = append(errs, t.agent.doPostMetric(ctx, metric))
+	}
+
+	return errors.Join(errs...)
+}
+
+type jsonTransport struct {
+	agent *Agent
+}
+
+func (t jsonTransport) MaxBatch() int {
+	return 1
+}
+
+func (t jsonTransport) Send(ctx context.Context, batch []Metric) error {
+	var errs []error
+	for _, metric := range batch {
+		errs = append(errs, t.agent.doSendJSONMetric(ctx, metric))
+	}
+
+	return errors.Join(errs...)
+}
+
+type batchTransport struct {
+	agent *Agent
+}
+
+func (t batchTransport) MaxBatch() int {
+	return 0
+}
+
+func (t batchTransport) Send(ctx context.Context, batch []Metric) error {
+	return t.agent.sendMetricsBatch(ctx, batch)
+}
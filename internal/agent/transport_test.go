@@ -0,0 +1,73 @@
+package agent
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// в каждом режиме отчет уходит одним способом, и каждая метрика -- ровно один раз
+func TestTransportModes(t *testing.T) {
+	tests := []struct {
+		mode     string
+		path     string
+		requests func(metrics int) int
+	}{
+		{mode: modeURL, path: "/update/", requests: func(metrics int) int { return metrics }},
+		{mode: modeJSON, path: "/update/", requests: func(metrics int) int { return metrics }},
+		{mode: modeBatch, path: "/updates/", requests: func(metrics int) int { return 1 }},
+		{mode: "", path: "/updates/", requests: func(metrics int) int { return 1 }},
+	}
+	for _, test := range tests {
+		t.Run(test.mode, func(t *testing.T) {
+			var mu sync.Mutex
+			requests := make(map[string]int)
+			srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				path := req.URL.Path
+				if strings.HasPrefix(path, "/update/") {
+					path = "/update/"
+				}
+				requests[path]++
+			}))
+			defer srv.Close()
+
+			agent := NewAgent(AgentConfig{serverAddress: strings.TrimPrefix(srv.URL, "http://"), mode: test.mode})
+			agent.updateMetrics()
+			snapshot := agent.snapshot()
+			require.NotEmpty(t, snapshot)
+
+			jobs := agent.sendJobs()
+			assert.Len(t, jobs, test.requests(len(snapshot)))
+			for _, job := range jobs {
+				job(context.Background())
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			assert.Equal(t, map[string]int{test.path: test.requests(len(snapshot))}, requests)
+		})
+	}
+}
+
+func TestNewTransport(t *testing.T) {
+	transport, err := newTransport(AgentConfig{mode: modeJSON, key: "secret"}, nil)
+	require.NoError(t, err)
+	assert.IsType(t, jsonTransport{}, transport)
+
+	_, err = newTransport(AgentConfig{mode: "grpc"}, nil)
+	assert.Error(t, err)
+
+	// в адресе подпись и шифрование не передать
+	_, err = newTransport(AgentConfig{mode: modeURL, key: "secret"}, nil)
+	assert.Error(t, err)
+	_, err = newTransport(AgentConfig{mode: modeURL, cryptoKey: "server.pub"}, nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,242 @@
+package alerts
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"prayago-metricsalert/internal/logger"
+	"prayago-metricsalert/internal/metrics"
+)
+
+type Metric = metrics.Metric
+type Labels = metrics.Labels
+
+const (
+	StateInactive = "inactive"
+	StatePending  = "pending"
+	StateFiring   = "firing"
+	StateResolved = "resolved"
+	StateAll      = "all"
+)
+
+type EngineConfig struct {
+	RulesFPath       string
+	EvaluateInterval time.Duration
+	Webhook          WebhookConfig
+}
+
+// движку нужен только доступ на чтение к метрикам по ключу серии,
+// storage.Storager этому интерфейсу удовлетворяет
+type MetricGetter interface {
+	GetMetric(key string) (*Metric, error)
+}
+
+// то, что нужно серверу от движка алертов для хендлеров
+type Alerter interface {
+	Alerts(state string) []Alert
+	FailedDeliveries() []Delivery
+}
+
+type Alert struct {
+	Rule       Rule       `json:"rule"`
+	State      string     `json:"state"`
+	Value      *float64   `json:"value,omitempty"`       // последнее значение метрики, nil если метрики нет
+	ActiveAt   *time.Time `json:"active_at,omitempty"`   // когда условие начало выполняться
+	FiredAt    *time.Time `json:"fired_at,omitempty"`    // когда алерт перешел в firing
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"` // когда сработавший алерт погас
+}
+
+type Engine struct {
+	config   EngineConfig
+	store    MetricGetter
+	rules    []Rule
+	notifier Notifier
+
+	mu     sync.RWMutex
+	alerts map[string]*Alert
+
+	stop      chan struct{}
+	done      chan struct{}
+	notifying bool // notifier запущен в Start
+}
+
+// NewEngine читает правила из config.RulesFPath. Если файл задан, но не читается,
+// это ошибка: иначе сервер молча работал бы без алертов.
+func NewEngine(config EngineConfig, store MetricGetter) (*Engine, error) {
+	var rules []Rule
+	if config.RulesFPath != "" {
+		var err error
+		if rules, err = LoadRules(config.RulesFPath); err != nil {
+			return nil, fmt.Errorf("error loading alert rules from %s: %w", config.RulesFPath, err)
+		}
+	}
+
+	var notifier Notifier
+	if len(config.Webhook.URLs) > 0 {
+		notifier = NewWebhookNotifier(config.Webhook)
+	}
+
+	return NewEngineWithRules(config, store, rules, notifier), nil
+}
+
+// notifier может быть nil, тогда о смене состояний никому не сообщаем
+func NewEngineWithRules(config EngineConfig, store MetricGetter, rules []Rule, notifier Notifier) *Engine {
+	engine := &Engine{
+		config:   config,
+		store:    store,
+		rules:    rules,
+		notifier: notifier,
+		alerts:   make(map[string]*Alert, len(rules)),
+	}
+
+	for _, rule := range rules {
+		engine.alerts[rule.Name] = &Alert{Rule: rule, State: StateInactive}
+	}
+
+	logger.LogSugar.Infof("Alert engine created, config: %v, rules: %d", config, len(rules))
+
+	return engine
+}
+
+func (e *Engine) Start() {
+	if e.config.EvaluateInterval <= 0 || len(e.rules) == 0 || e.stop != nil {
+		return
+	}
+
+	if e.notifier != nil && !e.notifying {
+		e.notifier.Start()
+		e.notifying = true
+	}
+
+	e.stop = make(chan struct{})
+	e.done = make(chan struct{})
+	go func() {
+		defer close(e.done)
+		ticker := time.NewTicker(e.config.EvaluateInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-e.stop:
+				return
+			case now := <-ticker.C:
+				e.Evaluate(now)
+			}
+		}
+	}()
+}
+
+// Stop перестает проверять правила. Уведомления, которые уже в очереди,
+// досылает StopNotifier: хранилище можно закрыть между ними.
+func (e *Engine) Stop() {
+	if e.stop == nil {
+		return
+	}
+
+	close(e.stop)
+	<-e.done
+	e.stop = nil
+}
+
+// StopNotifier досылает очередь уведомлений, сколько ждать -- решает notifier
+func (e *Engine) StopNotifier() {
+	if !e.notifying {
+		return
+	}
+
+	e.notifier.Stop()
+	e.notifying = false
+}
+
+// Evaluate проверяет все правила на момент now и двигает состояния алертов:
+// inactive -> pending -> firing -> resolved -> pending ...
+// Правило с нулевым for сразу переходит в firing.
+// О каждой смене состояния сообщаем notifier'у, если он есть.
+func (e *Engine) Evaluate(now time.Time) {
+	for _, rule := range e.rules {
+		value, found := e.metricValue(rule.SeriesKey())
+
+		e.mu.Lock()
+		alert := e.alerts[rule.Name]
+		previousState := alert.State
+		if found {
+			alert.Value = &value
+		} else {
+			alert.Value = nil
+		}
+
+		if found && rule.Matches(value) {
+			if alert.State != StatePending && alert.State != StateFiring {
+				alert.State = StatePending
+				alert.ActiveAt = timePtr(now)
+				alert.FiredAt = nil
+				alert.ResolvedAt = nil
+			}
+			if alert.State == StatePending && now.Sub(*alert.ActiveAt) >= rule.For {
+				alert.State = StateFiring
+				alert.FiredAt = timePtr(now)
+				logger.LogSugar.Infof("alert %s is firing, value %v", rule.Name, value)
+			}
+		} else {
+			switch alert.State {
+			case StateFiring:
+				alert.State = StateResolved
+				alert.ResolvedAt = timePtr(now)
+				logger.LogSugar.Infof("alert %s is resolved", rule.Name)
+			case StatePending:
+				alert.State = StateInactive
+				alert.ActiveAt = nil
+			}
+		}
+		changed := *alert
+		e.mu.Unlock()
+
+		if changed.State != previousState && e.notifier != nil {
+			e.notifier.Notify(changed, previousState)
+		}
+	}
+}
+
+// Alerts отдает копии алертов в заданном состоянии, StateAll -- все
+func (e *Engine) Alerts(state string) []Alert {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	alerts := make([]Alert, 0, len(e.rules))
+	for _, rule := range e.rules {
+		alert := e.alerts[rule.Name]
+		if state == StateAll || alert.State == state {
+			alerts = append(alerts, *alert)
+		}
+	}
+
+	return alerts
+}
+
+func (e *Engine) FailedDeliveries() []Delivery {
+	if e.notifier == nil {
+		return []Delivery{}
+	}
+
+	return e.notifier.FailedDeliveries()
+}
+
+func (e *Engine) metricValue(key string) (float64, bool) {
+	metric, err := e.store.GetMetric(key)
+	if err != nil || metric == nil {
+		return 0, false
+	}
+
+	switch {
+	case metric.MType == metrics.GaugeMetric && metric.Value != nil:
+		return *metric.Value, true
+	case metric.MType == metrics.CounterMetric && metric.Delta != nil:
+		return float64(*metric.Delta), true
+	}
+
+	return 0, false
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
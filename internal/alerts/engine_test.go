@@ -0,0 +1,137 @@
+package alerts
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"prayago-metricsalert/internal/metrics"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type dummyGetter map[string]Metric
+
+func (g dummyGetter) GetMetric(name string) (*Metric, error) {
+	if metric, present := g[name]; present {
+		return &metric, nil
+	}
+
+	return nil, errors.New("metric not found")
+}
+
+func (g dummyGetter) setGauge(name string, value float64) {
+	metric := metrics.NewMetric(name, metrics.GaugeMetric)
+	*metric.Value = value
+	g[name] = metric
+}
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules([]byte(`[
+		{"metric": "Alloc", "op": ">", "threshold": 100, "for": "30s"},
+		{"name": "NoPolls", "metric": "PollCount", "op": "==", "threshold": 0}
+	]`))
+	require.NoError(t, err)
+	require.Len(t, rules, 2)
+
+	assert.Equal(t, "Alloc>100", rules[0].Name)
+	assert.Equal(t, 30*time.Second, rules[0].For)
+	assert.Equal(t, "NoPolls", rules[1].Name)
+	assert.Equal(t, time.Duration(0), rules[1].For)
+
+	_, err = ParseRules([]byte(`[{"metric": "Alloc", "op": "~", "threshold": 1}]`))
+	assert.Error(t, err)
+
+	_, err = ParseRules([]byte(`[{"metric": "Alloc", "op": ">", "threshold": 1, "for": "soon"}]`))
+	assert.Error(t, err)
+}
+
+// заданный, но негодный файл правил -- ошибка, а не движок без правил
+func TestNewEngineRulesFile(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good.json")
+	require.NoError(t, os.WriteFile(good, []byte(`[{"name":"HighAlloc","metric":"Alloc","op":">","threshold":1}]`), 0666))
+	bad := filepath.Join(dir, "bad.json")
+	require.NoError(t, os.WriteFile(bad, []byte(`[{"name":"HighAlloc"`), 0666))
+
+	engine, err := NewEngine(EngineConfig{RulesFPath: good}, dummyGetter{})
+	require.NoError(t, err)
+	assert.Len(t, engine.Alerts(StateAll), 1)
+
+	_, err = NewEngine(EngineConfig{RulesFPath: bad}, dummyGetter{})
+	assert.Error(t, err)
+	_, err = NewEngine(EngineConfig{RulesFPath: filepath.Join(dir, "missing.json")}, dummyGetter{})
+	assert.Error(t, err)
+
+	engine, err = NewEngine(EngineConfig{}, dummyGetter{})
+	require.NoError(t, err)
+	assert.Empty(t, engine.Alerts(StateAll))
+}
+
+func TestEvaluateStateTransitions(t *testing.T) {
+	store := dummyGetter{}
+	rule := Rule{Name: "HighAlloc", MetricID: "Alloc", Op: OpGreater, Threshold: 100, For: time.Minute}
+	engine := NewEngineWithRules(EngineConfig{}, store, []Rule{rule}, nil)
+	start := time.Now()
+
+	// метрики нет -- алерт неактивен
+	engine.Evaluate(start)
+	assert.Equal(t, StateInactive, engine.Alerts(StateAll)[0].State)
+
+	store.setGauge("Alloc", 150)
+	engine.Evaluate(start)
+	assert.Equal(t, StatePending, engine.Alerts(StateAll)[0].State)
+	assert.Empty(t, engine.Alerts(StateFiring))
+
+	engine.Evaluate(start.Add(30 * time.Second))
+	assert.Equal(t, StatePending, engine.Alerts(StateAll)[0].State)
+
+	engine.Evaluate(start.Add(time.Minute))
+	firing := engine.Alerts(StateFiring)
+	require.Len(t, firing, 1)
+	assert.Equal(t, 150.0, *firing[0].Value)
+	assert.Equal(t, start, *firing[0].ActiveAt)
+
+	store.setGauge("Alloc", 50)
+	engine.Evaluate(start.Add(2 * time.Minute))
+	resolved := engine.Alerts(StateResolved)
+	require.Len(t, resolved, 1)
+	assert.NotNil(t, resolved[0].ResolvedAt)
+
+	// снова выше порога -- опять ждем for
+	store.setGauge("Alloc", 200)
+	engine.Evaluate(start.Add(3 * time.Minute))
+	assert.Equal(t, StatePending, engine.Alerts(StateAll)[0].State)
+}
+
+func TestEvaluatePendingDropsToInactive(t *testing.T) {
+	store := dummyGetter{}
+	rule := Rule{Name: "LowRandom", MetricID: "RandomValue", Op: OpLess, Threshold: 0.1, For: time.Minute}
+	engine := NewEngineWithRules(EngineConfig{}, store, []Rule{rule}, nil)
+	start := time.Now()
+
+	store.setGauge("RandomValue", 0.05)
+	engine.Evaluate(start)
+	assert.Equal(t, StatePending, engine.Alerts(StateAll)[0].State)
+
+	store.setGauge("RandomValue", 0.5)
+	engine.Evaluate(start.Add(time.Second))
+	assert.Equal(t, StateInactive, engine.Alerts(StateAll)[0].State)
+	assert.Nil(t, engine.Alerts(StateAll)[0].ActiveAt)
+}
+
+func TestEvaluateCounterWithoutFor(t *testing.T) {
+	store := dummyGetter{}
+	counter := metrics.NewMetric("PollCount", metrics.CounterMetric)
+	*counter.Delta = 10
+	store["PollCount"] = counter
+
+	rule := Rule{Name: "ManyPolls", MetricID: "PollCount", Op: OpGreaterEqual, Threshold: 10}
+	engine := NewEngineWithRules(EngineConfig{}, store, []Rule{rule}, nil)
+
+	engine.Evaluate(time.Now())
+	assert.Len(t, engine.Alerts(StateFiring), 1)
+}
@@ -0,0 +1,146 @@
+package alerts
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"prayago-metricsalert/internal/metrics"
+	"time"
+)
+
+const (
+	OpGreater      = ">"
+	OpGreaterEqual = ">="
+	OpLess         = "<"
+	OpLessEqual    = "<="
+	OpEqual        = "=="
+	OpNotEqual     = "!="
+)
+
+type Rule struct {
+	Name      string        `json:"name"`             // имя правила, по умолчанию собирается из метрики, оператора и порога
+	MetricID  string        `json:"metric"`           // имя метрики, значение которой проверяем
+	Op        string        `json:"op"`               // оператор сравнения: >, >=, <, <=, ==, !=
+	Threshold float64       `json:"threshold"`        // порог
+	For       time.Duration `json:"for"`              // сколько условие должно выполняться, чтобы алерт сработал
+	Labels    Labels        `json:"labels,omitempty"` // метки серии, если у метрики их несколько
+}
+
+// в JSON удобнее писать "for": "30s", а не наносекунды,
+// поэтому, как и у метрики, свой UnmarshalJSON
+func (r *Rule) UnmarshalJSON(data []byte) error {
+	type RuleAlias Rule
+	aliasValue := &struct {
+		*RuleAlias
+		For string `json:"for"`
+	}{
+		RuleAlias: (*RuleAlias)(r),
+	}
+
+	if err := json.Unmarshal(data, aliasValue); err != nil {
+		return err
+	}
+
+	r.For = 0
+	if aliasValue.For != "" {
+		duration, err := time.ParseDuration(aliasValue.For)
+		if err != nil {
+			return fmt.Errorf("rule %s: wrong for duration %q: %w", r.Name, aliasValue.For, err)
+		}
+		r.For = duration
+	}
+
+	return nil
+}
+
+func (r Rule) MarshalJSON() ([]byte, error) {
+	type RuleAlias Rule
+	return json.Marshal(&struct {
+		RuleAlias
+		For string `json:"for"`
+	}{
+		RuleAlias: RuleAlias(r),
+		For:       r.For.String(),
+	})
+}
+
+func (r Rule) Validate() error {
+	if r.MetricID == "" {
+		return errors.New("rule metric is empty")
+	}
+
+	switch r.Op {
+	case OpGreater, OpGreaterEqual, OpLess, OpLessEqual, OpEqual, OpNotEqual:
+	default:
+		return fmt.Errorf("rule %s: unsupported op %q", r.Name, r.Op)
+	}
+
+	if err := r.Labels.Validate(); err != nil {
+		return fmt.Errorf("rule %s: %w", r.Name, err)
+	}
+
+	if r.For < 0 {
+		return fmt.Errorf("rule %s: negative for duration", r.Name)
+	}
+
+	return nil
+}
+
+// SeriesKey -- ключ серии, значение которой проверяет правило
+func (r Rule) SeriesKey() string {
+	return metrics.SeriesKey(r.MetricID, r.Labels)
+}
+
+func (r Rule) Matches(value float64) bool {
+	switch r.Op {
+	case OpGreater:
+		return value > r.Threshold
+	case OpGreaterEqual:
+		return value >= r.Threshold
+	case OpLess:
+		return value < r.Threshold
+	case OpLessEqual:
+		return value <= r.Threshold
+	case OpEqual:
+		return value == r.Threshold
+	case OpNotEqual:
+		return value != r.Threshold
+	}
+
+	return false
+}
+
+func LoadRules(fpath string) ([]Rule, error) {
+	data, err := os.ReadFile(fpath)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseRules(data)
+}
+
+func ParseRules(data []byte) ([]Rule, error) {
+	var rules []Rule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool, len(rules))
+	for i := range rules {
+		if rules[i].Name == "" {
+			rules[i].Name = fmt.Sprintf("%s%s%v", rules[i].SeriesKey(), rules[i].Op, rules[i].Threshold)
+		}
+
+		if err := rules[i].Validate(); err != nil {
+			return nil, err
+		}
+
+		if names[rules[i].Name] {
+			return nil, fmt.Errorf("duplicate rule name %s", rules[i].Name)
+		}
+		names[rules[i].Name] = true
+	}
+
+	return rules, nil
+}
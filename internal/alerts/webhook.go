@@ -0,0 +1,219 @@
+package alerts
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"prayago-metricsalert/internal/logger"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// сколько последних неудачных доставок держим в памяти для /alerts/failed
+const maxFailedDeliveries = 100
+
+type Notifier interface {
+	Notify(alert Alert, previousState string)
+	FailedDeliveries() []Delivery
+	Start()
+	Stop()
+}
+
+type WebhookConfig struct {
+	URLs          []string
+	QueueSize     int
+	RetryCount    int
+	RetryWaitTime time.Duration // пауза перед первым повтором, дальше растет: 1-3-5...
+	Timeout       time.Duration // на одну попытку доставки
+	StopTimeout   time.Duration // сколько Stop ждет отправки очереди, дальше она считается недоставленной
+}
+
+// Notification -- то, что уходит POST'ом на вебхук
+type Notification struct {
+	Alert
+	PreviousState string    `json:"previous_state"`
+	SentAt        time.Time `json:"sent_at"`
+}
+
+type Delivery struct {
+	URL          string       `json:"url"`
+	Notification Notification `json:"notification"`
+	Attempts     int          `json:"attempts"`
+	Error        string       `json:"error"`
+	FailedAt     time.Time    `json:"failed_at"`
+}
+
+type WebhookNotifier struct {
+	config WebhookConfig
+	client *resty.Client
+	queue  chan Notification
+
+	// отменяется, когда Stop перестает ждать: висящие запросы и ретраи обрываются
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu     sync.Mutex
+	failed []Delivery
+
+	wg sync.WaitGroup
+}
+
+func NewWebhookNotifier(config WebhookConfig) *WebhookNotifier {
+	if config.QueueSize <= 0 {
+		config.QueueSize = 100
+	}
+	if config.RetryWaitTime <= 0 {
+		config.RetryWaitTime = time.Second
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 5 * time.Second
+	}
+	if config.StopTimeout <= 0 {
+		config.StopTimeout = 10 * time.Second
+	}
+
+	// ретраи как у агента: 1-3-5 интервалов ожидания
+	client := resty.New()
+	client.
+		SetTimeout(config.Timeout).
+		SetRetryCount(config.RetryCount).
+		SetRetryWaitTime(config.RetryWaitTime).
+		SetRetryMaxWaitTime(15 * config.RetryWaitTime).
+		SetRetryAfter(
+			func(client *resty.Client, resp *resty.Response) (time.Duration, error) {
+				return time.Duration(resp.Request.Attempt*2-1) * config.RetryWaitTime, nil
+			},
+		).
+		AddRetryCondition(
+			func(r *resty.Response, err error) bool {
+				return err != nil || r.StatusCode() == http.StatusTooManyRequests || r.StatusCode() >= 500
+			},
+		)
+
+	logger.LogSugar.Infof("Webhook notifier created, config: %v", config)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &WebhookNotifier{
+		config: config,
+		client: client,
+		queue:  make(chan Notification, config.QueueSize),
+		ctx:    ctx,
+		cancel: cancel,
+		failed: make([]Delivery, 0),
+	}
+}
+
+func (wn *WebhookNotifier) Start() {
+	wn.wg.Add(1)
+	go func() {
+		defer wn.wg.Done()
+		for notification := range wn.queue {
+			for _, url := range wn.config.URLs {
+				wn.deliver(wn.ctx, url, notification)
+			}
+		}
+	}()
+}
+
+// Stop дожидается отправки того, что уже в очереди, но не дольше StopTimeout.
+// Потом обрывает отправку, а все недосланное записывает в недоставленные.
+func (wn *WebhookNotifier) Stop() {
+	close(wn.queue)
+
+	done := make(chan struct{})
+	go func() {
+		wn.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(wn.config.StopTimeout):
+		logger.LogSugar.Errorf("webhook notifier did not deliver the queue in %v, dropping the rest", wn.config.StopTimeout)
+		wn.cancel()
+		<-done
+	}
+	wn.cancel()
+}
+
+// Notify только кладет уведомление в очередь и никогда не блокируется:
+// если очередь переполнена, уведомление сразу считается недоставленным
+func (wn *WebhookNotifier) Notify(alert Alert, previousState string) {
+	notification := Notification{
+		Alert:         alert,
+		PreviousState: previousState,
+	}
+
+	select {
+	case wn.queue <- notification:
+	default:
+		for _, url := range wn.config.URLs {
+			wn.addFailed(url, notification, 0, errors.New("delivery queue is full"))
+		}
+	}
+}
+
+func (wn *WebhookNotifier) FailedDeliveries() []Delivery {
+	wn.mu.Lock()
+	defer wn.mu.Unlock()
+
+	failed := make([]Delivery, len(wn.failed))
+	copy(failed, wn.failed)
+	return failed
+}
+
+func (wn *WebhookNotifier) deliver(ctx context.Context, url string, notification Notification) {
+	// после отмены очередь только дописывается в недоставленные
+	if err := ctx.Err(); err != nil {
+		wn.addFailed(url, notification, 0, fmt.Errorf("notifier stopped: %w", err))
+		return
+	}
+
+	notification.SentAt = time.Now()
+	jsonValue, err := json.Marshal(notification)
+	if err != nil {
+		wn.addFailed(url, notification, 0, err)
+		return
+	}
+
+	resp, err := wn.client.R().
+		SetContext(ctx).
+		SetHeader("Content-Type", "application/json").
+		SetBody(jsonValue).
+		Post(url)
+
+	attempts := wn.config.RetryCount + 1
+	if resp != nil && resp.Request != nil {
+		attempts = resp.Request.Attempt
+	}
+
+	if err == nil && resp.IsError() {
+		err = fmt.Errorf("unexpected status %d", resp.StatusCode())
+	}
+
+	if err != nil {
+		logger.LogSugar.Errorf("webhook delivery to %s failed: %v", url, err)
+		wn.addFailed(url, notification, attempts, err)
+	}
+}
+
+func (wn *WebhookNotifier) addFailed(url string, notification Notification, attempts int, err error) {
+	wn.mu.Lock()
+	defer wn.mu.Unlock()
+
+	wn.failed = append(wn.failed, Delivery{
+		URL:          url,
+		Notification: notification,
+		Attempts:     attempts,
+		Error:        err.Error(),
+		FailedAt:     time.Now(),
+	})
+	if len(wn.failed) > maxFailedDeliveries {
+		wn.failed = wn.failed[len(wn.failed)-maxFailedDeliveries:]
+	}
+}
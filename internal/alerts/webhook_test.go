@@ -0,0 +1,155 @@
+package alerts
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookDeliversStateChanges(t *testing.T) {
+	var mu sync.Mutex
+	var received []Notification
+	receiver := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		var notification Notification
+		assert.NoError(t, json.NewDecoder(req.Body).Decode(&notification))
+		mu.Lock()
+		received = append(received, notification)
+		mu.Unlock()
+	}))
+	defer receiver.Close()
+
+	notifier := NewWebhookNotifier(WebhookConfig{URLs: []string{receiver.URL}})
+	store := dummyGetter{}
+	rule := Rule{Name: "HighAlloc", MetricID: "Alloc", Op: OpGreater, Threshold: 100}
+	engine := NewEngineWithRules(EngineConfig{}, store, []Rule{rule}, notifier)
+
+	notifier.Start()
+	store.setGauge("Alloc", 150)
+	engine.Evaluate(time.Now())
+	store.setGauge("Alloc", 50)
+	engine.Evaluate(time.Now())
+	notifier.Stop()
+
+	// pending и firing при нулевом for случаются за одну проверку, поэтому два уведомления
+	require.Len(t, received, 2)
+	assert.Equal(t, StateFiring, received[0].State)
+	assert.Equal(t, StateInactive, received[0].PreviousState)
+	assert.Equal(t, "HighAlloc", received[0].Rule.Name)
+	assert.Equal(t, StateResolved, received[1].State)
+	assert.Equal(t, StateFiring, received[1].PreviousState)
+	assert.Empty(t, notifier.FailedDeliveries())
+}
+
+func TestWebhookRetriesAndRecordsFailure(t *testing.T) {
+	var calls atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		calls.Add(1)
+		res.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer receiver.Close()
+
+	notifier := NewWebhookNotifier(WebhookConfig{
+		URLs:          []string{receiver.URL},
+		RetryCount:    2,
+		RetryWaitTime: time.Millisecond,
+	})
+	notifier.Start()
+	notifier.Notify(Alert{Rule: Rule{Name: "HighAlloc"}, State: StateFiring}, StatePending)
+	notifier.Stop()
+
+	assert.Equal(t, int32(3), calls.Load())
+	failed := notifier.FailedDeliveries()
+	require.Len(t, failed, 1)
+	assert.Equal(t, receiver.URL, failed[0].URL)
+	assert.Equal(t, 3, failed[0].Attempts)
+	assert.Equal(t, "HighAlloc", failed[0].Notification.Rule.Name)
+}
+
+func TestWebhookSlowReceiverDoesNotBlockNotify(t *testing.T) {
+	release := make(chan struct{})
+	arrived := make(chan struct{}, 5)
+	receiver := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		arrived <- struct{}{}
+		<-release
+	}))
+	defer receiver.Close()
+
+	notifier := NewWebhookNotifier(WebhookConfig{URLs: []string{receiver.URL}, QueueSize: 1})
+	notifier.Start()
+
+	alert := Alert{Rule: Rule{Name: "HighAlloc"}, State: StateFiring}
+	notifier.Notify(alert, StatePending)
+	<-arrived
+
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		notifier.Notify(alert, StatePending)
+	}
+	assert.Less(t, time.Since(start), time.Second)
+
+	close(release)
+	notifier.Stop()
+
+	// одно уведомление висит у получателя, одно лежит в очереди, остальные не влезли
+	assert.Len(t, notifier.FailedDeliveries(), 3)
+}
+
+// зависший получатель не держит Stop дольше StopTimeout, недосланное -- в недоставленных
+func TestWebhookStopGivesUpOnHungReceiver(t *testing.T) {
+	release := make(chan struct{})
+	arrived := make(chan struct{}, 5)
+	receiver := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		arrived <- struct{}{}
+		<-release
+	}))
+	defer receiver.Close()
+	defer close(release)
+
+	notifier := NewWebhookNotifier(WebhookConfig{
+		URLs:        []string{receiver.URL},
+		QueueSize:   5,
+		Timeout:     time.Minute,
+		StopTimeout: 50 * time.Millisecond,
+	})
+	notifier.Start()
+
+	alert := Alert{Rule: Rule{Name: "HighAlloc"}, State: StateFiring}
+	notifier.Notify(alert, StatePending)
+	<-arrived
+	notifier.Notify(alert, StatePending)
+	notifier.Notify(alert, StatePending)
+
+	start := time.Now()
+	notifier.Stop()
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	// висевший запрос и два из очереди
+	failed := notifier.FailedDeliveries()
+	require.Len(t, failed, 3)
+	for _, delivery := range failed {
+		assert.Equal(t, receiver.URL, delivery.URL)
+	}
+}
+
+func TestWebhookRequestTimeout(t *testing.T) {
+	release := make(chan struct{})
+	receiver := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+	defer receiver.Close()
+	defer close(release)
+
+	notifier := NewWebhookNotifier(WebhookConfig{URLs: []string{receiver.URL}, Timeout: 20 * time.Millisecond})
+	notifier.Start()
+	notifier.Notify(Alert{Rule: Rule{Name: "HighAlloc"}, State: StateFiring}, StatePending)
+	notifier.Stop()
+
+	assert.Len(t, notifier.FailedDeliveries(), 1)
+}
@@ -0,0 +1,163 @@
+// Package encryption -- гибридное шифрование тела запросов агента открытым ключом сервера.
+//
+// RSA-OAEP напрямую шифрует только пару сотен байт, поэтому тело шифруется AES-256-GCM
+// на случайном ключе, а RSA-OAEP (SHA-256) шифрует только этот ключ:
+//
+//	RSA-OAEP(ключ AES) | nonce GCM | AES-GCM(тело)
+//
+// Ключи в PEM, например:
+//
+//	openssl genrsa -out private.pem 4096
+//	openssl rsa -in private.pem -pubout -out public.pem
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Header -- заголовок зашифрованного запроса, значение -- Scheme
+const (
+	Header = "X-Encryption"
+	Scheme = "rsa-oaep-aes-256-gcm"
+)
+
+const aesKeySize = 32
+
+var ErrMalformed = errors.New("malformed encrypted message")
+
+func Encrypt(key *rsa.PublicKey, plain []byte) ([]byte, error) {
+	aesKey := make([]byte, aesKeySize)
+	if _, err := rand.Read(aesKey); err != nil {
+		return nil, err
+	}
+
+	encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, key, aesKey, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGCM(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	message := make([]byte, 0, len(encryptedKey)+len(nonce)+len(plain)+gcm.Overhead())
+	message = append(message, encryptedKey...)
+	message = append(message, nonce...)
+	return gcm.Seal(message, nonce, plain, nil), nil
+}
+
+func Decrypt(key *rsa.PrivateKey, message []byte) ([]byte, error) {
+	keySize := key.Size()
+	if len(message) < keySize {
+		return nil, ErrMalformed
+	}
+
+	aesKey, err := rsa.DecryptOAEP(sha256.New(), nil, key, message[:keySize], nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	if len(aesKey) != aesKeySize {
+		return nil, ErrMalformed
+	}
+
+	gcm, err := newGCM(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	message = message[keySize:]
+	if len(message) < gcm.NonceSize() {
+		return nil, ErrMalformed
+	}
+
+	plain, err := gcm.Open(nil, message[:gcm.NonceSize()], message[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+
+	return plain, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// LoadPublicKey читает открытый ключ из PEM: PUBLIC KEY (PKIX) или RSA PUBLIC KEY (PKCS#1)
+func LoadPublicKey(fpath string) (*rsa.PublicKey, error) {
+	block, err := readPEM(fpath)
+	if err != nil {
+		return nil, err
+	}
+
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if rsaKey, ok := key.(*rsa.PublicKey); ok {
+			return rsaKey, nil
+		}
+		return nil, fmt.Errorf("%s is not an RSA key", fpath)
+	}
+
+	return nil, fmt.Errorf("%s: unsupported PEM block %q", fpath, block.Type)
+}
+
+// LoadPrivateKey читает закрытый ключ из PEM: RSA PRIVATE KEY (PKCS#1) или PRIVATE KEY (PKCS#8)
+func LoadPrivateKey(fpath string) (*rsa.PrivateKey, error) {
+	block, err := readPEM(fpath)
+	if err != nil {
+		return nil, err
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if rsaKey, ok := key.(*rsa.PrivateKey); ok {
+			return rsaKey, nil
+		}
+		return nil, fmt.Errorf("%s is not an RSA key", fpath)
+	}
+
+	return nil, fmt.Errorf("%s: unsupported PEM block %q", fpath, block.Type)
+}
+
+func readPEM(fpath string) (*pem.Block, error) {
+	data, err := os.ReadFile(fpath)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", fpath)
+	}
+
+	return block, nil
+}
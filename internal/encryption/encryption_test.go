@@ -0,0 +1,81 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	// тело намного больше того, что RSA-OAEP шифрует напрямую
+	plain := bytes.Repeat([]byte(`{"id":"Alloc","type":"gauge","value":1.5}`), 1000)
+	message, err := Encrypt(&key.PublicKey, plain)
+	require.NoError(t, err)
+	assert.NotContains(t, string(message), "Alloc")
+
+	decrypted, err := Decrypt(key, message)
+	require.NoError(t, err)
+	assert.Equal(t, plain, decrypted)
+
+	message[len(message)-1] ^= 1
+	_, err = Decrypt(key, message)
+	assert.ErrorIs(t, err, ErrMalformed)
+
+	_, err = Decrypt(key, []byte("short"))
+	assert.ErrorIs(t, err, ErrMalformed)
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	message, err = Encrypt(&other.PublicKey, plain)
+	require.NoError(t, err)
+	_, err = Decrypt(key, message)
+	assert.ErrorIs(t, err, ErrMalformed)
+}
+
+func TestLoadKeys(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	dir := t.TempDir()
+
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	pkix, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+
+	files := map[string]*pem.Block{
+		"private.pem":       {Type: "PRIVATE KEY", Bytes: pkcs8},
+		"private-pkcs1.pem": {Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)},
+		"public.pem":        {Type: "PUBLIC KEY", Bytes: pkix},
+		"public-pkcs1.pem":  {Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&key.PublicKey)},
+	}
+	for name, block := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(block), 0600))
+	}
+
+	for _, name := range []string{"private.pem", "private-pkcs1.pem"} {
+		loaded, err := LoadPrivateKey(filepath.Join(dir, name))
+		require.NoError(t, err, name)
+		assert.True(t, key.Equal(loaded), name)
+	}
+	for _, name := range []string{"public.pem", "public-pkcs1.pem"} {
+		loaded, err := LoadPublicKey(filepath.Join(dir, name))
+		require.NoError(t, err, name)
+		assert.True(t, key.PublicKey.Equal(loaded), name)
+	}
+
+	_, err = LoadPrivateKey(filepath.Join(dir, "public.pem"))
+	assert.Error(t, err)
+	_, err = LoadPublicKey(filepath.Join(dir, "missing.pem"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,64 @@
+// Package fileutil -- запись файлов, которая переживает падение: после него файл
+// либо целый, либо прежний. Так пишутся снимки хранилища и спул агента.
+package fileutil
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// TmpSuffix есть в имени временного файла WriteAtomic. Такой файл остается
+// на диске, только если процесс упал посреди записи.
+const TmpSuffix = ".tmp-"
+
+// WriteAtomic пишет data во временный файл рядом с fpath, делает fsync, переименовывает
+// его в fpath и делает fsync каталога. beforeRename, если не nil, зовется, когда данные
+// уже на диске, а fpath еще прежний, например чтобы сдвинуть старые версии файла.
+func WriteAtomic(fpath string, data []byte, beforeRename func() error) error {
+	dir := filepath.Dir(fpath)
+	tmp, err := os.CreateTemp(dir, filepath.Base(fpath)+TmpSuffix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if beforeRename != nil {
+		if err := beforeRename(); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(tmp.Name(), fpath); err != nil {
+		return err
+	}
+
+	return SyncDir(dir)
+}
+
+// SyncDir -- fsync каталога, без него rename может не пережить падение питания
+func SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// IsTemp -- временный файл WriteAtomic, брошенный упавшим процессом
+func IsTemp(name string) bool {
+	return strings.Contains(filepath.Base(name), TmpSuffix)
+}
@@ -0,0 +1,45 @@
+package fileutil
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteAtomic(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "storage.json")
+	require.NoError(t, WriteAtomic(fpath, []byte("first"), nil))
+
+	// beforeRename видит прежний файл, а временный уже записан
+	err := WriteAtomic(fpath, []byte("second"), func() error {
+		data, err := os.ReadFile(fpath)
+		require.NoError(t, err)
+		assert.Equal(t, "first", string(data))
+
+		files, err := filepath.Glob(fpath + TmpSuffix + "*")
+		require.NoError(t, err)
+		require.Len(t, files, 1)
+		assert.True(t, IsTemp(files[0]))
+		return nil
+	})
+	require.NoError(t, err)
+	data, err := os.ReadFile(fpath)
+	require.NoError(t, err)
+	assert.Equal(t, "second", string(data))
+
+	// ошибка beforeRename -- файл прежний
+	require.Error(t, WriteAtomic(fpath, []byte("third"), func() error { return errors.New("no space left") }))
+	data, err = os.ReadFile(fpath)
+	require.NoError(t, err)
+	assert.Equal(t, "second", string(data))
+
+	// временные файлы не остаются
+	files, err := filepath.Glob(fpath + TmpSuffix + "*")
+	require.NoError(t, err)
+	assert.Empty(t, files)
+	assert.False(t, IsTemp(fpath))
+}
@@ -0,0 +1,295 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// бакеты по умолчанию как у клиента Prometheus, для латенси в секундах
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var DefaultQuantiles = []float64{0.5, 0.9, 0.99}
+
+// из квантилей нельзя собрать квантили, поэтому summary хранит сами наблюдения,
+// но не больше этого количества последних
+const MaxSummaryObservations = 1024
+
+type Histogram struct {
+	Buckets []float64 `json:"buckets"` // верхние границы бакетов по возрастанию, +Inf не указывается
+	Counts  []uint64  `json:"counts"`  // количество наблюдений в каждом бакете, последний элемент -- для +Inf
+	Sum     float64   `json:"sum"`
+	Count   uint64    `json:"count"`
+}
+
+func NewHistogram(buckets []float64) *Histogram {
+	return &Histogram{
+		Buckets: slices.Clone(buckets),
+		Counts:  make([]uint64, len(buckets)+1),
+	}
+}
+
+// Clone -- глубокая копия, nil остается nil
+func (h *Histogram) Clone() *Histogram {
+	if h == nil {
+		return nil
+	}
+
+	clone := *h
+	clone.Buckets = slices.Clone(h.Buckets)
+	clone.Counts = slices.Clone(h.Counts)
+	return &clone
+}
+
+// Validate проверяет бакеты и пересчитывает Count, если его не передали
+func (h *Histogram) Validate() error {
+	if len(h.Buckets) == 0 {
+		return errors.New("histogram has no buckets")
+	}
+
+	for i, bound := range h.Buckets {
+		if math.IsNaN(bound) || math.IsInf(bound, 0) {
+			return fmt.Errorf("histogram bucket %v is not finite", bound)
+		}
+		if i > 0 && bound <= h.Buckets[i-1] {
+			return errors.New("histogram buckets must be sorted and unique")
+		}
+	}
+
+	if h.Counts == nil {
+		h.Counts = make([]uint64, len(h.Buckets)+1)
+	}
+	if len(h.Counts) != len(h.Buckets)+1 {
+		return fmt.Errorf("histogram has %d buckets but %d counts, expected %d",
+			len(h.Buckets), len(h.Counts), len(h.Buckets)+1)
+	}
+
+	var count uint64
+	for _, c := range h.Counts {
+		count += c
+	}
+	if h.Count != 0 && h.Count != count {
+		return fmt.Errorf("histogram count %d does not match bucket counts %d", h.Count, count)
+	}
+	h.Count = count
+
+	if !isFinite(h.Sum) {
+		return fmt.Errorf("histogram sum %v is not finite", h.Sum)
+	}
+
+	return nil
+}
+
+// Observe добавляет наблюдение. Если сумма станет бесконечной, гистограмма не меняется:
+// бесконечность не записать в JSON, и снимок хранилища перестал бы сохраняться.
+func (h *Histogram) Observe(value float64) error {
+	sum, err := addSum(h.Sum, value)
+	if err != nil {
+		return err
+	}
+
+	i := sort.SearchFloat64s(h.Buckets, value)
+	h.Counts[i]++
+	h.Sum = sum
+	h.Count++
+
+	return nil
+}
+
+// Merge складывает гистограммы, например от разных агентов, бакеты должны совпадать
+func (h *Histogram) Merge(other *Histogram) error {
+	if !slices.Equal(h.Buckets, other.Buckets) {
+		return fmt.Errorf("histogram buckets mismatch %v:%v", h.Buckets, other.Buckets)
+	}
+	sum, err := addSum(h.Sum, other.Sum)
+	if err != nil {
+		return err
+	}
+
+	for i, c := range other.Counts {
+		h.Counts[i] += c
+	}
+	h.Sum = sum
+	h.Count += other.Count
+
+	return nil
+}
+
+// CumulativeCounts -- количество наблюдений <= границы бакета, последний элемент -- для +Inf
+func (h *Histogram) CumulativeCounts() []uint64 {
+	cumulative := make([]uint64, len(h.Counts))
+	var total uint64
+	for i, c := range h.Counts {
+		total += c
+		cumulative[i] = total
+	}
+
+	return cumulative
+}
+
+func (h *Histogram) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "count=%d sum=%s", h.Count, formatFloat(h.Sum))
+	cumulative := h.CumulativeCounts()
+	for i, bound := range h.Buckets {
+		fmt.Fprintf(&sb, " le%s=%d", formatFloat(bound), cumulative[i])
+	}
+	fmt.Fprintf(&sb, " le+Inf=%d", cumulative[len(cumulative)-1])
+
+	return sb.String()
+}
+
+type Summary struct {
+	Quantiles    []float64 `json:"quantiles"`              // какие квантили считать
+	Values       []float64 `json:"values,omitempty"`       // значения квантилей, пересчитываются сервером
+	Observations []float64 `json:"observations,omitempty"` // последние наблюдения
+	Sum          float64   `json:"sum"`
+	Count        uint64    `json:"count"`
+}
+
+func NewSummary(quantiles []float64) *Summary {
+	return &Summary{
+		Quantiles: slices.Clone(quantiles),
+	}
+}
+
+// Clone -- глубокая копия, nil остается nil
+func (s *Summary) Clone() *Summary {
+	if s == nil {
+		return nil
+	}
+
+	clone := *s
+	clone.Quantiles = slices.Clone(s.Quantiles)
+	clone.Values = slices.Clone(s.Values)
+	clone.Observations = slices.Clone(s.Observations)
+	return &clone
+}
+
+// Validate проверяет квантили и наблюдения, Count и Sum считает по наблюдениям,
+// если их не передали
+func (s *Summary) Validate() error {
+	if len(s.Quantiles) == 0 {
+		s.Quantiles = slices.Clone(DefaultQuantiles)
+	}
+
+	for _, q := range s.Quantiles {
+		if math.IsNaN(q) || q < 0 || q > 1 {
+			return fmt.Errorf("summary quantile %v is out of [0, 1]", q)
+		}
+	}
+
+	var sum float64
+	for _, o := range s.Observations {
+		if !isFinite(o) {
+			return fmt.Errorf("summary observation %v is not finite", o)
+		}
+		sum += o
+	}
+
+	if s.Count == 0 {
+		s.Count = uint64(len(s.Observations))
+		s.Sum = sum
+	}
+	if !isFinite(s.Sum) {
+		return fmt.Errorf("summary sum %v is not finite", s.Sum)
+	}
+	if s.Count < uint64(len(s.Observations)) {
+		return fmt.Errorf("summary count %d is less than observations %d", s.Count, len(s.Observations))
+	}
+
+	s.trim()
+	s.updateValues()
+	return nil
+}
+
+// Observe добавляет наблюдение, с бесконечной суммой -- ошибка, как у Histogram.Observe
+func (s *Summary) Observe(value float64) error {
+	sum, err := addSum(s.Sum, value)
+	if err != nil {
+		return err
+	}
+
+	s.Observations = append(s.Observations, value)
+	s.Sum = sum
+	s.Count++
+	s.trim()
+	s.updateValues()
+
+	return nil
+}
+
+// Merge объединяет наблюдения, например от разных агентов, квантили должны совпадать
+func (s *Summary) Merge(other *Summary) error {
+	if len(other.Quantiles) > 0 && !slices.Equal(s.Quantiles, other.Quantiles) {
+		return fmt.Errorf("summary quantiles mismatch %v:%v", s.Quantiles, other.Quantiles)
+	}
+	sum, err := addSum(s.Sum, other.Sum)
+	if err != nil {
+		return err
+	}
+
+	s.Observations = append(s.Observations, other.Observations...)
+	s.Sum = sum
+	s.Count += other.Count
+	s.trim()
+	s.updateValues()
+
+	return nil
+}
+
+func (s *Summary) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "count=%d sum=%s", s.Count, formatFloat(s.Sum))
+	for i, q := range s.Quantiles {
+		if i < len(s.Values) {
+			fmt.Fprintf(&sb, " q%s=%s", formatFloat(q), formatFloat(s.Values[i]))
+		}
+	}
+
+	return sb.String()
+}
+
+func (s *Summary) trim() {
+	if len(s.Observations) > MaxSummaryObservations {
+		s.Observations = slices.Clone(s.Observations[len(s.Observations)-MaxSummaryObservations:])
+	}
+}
+
+// квантили методом nearest rank по отсортированной копии наблюдений
+func (s *Summary) updateValues() {
+	if len(s.Observations) == 0 {
+		s.Values = nil
+		return
+	}
+
+	sorted := slices.Clone(s.Observations)
+	slices.Sort(sorted)
+
+	s.Values = make([]float64, len(s.Quantiles))
+	for i, q := range s.Quantiles {
+		rank := int(math.Ceil(q*float64(len(sorted)))) - 1
+		rank = max(0, min(rank, len(sorted)-1))
+		s.Values[i] = sorted[rank]
+	}
+}
+
+func addSum(sum float64, value float64) (float64, error) {
+	if result := sum + value; isFinite(result) {
+		return result, nil
+	}
+
+	return 0, fmt.Errorf("sum %v + %v is not finite", sum, value)
+}
+
+func isFinite(value float64) bool {
+	return !math.IsNaN(value) && !math.IsInf(value, 0)
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
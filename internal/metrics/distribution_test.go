@@ -0,0 +1,117 @@
+package metrics
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistogramObserveAndMerge(t *testing.T) {
+	h := NewHistogram([]float64{0.1, 0.5, 1})
+	for _, v := range []float64{0.05, 0.1, 0.3, 0.7, 2} {
+		h.Observe(v)
+	}
+
+	assert.Equal(t, []uint64{2, 1, 1, 1}, h.Counts)
+	assert.Equal(t, uint64(5), h.Count)
+	assert.InDelta(t, 3.15, h.Sum, 1e-9)
+	assert.Equal(t, []uint64{2, 3, 4, 5}, h.CumulativeCounts())
+	assert.Equal(t, "count=5 sum=3.15 le0.1=2 le0.5=3 le1=4 le+Inf=5", h.String())
+
+	other := &Histogram{Buckets: []float64{0.1, 0.5, 1}, Counts: []uint64{1, 0, 0, 1}, Sum: 5.01}
+	require.NoError(t, other.Validate())
+	require.NoError(t, h.Merge(other))
+	assert.Equal(t, []uint64{3, 1, 1, 2}, h.Counts)
+	assert.Equal(t, uint64(7), h.Count)
+
+	assert.Error(t, h.Merge(NewHistogram([]float64{1, 2})))
+}
+
+func TestHistogramValidate(t *testing.T) {
+	assert.Error(t, (&Histogram{}).Validate())
+	assert.Error(t, (&Histogram{Buckets: []float64{1, 0.5}}).Validate())
+	assert.Error(t, (&Histogram{Buckets: []float64{1}, Counts: []uint64{1}}).Validate())
+	assert.Error(t, (&Histogram{Buckets: []float64{1}, Counts: []uint64{1, 1}, Count: 3}).Validate())
+
+	h := &Histogram{Buckets: []float64{1}}
+	require.NoError(t, h.Validate())
+	assert.Equal(t, []uint64{0, 0}, h.Counts)
+}
+
+func TestSummaryQuantilesAndMerge(t *testing.T) {
+	s := &Summary{Quantiles: []float64{0.5, 0.9}, Observations: []float64{5, 1, 4, 2, 3}}
+	require.NoError(t, s.Validate())
+	assert.Equal(t, uint64(5), s.Count)
+	assert.Equal(t, 15.0, s.Sum)
+	assert.Equal(t, []float64{3, 5}, s.Values)
+
+	// наблюдения второго агента добавляются к первым, а не усредняются
+	other := &Summary{Quantiles: []float64{0.5, 0.9}, Observations: []float64{6, 7, 8, 9, 10}}
+	require.NoError(t, other.Validate())
+	require.NoError(t, s.Merge(other))
+	assert.Equal(t, uint64(10), s.Count)
+	assert.Equal(t, 55.0, s.Sum)
+	assert.Equal(t, []float64{5, 9}, s.Values)
+	assert.Equal(t, "count=10 sum=55 q0.5=5 q0.9=9", s.String())
+
+	assert.Error(t, s.Merge(&Summary{Quantiles: []float64{0.99}}))
+	assert.Error(t, (&Summary{Quantiles: []float64{1.5}}).Validate())
+}
+
+func TestSummaryKeepsLastObservations(t *testing.T) {
+	s := NewSummary(DefaultQuantiles)
+	for i := 0; i < MaxSummaryObservations+10; i++ {
+		s.Observe(float64(i))
+	}
+
+	assert.Len(t, s.Observations, MaxSummaryObservations)
+	assert.Equal(t, 10.0, s.Observations[0])
+	assert.Equal(t, uint64(MaxSummaryObservations+10), s.Count)
+}
+
+func TestDistributionMetricUpdates(t *testing.T) {
+	var metric Metric
+	require.NoError(t, json.Unmarshal(
+		[]byte(`{"id":"latency","type":"histogram","histogram":{"buckets":[0.1,1],"counts":[1,2,0]}}`),
+		&metric,
+	))
+	require.NoError(t, metric.ValidateDistribution())
+	assert.Equal(t, uint64(3), metric.Histogram.Count)
+
+	require.NoError(t, metric.UpdateValueStr("5"))
+	assert.Equal(t, []uint64{1, 2, 1}, metric.Histogram.Counts)
+
+	incoming := Metric{ID: "latency", MType: HistogramMetric, Histogram: NewHistogram([]float64{0.1, 1})}
+	incoming.Histogram.Observe(0.05)
+	require.NoError(t, metric.UpdateValueNum(incoming.GetValue()))
+	assert.Equal(t, []uint64{2, 2, 1}, metric.Histogram.Counts)
+
+	assert.Error(t, metric.UpdateValueNum(NewSummary(DefaultQuantiles)))
+
+	summary := NewMetric("rt", SummaryMetric)
+	require.NoError(t, summary.UpdateValueStr("0.25"))
+	assert.Equal(t, uint64(1), summary.Summary.Count)
+	assert.Equal(t, "count=1 sum=0.25 q0.5=0.25 q0.9=0.25 q0.99=0.25", summary.GetValueStr())
+}
+
+func TestDistributionSumOverflow(t *testing.T) {
+	h := NewHistogram([]float64{1})
+	require.NoError(t, h.Observe(1e308))
+	assert.Error(t, h.Observe(1e308))
+	assert.Error(t, h.Merge(&Histogram{Buckets: []float64{1}, Counts: []uint64{0, 1}, Sum: 1e308, Count: 1}))
+	assert.Equal(t, []uint64{0, 1}, h.Counts)
+	assert.Equal(t, uint64(1), h.Count)
+	assert.Equal(t, 1e308, h.Sum)
+
+	s := NewSummary(DefaultQuantiles)
+	require.NoError(t, s.Observe(1e308))
+	assert.Error(t, s.Observe(1e308))
+	assert.Error(t, s.Merge(&Summary{Observations: []float64{1e308}, Sum: 1e308, Count: 1}))
+	assert.Equal(t, []float64{1e308}, s.Observations)
+	assert.Equal(t, uint64(1), s.Count)
+
+	// наблюдения конечные, а сумма -- нет
+	assert.Error(t, (&Summary{Observations: []float64{1e308, 1e308}}).Validate())
+}
@@ -0,0 +1,155 @@
+package metrics
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Labels -- дополнительные измерения метрики (host, service и т.п.),
+// метрика определяется именем вместе с метками
+type Labels map[string]string
+
+var labelNameRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+func (l Labels) Validate() error {
+	for name := range l {
+		if !labelNameRe.MatchString(name) {
+			return fmt.Errorf("wrong label name %q", name)
+		}
+	}
+
+	return nil
+}
+
+// String отдает метки в каноническом виде {a="1",b="2"}, ключи отсортированы,
+// для пустых меток -- пустая строка
+func (l Labels) String() string {
+	if len(l) == 0 {
+		return ""
+	}
+
+	var sb strings.Builder
+	sb.WriteString("{")
+	for i, name := range l.Names() {
+		if i > 0 {
+			sb.WriteString(",")
+		}
+		sb.WriteString(name)
+		sb.WriteString("=")
+		sb.WriteString(strconv.Quote(l[name]))
+	}
+	sb.WriteString("}")
+
+	return sb.String()
+}
+
+// Matches -- есть ли у метрики все метки фильтра с теми же значениями
+func (l Labels) Matches(filter Labels) bool {
+	for name, value := range filter {
+		if labelValue, present := l[name]; !present || labelValue != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (l Labels) Clone() Labels {
+	if len(l) == 0 {
+		return nil
+	}
+
+	return maps.Clone(l)
+}
+
+// ParseLabels разбирает метки из query параметра вида host:web1,service:api
+func ParseLabels(s string) (Labels, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+
+	labels := make(Labels)
+	for _, pair := range strings.Split(s, ",") {
+		name, value, found := strings.Cut(pair, ":")
+		if !found {
+			return nil, fmt.Errorf("wrong label %q, expected name:value", pair)
+		}
+		labels[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+
+	if err := labels.Validate(); err != nil {
+		return nil, err
+	}
+
+	return labels, nil
+}
+
+// FormatLabels -- обратное к ParseLabels
+func FormatLabels(l Labels) string {
+	pairs := make([]string, 0, len(l))
+	for _, name := range l.Names() {
+		pairs = append(pairs, name+":"+l[name])
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+// Names -- имена меток по алфавиту
+func (l Labels) Names() []string {
+	names := make([]string, 0, len(l))
+	for name := range l {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// SeriesKey -- ключ серии: имя метрики плюс метки, без меток совпадает с именем
+func SeriesKey(name string, labels Labels) string {
+	return name + labels.String()
+}
+
+// ParseSeriesKey -- обратное к SeriesKey: разбирает ключ на имя и метки
+func ParseSeriesKey(key string) (string, Labels, error) {
+	name, rest, found := strings.Cut(key, "{")
+	if !found {
+		return key, nil, nil
+	}
+	if !strings.HasSuffix(rest, "}") {
+		return "", nil, fmt.Errorf("wrong series key %q", key)
+	}
+	rest = strings.TrimSuffix(rest, "}")
+
+	labels := make(Labels)
+	for rest != "" {
+		labelName, quoted, found := strings.Cut(rest, "=")
+		if !found {
+			return "", nil, fmt.Errorf("wrong series key %q", key)
+		}
+		prefix, err := strconv.QuotedPrefix(quoted)
+		if err != nil {
+			return "", nil, fmt.Errorf("wrong series key %q: %w", key, err)
+		}
+		value, _ := strconv.Unquote(prefix)
+		labels[labelName] = value
+
+		rest = quoted[len(prefix):]
+		if rest != "" {
+			var found bool
+			if rest, found = strings.CutPrefix(rest, ","); !found {
+				return "", nil, fmt.Errorf("wrong series key %q", key)
+			}
+		}
+	}
+
+	if err := labels.Validate(); err != nil {
+		return "", nil, err
+	}
+
+	return name, labels.Clone(), nil
+}
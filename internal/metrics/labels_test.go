@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLabelsKeyAndParse(t *testing.T) {
+	labels, err := ParseLabels("service:api, host:web1")
+	require.NoError(t, err)
+	assert.Equal(t, Labels{"host": "web1", "service": "api"}, labels)
+	assert.Equal(t, `{host="web1",service="api"}`, labels.String())
+	assert.Equal(t, "host:web1,service:api", FormatLabels(labels))
+
+	metric := NewMetric("Alloc", GaugeMetric)
+	assert.Equal(t, "Alloc", metric.Key())
+	metric.Labels = labels
+	assert.Equal(t, `Alloc{host="web1",service="api"}`, metric.Key())
+
+	empty, err := ParseLabels("")
+	require.NoError(t, err)
+	assert.Nil(t, empty)
+
+	_, err = ParseLabels("host")
+	assert.Error(t, err)
+	_, err = ParseLabels("1host:web1")
+	assert.Error(t, err)
+}
+
+func TestLabelsMatches(t *testing.T) {
+	labels := Labels{"host": "web1", "service": "api"}
+
+	assert.True(t, labels.Matches(nil))
+	assert.True(t, labels.Matches(Labels{"host": "web1"}))
+	assert.False(t, labels.Matches(Labels{"host": "web2"}))
+	assert.False(t, labels.Matches(Labels{"dc": "eu"}))
+	assert.False(t, Labels(nil).Matches(Labels{"host": "web1"}))
+}
+
+func TestParseSeriesKey(t *testing.T) {
+	labels := Labels{"host": "web1", "path": `/a,b="c"`}
+	name, parsed, err := ParseSeriesKey(SeriesKey("Alloc", labels))
+	require.NoError(t, err)
+	assert.Equal(t, "Alloc", name)
+	assert.Equal(t, labels, parsed)
+
+	name, parsed, err = ParseSeriesKey("PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, "PollCount", name)
+	assert.Nil(t, parsed)
+
+	_, _, err = ParseSeriesKey(`Alloc{host="web1"`)
+	assert.Error(t, err)
+	_, _, err = ParseSeriesKey(`Alloc{host=web1}`)
+	assert.Error(t, err)
+}
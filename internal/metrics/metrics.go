@@ -5,26 +5,38 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
-	"strings"
+	"time"
 )
 
 const (
-	GaugeMetric   = "gauge"
-	CounterMetric = "counter"
+	GaugeMetric     = "gauge"
+	CounterMetric   = "counter"
+	HistogramMetric = "histogram"
+	SummaryMetric   = "summary"
 )
 
 type (
 	Metric struct {
-		ID    string   `json:"id"`              // имя метрики
-		MType string   `json:"type"`            // параметр, принимающий значение gauge или counter
-		Delta *int64   `json:"delta,omitempty"` // значение метрики в случае передачи counter
-		Value *float64 `json:"value,omitempty"` // значение метрики в случае передачи gauge
+		ID        string     `json:"id"`                  // имя метрики
+		MType     string     `json:"type"`                // параметр, принимающий значение gauge, counter, histogram или summary
+		Delta     *int64     `json:"delta,omitempty"`     // значение метрики в случае передачи counter
+		Value     *float64   `json:"value,omitempty"`     // значение метрики в случае передачи gauge
+		Histogram *Histogram `json:"histogram,omitempty"` // значение метрики в случае передачи histogram
+		Summary   *Summary   `json:"summary,omitempty"`   // значение метрики в случае передачи summary
+		Labels    Labels     `json:"labels,omitempty"`    // метки, вместе с именем определяют серию
 	}
 )
 
-func (m *Metric) UnmarshalJSON(data []byte) error {
-	// fmt.Printf("UnmarshalJSON start: %s\r\n", string(data[:]))
+func IsKnownType(mType string) bool {
+	switch mType {
+	case GaugeMetric, CounterMetric, HistogramMetric, SummaryMetric:
+		return true
+	}
+
+	return false
+}
 
+func (m *Metric) UnmarshalJSON(data []byte) error {
 	type MyMetricAlias Metric
 	aliasValue := &struct {
 		*MyMetricAlias
@@ -34,7 +46,6 @@ func (m *Metric) UnmarshalJSON(data []byte) error {
 	}
 
 	if err := json.Unmarshal(data, aliasValue); err != nil {
-		fmt.Printf("UnmarshalJSON error %v\r\n", err)
 		return err
 	}
 
@@ -42,21 +53,16 @@ func (m *Metric) UnmarshalJSON(data []byte) error {
 	// что приводит к тому, что при json.Unmarshall метрика типа gauge
 	// получает значение типа int64 и сервер в скором времени сыпется
 	// поэтому кастомный UnmarshalJSON
-	if m.MType == GaugeMetric && aliasValue.Value != nil {
-		var valueFloat64 float64
-		json.Unmarshal(aliasValue.Value, &valueFloat64)
-		m.Value = &valueFloat64
-	} else {
-		json.Unmarshal(aliasValue.Value, &m.Value)
+	m.Value = nil
+	if len(aliasValue.Value) == 0 || string(aliasValue.Value) == "null" {
+		return nil
 	}
 
-	// if m.Value != nil {
-	// 	fmt.Printf("UnmarshalJSON end: %v:%v\r\n", *m.Value, reflect.TypeOf(*m.Value))
-	// }
-
-	// if m.Delta != nil {
-	// 	fmt.Printf("UnmarshalJSON end: %v:%v\r\n", *m.Delta, reflect.TypeOf(*m.Delta))
-	// }
+	var value float64
+	if err := json.Unmarshal(aliasValue.Value, &value); err != nil {
+		return invalid(m.ID, "value", "%s is not a number", aliasValue.Value)
+	}
+	m.Value = &value
 
 	return nil
 }
@@ -65,12 +71,25 @@ func NewMetric(ID string, MType string) Metric {
 	var zeroInt int64 = 0
 	var zeroFloat float64 = 0
 
-	if MType == GaugeMetric {
+	switch MType {
+	case GaugeMetric:
 		return Metric{
 			ID:    ID,
 			MType: MType,
 			Value: &zeroFloat,
 		}
+	case HistogramMetric:
+		return Metric{
+			ID:        ID,
+			MType:     MType,
+			Histogram: NewHistogram(DefaultBuckets),
+		}
+	case SummaryMetric:
+		return Metric{
+			ID:      ID,
+			MType:   MType,
+			Summary: NewSummary(DefaultQuantiles),
+		}
 	}
 
 	return Metric{
@@ -80,6 +99,30 @@ func NewMetric(ID string, MType string) Metric {
 	}
 }
 
+// Key -- ключ серии, по нему метрика лежит в хранилище
+func (m Metric) Key() string {
+	return SeriesKey(m.ID, m.Labels)
+}
+
+// Clone -- глубокая копия: поля значений у метрики указатели,
+// и без копии обновление хранилища меняет уже отданную метрику
+func (m Metric) Clone() Metric {
+	clone := m
+	if m.Delta != nil {
+		delta := *m.Delta
+		clone.Delta = &delta
+	}
+	if m.Value != nil {
+		value := *m.Value
+		clone.Value = &value
+	}
+	clone.Histogram = m.Histogram.Clone()
+	clone.Summary = m.Summary.Clone()
+	clone.Labels = m.Labels.Clone()
+
+	return clone
+}
+
 func (m Metric) GetDeltaField() int64 {
 	return *m.Delta
 }
@@ -92,46 +135,100 @@ func (m Metric) ISGauge() bool {
 	return m.MType == GaugeMetric
 }
 
+func (m Metric) IsDistribution() bool {
+	return m.MType == HistogramMetric || m.MType == SummaryMetric
+}
+
 func (m Metric) GetValue() any {
-	if m.MType == GaugeMetric {
+	switch m.MType {
+	case GaugeMetric:
 		return *m.Value
+	case HistogramMetric:
+		return m.Histogram
+	case SummaryMetric:
+		return m.Summary
 	}
 
 	return *m.Delta
 }
 
 func (m Metric) GetValueStr() string {
-	if m.MType == GaugeMetric {
+	switch m.MType {
+	case GaugeMetric:
 		return strconv.FormatFloat(*m.Value, 'f', -1, 64)
+	case HistogramMetric:
+		return m.Histogram.String()
+	case SummaryMetric:
+		return m.Summary.String()
 	}
 
 	return strconv.FormatInt(*m.Delta, 10)
 }
 
-func (m Metric) UpdateValueStr(value string) error {
-	var typedValue any
-	var err error
-	if m.MType == GaugeMetric {
-		typedValue, err = strconv.ParseFloat(strings.TrimSpace(value), 64)
-	} else {
-		typedValue, err = strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+// Empty -- метрика того же имени, типа и меток с нулевым значением,
+// у histogram и summary те же бакеты и квантили. Новая метрика в хранилище
+// начинается с нее и дальше обновляется так же, как уже существующая.
+func (m Metric) Empty() Metric {
+	empty := NewMetric(m.ID, m.MType)
+	empty.Labels = m.Labels.Clone()
+	if m.Histogram != nil {
+		empty.Histogram = NewHistogram(m.Histogram.Buckets)
+	}
+	if m.Summary != nil {
+		empty.Summary = NewSummary(m.Summary.Quantiles)
 	}
 
+	return empty
+}
+
+// ValidateDistribution проверяет и дополняет значение histogram и summary,
+// для остальных типов ничего не делает
+func (m Metric) ValidateDistribution() error {
+	switch m.MType {
+	case HistogramMetric:
+		if m.Histogram == nil {
+			return errors.New("histogram value is missing")
+		}
+		return m.Histogram.Validate()
+	case SummaryMetric:
+		if m.Summary == nil {
+			return errors.New("summary value is missing")
+		}
+		return m.Summary.Validate()
+	}
+
+	return nil
+}
+
+// для histogram и summary строковое значение -- это одно наблюдение
+func (m Metric) UpdateValueStr(value string) error {
+	typedValue, err := ParseValue(m.ID, m.MType, value)
 	if err != nil {
 		return err
 	}
 
-	m.doUpdateWithFloatOrIntValue(typedValue)
-	return nil
+	return m.doUpdateWithFloatOrIntValue(typedValue)
 }
 
-func (m Metric) doUpdateWithFloatOrIntValue(value any) {
-	if m.MType == GaugeMetric {
+func (m Metric) doUpdateWithFloatOrIntValue(value any) error {
+	switch m.MType {
+	case GaugeMetric:
 		*m.Value = value.(float64)
-		return
+	case HistogramMetric:
+		if histogram, ok := value.(*Histogram); ok {
+			return m.Histogram.Merge(histogram)
+		}
+		return m.Histogram.Observe(value.(float64))
+	case SummaryMetric:
+		if summary, ok := value.(*Summary); ok {
+			return m.Summary.Merge(summary)
+		}
+		return m.Summary.Observe(value.(float64))
+	default:
+		*m.Delta += value.(int64)
 	}
 
-	*m.Delta += value.(int64)
+	return nil
 }
 
 func (m Metric) UpdateValueNum(value any) error {
@@ -139,24 +236,65 @@ func (m Metric) UpdateValueNum(value any) error {
 		return errors.New("missing type")
 	}
 
-	if m.MType != GaugeMetric && m.MType != CounterMetric {
+	if !IsKnownType(m.MType) {
 		return fmt.Errorf("wrong metric type %s", m.MType)
 	}
 
 	switch assertedTypeValue := value.(type) {
 	case float64:
-		if m.MType != GaugeMetric {
+		if m.MType == CounterMetric {
 			return fmt.Errorf("metric type and value mismatch %v:%v", m.MType, assertedTypeValue)
 		}
 	case int64:
 		if m.MType != CounterMetric {
 			return fmt.Errorf("metric type and value mismatch %v:%v", m.MType, assertedTypeValue)
 		}
+	case *Histogram:
+		if m.MType != HistogramMetric {
+			return fmt.Errorf("metric type and value mismatch %v:%v", m.MType, assertedTypeValue)
+		}
+	case *Summary:
+		if m.MType != SummaryMetric {
+			return fmt.Errorf("metric type and value mismatch %v:%v", m.MType, assertedTypeValue)
+		}
 	case string:
 	default:
 		return fmt.Errorf("wrong value type %s", assertedTypeValue)
 	}
 
-	m.doUpdateWithFloatOrIntValue(value)
-	return nil
+	return m.doUpdateWithFloatOrIntValue(value)
+}
+
+// Sample -- значение метрики в момент времени, из них состоит история
+// для histogram и summary в истории хранятся только количество и сумма наблюдений
+type Sample struct {
+	Timestamp time.Time `json:"timestamp"`
+	Delta     *int64    `json:"delta,omitempty"`
+	Value     *float64  `json:"value,omitempty"`
+	Count     *uint64   `json:"count,omitempty"`
+	Sum       *float64  `json:"sum,omitempty"`
+}
+
+// NewSample копирует текущее значение метрики,
+// чтобы дальнейшие обновления метрики не меняли историю
+func NewSample(m Metric, ts time.Time) Sample {
+	sample := Sample{Timestamp: ts}
+	if m.Delta != nil {
+		delta := *m.Delta
+		sample.Delta = &delta
+	}
+	if m.Value != nil {
+		value := *m.Value
+		sample.Value = &value
+	}
+	if m.Histogram != nil {
+		count, sum := m.Histogram.Count, m.Histogram.Sum
+		sample.Count, sample.Sum = &count, &sum
+	}
+	if m.Summary != nil {
+		count, sum := m.Summary.Count, m.Summary.Sum
+		sample.Count, sample.Sum = &count, &sum
+	}
+
+	return sample
 }
@@ -0,0 +1,135 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// MaxNameLength -- длина имени метрики, столбец name в базе VARCHAR(50)
+const MaxNameLength = 50
+
+var nameRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_.:-]*$`)
+
+// ErrInvalidMetric -- общий признак ошибок проверки, errors.Is(err, ErrInvalidMetric)
+// верно для любой *ValidationError
+var ErrInvalidMetric = errors.New("invalid metric")
+
+// ValidationError -- пришедшая метрика негодна: какое поле и почему.
+// Это ошибка клиента, хендлеры отвечают на нее 400.
+type ValidationError struct {
+	Metric string // имя метрики, как пришло
+	Field  string // id, type, value, delta, labels, histogram или summary
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	if e.Metric == "" {
+		return fmt.Sprintf("invalid metric: %s: %s", e.Field, e.Reason)
+	}
+
+	return fmt.Sprintf("invalid metric %s: %s: %s", e.Metric, e.Field, e.Reason)
+}
+
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrInvalidMetric
+}
+
+func invalid(metric string, field string, format string, args ...any) error {
+	return &ValidationError{Metric: metric, Field: field, Reason: fmt.Sprintf(format, args...)}
+}
+
+// ValidateName -- имя непустое, не длиннее MaxNameLength, из букв, цифр и _.:-
+func ValidateName(name string) error {
+	switch {
+	case name == "":
+		return invalid(name, "id", "name is empty")
+	case len(name) > MaxNameLength:
+		return invalid(name, "id", "name is longer than %d", MaxNameLength)
+	case !nameRe.MatchString(name):
+		return invalid(name, "id", "name has wrong characters")
+	}
+
+	return nil
+}
+
+func ValidateType(name string, mType string) error {
+	if mType == "" {
+		return invalid(name, "type", "type is empty")
+	}
+	if !IsKnownType(mType) {
+		return invalid(name, "type", "unsupported type %q", mType)
+	}
+
+	return nil
+}
+
+// ValidateSeries -- проверки имени, типа и меток, общие для URL и JSON API
+func ValidateSeries(name string, mType string, labels Labels) error {
+	if err := ValidateName(name); err != nil {
+		return err
+	}
+
+	if err := ValidateType(name, mType); err != nil {
+		return err
+	}
+
+	if err := labels.Validate(); err != nil {
+		return invalid(name, "labels", "%v", err)
+	}
+
+	return nil
+}
+
+// ParseValue разбирает строковое значение из URL: int64 для counter,
+// конечное float64 для остальных типов
+func ParseValue(name string, mType string, value string) (any, error) {
+	value = strings.TrimSpace(value)
+	if mType == CounterMetric {
+		delta, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, invalid(name, "delta", "%q is not an integer", value)
+		}
+		return delta, nil
+	}
+
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil, invalid(name, "value", "%q is not a number", value)
+	}
+	if math.IsNaN(number) || math.IsInf(number, 0) {
+		return nil, invalid(name, "value", "%v is not finite", number)
+	}
+
+	return number, nil
+}
+
+// Validate -- проверки метрики, пришедшей в хранилище целиком (JSON API, пачки)
+func (m Metric) Validate() error {
+	if err := ValidateSeries(m.ID, m.MType, m.Labels); err != nil {
+		return err
+	}
+
+	switch m.MType {
+	case GaugeMetric:
+		if m.Value == nil {
+			return invalid(m.ID, "value", "gauge has no value")
+		}
+		if math.IsNaN(*m.Value) || math.IsInf(*m.Value, 0) {
+			return invalid(m.ID, "value", "%v is not finite", *m.Value)
+		}
+	case CounterMetric:
+		if m.Delta == nil {
+			return invalid(m.ID, "delta", "counter has no delta")
+		}
+	}
+
+	if err := m.ValidateDistribution(); err != nil {
+		return invalid(m.ID, m.MType, "%v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,88 @@
+package metrics
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidate(t *testing.T) {
+	value := 1.5
+	nan := math.NaN()
+	delta := int64(1)
+
+	tests := []struct {
+		name   string
+		metric Metric
+		field  string
+	}{
+		{name: "valid gauge", metric: Metric{ID: "Alloc", MType: GaugeMetric, Value: &value}},
+		{name: "valid counter", metric: Metric{ID: "http.requests", MType: CounterMetric, Delta: &delta}},
+		{name: "empty name", metric: Metric{MType: GaugeMetric, Value: &value}, field: "id"},
+		{name: "wrong name", metric: Metric{ID: "Alloc{x}", MType: GaugeMetric, Value: &value}, field: "id"},
+		{name: "long name", metric: Metric{ID: strings.Repeat("a", MaxNameLength+1), MType: GaugeMetric, Value: &value}, field: "id"},
+		{name: "empty type", metric: Metric{ID: "Alloc", Value: &value}, field: "type"},
+		{name: "unknown type", metric: Metric{ID: "Alloc", MType: "bool", Value: &value}, field: "type"},
+		{name: "gauge without value", metric: Metric{ID: "Alloc", MType: GaugeMetric, Delta: &delta}, field: "value"},
+		{name: "counter without delta", metric: Metric{ID: "PollCount", MType: CounterMetric, Value: &value}, field: "delta"},
+		{name: "not finite gauge", metric: Metric{ID: "Alloc", MType: GaugeMetric, Value: &nan}, field: "value"},
+		{name: "wrong label", metric: Metric{ID: "Alloc", MType: GaugeMetric, Value: &value, Labels: Labels{"1x": "y"}}, field: "labels"},
+		{name: "histogram without value", metric: Metric{ID: "latency", MType: HistogramMetric}, field: "histogram"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.metric.Validate()
+			if test.field == "" {
+				assert.NoError(t, err)
+				return
+			}
+
+			var validationErr *ValidationError
+			require.True(t, errors.As(err, &validationErr), err)
+			assert.Equal(t, test.field, validationErr.Field)
+			assert.ErrorIs(t, err, ErrInvalidMetric)
+		})
+	}
+}
+
+func TestParseValue(t *testing.T) {
+	value, err := ParseValue("Alloc", GaugeMetric, " 1.5 ")
+	require.NoError(t, err)
+	assert.Equal(t, 1.5, value)
+
+	value, err = ParseValue("PollCount", CounterMetric, "3")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), value)
+
+	for _, wrong := range []string{"abc", "NaN", "+Inf", ""} {
+		_, err = ParseValue("Alloc", GaugeMetric, wrong)
+		assert.ErrorIs(t, err, ErrInvalidMetric, wrong)
+	}
+	_, err = ParseValue("PollCount", CounterMetric, "1.5")
+	assert.ErrorIs(t, err, ErrInvalidMetric)
+}
+
+func TestUnmarshalJSONErrors(t *testing.T) {
+	var metric Metric
+	err := json.Unmarshal([]byte(`{"id":"Alloc","type":"gauge","value":"abc"}`), &metric)
+	assert.ErrorIs(t, err, ErrInvalidMetric)
+
+	err = json.Unmarshal([]byte(`{"id":"PollCount","type":"counter","delta":"abc"}`), &metric)
+	assert.Error(t, err)
+
+	// counter без delta разбирается, но не проходит проверку, а не падает на *m.Delta
+	metric = Metric{}
+	require.NoError(t, json.Unmarshal([]byte(`{"id":"PollCount","type":"counter"}`), &metric))
+	assert.Nil(t, metric.Value)
+	assert.ErrorIs(t, metric.Validate(), ErrInvalidMetric)
+
+	metric = Metric{}
+	require.NoError(t, json.Unmarshal([]byte(`{"id":"Alloc","type":"gauge","value":0}`), &metric))
+	require.NotNil(t, metric.Value)
+	assert.Equal(t, 0.0, *metric.Value)
+}
@@ -2,42 +2,88 @@ package server
 
 import (
 	"flag"
+	"fmt"
 	"os"
 	"prayago-metricsalert/internal/logger"
 	"strconv"
+	"strings"
 	"time"
 )
 
 type ServerConfig struct {
 	ServerAddress         string
+	StorageDSN            string
 	StorageFPath          string
+	SnapshotKeep          int
+	WAL                   bool
 	DBConnectionString    string
+	DBPrimary             bool
 	StoreInterval         time.Duration
 	RestoreStorageOnStart bool
+	HistorySize           int
+	AlertRulesFPath       string
+	AlertInterval         time.Duration
+	AlertWebhooks         []string
+	ShutdownTimeout       time.Duration
+	Key                   string // ключ подписи запросов агента, см. HashHeader
+	CryptoKey             string // путь к закрытому ключу RSA в PEM для зашифрованных запросов агента
 }
 
 func NewServerConfig() ServerConfig {
 	a := flag.String("a", "localhost:8080", "server address and port")
+	storageDSN := flag.String("storage", "", "storage DSN: memory://, file://path, postgres://..., sqlite://path (server built with -tags sqlite); overrides -f and -d")
 	f := flag.String("f", "./storage.json", "memstorage file path")
+	snapshotKeep := flag.Int("snapshot-keep", 3, "how many last memstorage snapshots to keep for recovery")
+	useWAL := flag.Bool("wal", true, "log every memstorage update to a write-ahead log next to the snapshot file")
 	d := flag.String("d", "", "database connection string")
+	dbPrimary := flag.Bool("db-primary", false, "serve metrics from the database instead of memory, requires -d")
 	i := flag.Int("i", 300, "memstorage saving interval, sec")
 	r := flag.Bool("r", true, "should memstorage restore values on server start or not")
+	historySize := flag.Int("history-size", 0, "how many samples of each metric to keep in memory, 0 disables history")
+	alertRules := flag.String("alert-rules", "", "alert rules JSON file path")
+	alertInterval := flag.Int("alert-interval", 10, "alert rules evaluation interval, sec")
+	alertWebhooks := flag.String("alert-webhooks", "", "comma separated webhook URLs for alert notifications")
+	key := flag.String("k", "", "shared key to verify HashSHA256 signatures of agent requests, empty disables signing; with a key POST /update/{type}/{name}/{value} is forbidden")
+	cryptoKey := flag.String("crypto-key", "", "RSA private key PEM file to decrypt agent requests, empty disables encryption")
+	shutdownTimeout := flag.Int("shutdown-timeout", 10, "how long to wait for in-flight requests on shutdown, sec")
 	flag.Parse()
 
 	config := ServerConfig{
 		ServerAddress:         *a,
+		StorageDSN:            *storageDSN,
 		StorageFPath:          *f,
+		SnapshotKeep:          *snapshotKeep,
+		WAL:                   *useWAL,
 		DBConnectionString:    *d,
+		DBPrimary:             *dbPrimary,
 		StoreInterval:         time.Duration(*i) * time.Second,
 		RestoreStorageOnStart: *r,
+		HistorySize:           *historySize,
+		AlertRulesFPath:       *alertRules,
+		AlertInterval:         time.Duration(*alertInterval) * time.Second,
+		AlertWebhooks:         splitList(*alertWebhooks),
+		ShutdownTimeout:       time.Duration(*shutdownTimeout) * time.Second,
+		Key:                   *key,
+		CryptoKey:             *cryptoKey,
 	}
 
 	if envServerAddress := os.Getenv("ADDRESS"); envServerAddress != "" {
 		config.ServerAddress = envServerAddress
 	}
+	if envStorageDSN := os.Getenv("STORAGE_DSN"); envStorageDSN != "" {
+		config.StorageDSN = envStorageDSN
+	}
 	if envStorageFPath := os.Getenv("FILE_STORAGE_PATH"); envStorageFPath != "" {
 		config.StorageFPath = envStorageFPath
 	}
+	if envSnapshotKeep := os.Getenv("SNAPSHOT_KEEP"); envSnapshotKeep != "" {
+		if snapshotKeepInt, err := strconv.Atoi(envSnapshotKeep); err == nil {
+			config.SnapshotKeep = snapshotKeepInt
+		}
+	}
+	if envWAL := os.Getenv("WAL"); envWAL != "" {
+		config.WAL, _ = strconv.ParseBool(envWAL)
+	}
 	if envStoreIntrvl := os.Getenv("STORE_INTERVAL"); envStoreIntrvl != "" {
 		if storeIntervalInt, err := strconv.Atoi(envStoreIntrvl); err == nil {
 			config.StoreInterval = time.Duration(storeIntervalInt) * time.Second
@@ -49,8 +95,65 @@ func NewServerConfig() ServerConfig {
 	if envDataBaseDsn := os.Getenv("DATABASE_DSN"); envDataBaseDsn != "" {
 		config.DBConnectionString = envDataBaseDsn
 	}
+	if envDBPrimary := os.Getenv("DATABASE_PRIMARY"); envDBPrimary != "" {
+		config.DBPrimary, _ = strconv.ParseBool(envDBPrimary)
+	}
+
+	if envHistorySize := os.Getenv("HISTORY_SIZE"); envHistorySize != "" {
+		if historySizeInt, err := strconv.Atoi(envHistorySize); err == nil {
+			config.HistorySize = historySizeInt
+		}
+	}
+
+	if envAlertRules := os.Getenv("ALERT_RULES"); envAlertRules != "" {
+		config.AlertRulesFPath = envAlertRules
+	}
+	if envAlertIntrvl := os.Getenv("ALERT_INTERVAL"); envAlertIntrvl != "" {
+		if alertIntervalInt, err := strconv.Atoi(envAlertIntrvl); err == nil {
+			config.AlertInterval = time.Duration(alertIntervalInt) * time.Second
+		}
+	}
+
+	if envAlertWebhooks := os.Getenv("ALERT_WEBHOOKS"); envAlertWebhooks != "" {
+		config.AlertWebhooks = splitList(envAlertWebhooks)
+	}
+
+	if envShutdownTimeout := os.Getenv("SHUTDOWN_TIMEOUT"); envShutdownTimeout != "" {
+		if shutdownTimeoutInt, err := strconv.Atoi(envShutdownTimeout); err == nil {
+			config.ShutdownTimeout = time.Duration(shutdownTimeoutInt) * time.Second
+		}
+	}
+
+	if envKey := os.Getenv("KEY"); envKey != "" {
+		config.Key = envKey
+	}
+
+	if envCryptoKey := os.Getenv("CRYPTO_KEY"); envCryptoKey != "" {
+		config.CryptoKey = envCryptoKey
+	}
 
 	logger.LogSugar.Infoln("Server config:", config)
 
 	return config
 }
+
+// String прячет ключ: конфиг пишется в лог
+func (config ServerConfig) String() string {
+	if config.Key != "" {
+		config.Key = "***"
+	}
+
+	type plainConfig ServerConfig
+	return fmt.Sprintf("%v", plainConfig(config))
+}
+
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
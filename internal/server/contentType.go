@@ -9,13 +9,13 @@ func enforceContentTypeJSON(next http.HandlerFunc) http.HandlerFunc {
 	return func(res http.ResponseWriter, req *http.Request) {
 		ctHeader := req.Header.Get("Content-Type")
 		if ctHeader == "" {
-			http.Error(res, "missing content type header", http.StatusBadRequest)
+			jsonError(res, req, http.StatusBadRequest, "missing content type header")
 			return
 		}
 
 		contentType := strings.ToLower(strings.TrimSpace(strings.Split(ctHeader, ";")[0]))
 		if contentType != "application/json" {
-			http.Error(res, "wrong content type", http.StatusBadRequest)
+			jsonError(res, req, http.StatusBadRequest, "wrong content type")
 			return
 		}
 
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"io"
+	"net/http"
+
+	"prayago-metricsalert/internal/encryption"
+)
+
+// decryptMiddleware расшифровывает тело запроса закрытым ключом сервера.
+// Стоит перед gzipMiddleware: агент сначала сжимает, потом шифрует.
+// С ключом незашифрованные запросы не принимаются, без ключа ничего не делает.
+func decryptMiddleware(key *rsa.PrivateKey, next http.HandlerFunc) http.HandlerFunc {
+	if key == nil {
+		return next
+	}
+
+	return func(res http.ResponseWriter, req *http.Request) {
+		if req.Header.Get(encryption.Header) != encryption.Scheme {
+			jsonError(res, req, http.StatusBadRequest, "request body must be encrypted with "+encryption.Scheme)
+			return
+		}
+
+		message, err := io.ReadAll(req.Body)
+		if err != nil {
+			jsonError(res, req, http.StatusBadRequest, err.Error())
+			return
+		}
+		plain, err := encryption.Decrypt(key, message)
+		if err != nil {
+			jsonError(res, req, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		req.Body = io.NopCloser(bytes.NewReader(plain))
+		req.ContentLength = int64(len(plain))
+		req.Header.Del(encryption.Header)
+		next.ServeHTTP(res, req)
+	}
+}
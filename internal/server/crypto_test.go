@@ -0,0 +1,62 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"prayago-metricsalert/internal/encryption"
+	"prayago-metricsalert/internal/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecryptMiddleware(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	store := storage.NewStorage(storage.StorageConfig{DSN: "memory://"})
+	router := GetRouter(store, dummyAlerter{}, RouterOptions{PrivateKey: key})
+
+	// агент сначала сжимает, потом шифрует
+	var gzipped bytes.Buffer
+	gzipper := gzip.NewWriter(&gzipped)
+	gzipper.Write([]byte(`[{"id":"PollCount","type":"counter","delta":1}]`))
+	gzipper.Close()
+	encrypted, err := encryption.Encrypt(&key.PublicKey, gzipped.Bytes())
+	require.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		body      []byte
+		encrypted bool
+		code      int
+	}{
+		{name: "Encrypted batch should be StatusOK", body: encrypted, encrypted: true, code: http.StatusOK},
+		{name: "Plain batch should return StatusBadRequest", body: gzipped.Bytes(), code: http.StatusBadRequest},
+		{name: "Garbage should return StatusBadRequest", body: gzipped.Bytes(), encrypted: true, code: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewReader(test.body))
+			request.Header.Set("Content-Type", "application/json")
+			request.Header.Set("Content-Encoding", "gzip")
+			if test.encrypted {
+				request.Header.Set(encryption.Header, encryption.Scheme)
+			}
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, request)
+
+			assert.Equal(t, test.code, w.Code)
+		})
+	}
+
+	value, err := store.GetMetricValue("PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), value)
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"runtime/debug"
+	"strings"
+
+	"prayago-metricsalert/internal/logger"
+)
+
+const requestIDHeader = "X-Request-Id"
+
+// ID клиента попадает в заголовок ответа, в лог и в тело ошибки,
+// поэтому берем только короткий и без лишних символов
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+type requestIDKey struct{}
+
+// errorResponse -- тело ответа с ошибкой у JSON API
+type errorResponse struct {
+	Code      int    `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// requestIDMiddleware берет X-Request-Id клиента или, если его нет или он не годится,
+// придумывает свой и возвращает его в ответе, по нему ошибку клиента можно найти в логе
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+
+		res.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(res, req.WithContext(context.WithValue(req.Context(), requestIDKey{}, id)))
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func requestID(req *http.Request) string {
+	id, _ := req.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// recoveryMiddleware превращает панику в хендлере в ответ 500,
+// иначе клиент получает оборванное соединение без ответа
+func recoveryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		watcher := &headerWatcher{ResponseWriter: res}
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			// так net/http просит молча оборвать ответ
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+
+			logger.LogSugar.Errorln("panic in handler", "request_id", requestID(req),
+				"uri", req.RequestURI, "panic", recovered, "stack", string(debug.Stack()))
+			if watcher.wroteHeader {
+				// статус уже ушел клиенту, остается только оборвать ответ
+				panic(http.ErrAbortHandler)
+			}
+			// ответ об ошибке не сжимается, даже если gzipMiddleware уже объявил gzip
+			res.Header().Del("Content-Encoding")
+			if wantsJSON(req) {
+				jsonError(res, req, http.StatusInternalServerError, "internal server error")
+				return
+			}
+			textError(res, req, http.StatusInternalServerError, "internal server error")
+		}()
+
+		next.ServeHTTP(watcher, req)
+	})
+}
+
+// headerWatcher запоминает, ушел ли уже статус ответа
+type headerWatcher struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *headerWatcher) WriteHeader(statusCode int) {
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *headerWatcher) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+func wantsJSON(req *http.Request) bool {
+	return strings.Contains(req.Header.Get("Content-Type"), "application/json") ||
+		strings.Contains(req.Header.Get("Accept"), "application/json")
+}
+
+// jsonError -- ошибка для JSON API: {"code": 400, "message": "...", "request_id": "..."}
+func jsonError(res http.ResponseWriter, req *http.Request, code int, message string) {
+	logError(req, code, message)
+
+	body, _ := json.Marshal(errorResponse{Code: code, Message: message, RequestID: requestID(req)})
+	res.Header().Set("Content-Type", "application/json")
+	res.Header().Set("X-Content-Type-Options", "nosniff")
+	res.WriteHeader(code)
+	res.Write(body)
+}
+
+// textError -- ошибка для адресов со значениями в пути (/update/{mtype}/...),
+// их клиенты ждут текст, request ID есть в заголовке X-Request-Id
+func textError(res http.ResponseWriter, req *http.Request, code int, message string) {
+	logError(req, code, message)
+	http.Error(res, message, code)
+}
+
+func logError(req *http.Request, code int, message string) {
+	if code >= http.StatusInternalServerError {
+		logger.LogSugar.Errorln("request_id", requestID(req), "uri", req.RequestURI, "status", code, "err", message)
+	}
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"prayago-metricsalert/internal/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// panicStorage падает на любом обращении
+type panicStorage struct {
+	dummyStorage
+}
+
+func (panicStorage) GetMetric(key string) (*Metric, error) {
+	var metric *Metric
+	return metric, metric.Validate()
+}
+
+func (panicStorage) GetMetricValue(key string) (any, error) {
+	var metric *Metric
+	return metric.GetValueField(), nil
+}
+
+// ID клиента берется, только если он короткий и из безопасных символов, иначе свой
+func TestRequestIDMiddleware(t *testing.T) {
+	handler := requestIDMiddleware(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, res.Header().Get(requestIDHeader), requestID(req))
+	}))
+
+	tests := []struct {
+		name string
+		id   string
+		keep bool
+	}{
+		{name: "valid", id: "req-1.A_b", keep: true},
+		{name: "max length", id: strings.Repeat("a", 64), keep: true},
+		{name: "empty", id: ""},
+		{name: "too long", id: strings.Repeat("a", 65)},
+		{name: "spaces", id: "id with spaces"},
+		{name: "quotes", id: `"},"admin":true`},
+		{name: "control", id: "id\x1b[31m"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/", nil)
+			request.Header.Set(requestIDHeader, test.id)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, request)
+
+			id := w.Header().Get(requestIDHeader)
+			if test.keep {
+				assert.Equal(t, test.id, id)
+				return
+			}
+			assert.NotEqual(t, test.id, id)
+			assert.Regexp(t, `^[0-9a-f]{16}$`, id)
+		})
+	}
+}
+
+func TestRecoveryMiddleware(t *testing.T) {
+	srv := httptest.NewServer(GetRouter(panicStorage{}, dummyAlerter{}, RouterOptions{}))
+	defer srv.Close()
+
+	// JSON API отвечает конвертом с request ID клиента
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/value/", strings.NewReader(`{"id":"Alloc","type":"gauge"}`))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(requestIDHeader, "test-id")
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	assert.Equal(t, http.StatusInternalServerError, res.StatusCode)
+	assert.Equal(t, "test-id", res.Header.Get(requestIDHeader))
+	var body errorResponse
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+	assert.Equal(t, errorResponse{Code: http.StatusInternalServerError, Message: "internal server error", RequestID: "test-id"}, body)
+
+	// адреса со значением в пути отвечают текстом, а сервер после паники жив
+	res, err = http.Get(srv.URL + "/value/gauge/Alloc")
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	assert.Equal(t, http.StatusInternalServerError, res.StatusCode)
+	assert.NotEmpty(t, res.Header.Get(requestIDHeader))
+	text, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "internal server error\n", string(text))
+}
+
+func TestJSONErrorEnvelope(t *testing.T) {
+	srv := httptest.NewServer(GetRouter(storage.NewStorage(storage.StorageConfig{DSN: "memory://"}), dummyAlerter{}, RouterOptions{}))
+	defer srv.Close()
+
+	res, err := http.Post(srv.URL+"/update/", "application/json", strings.NewReader(`{"id":"PollCount","type":"counter"}`))
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	assert.Equal(t, "application/json", res.Header.Get("Content-Type"))
+	var body errorResponse
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+	assert.Equal(t, http.StatusBadRequest, body.Code)
+	assert.Contains(t, body.Message, "delta")
+	assert.Equal(t, res.Header.Get(requestIDHeader), body.RequestID)
+	assert.NotEmpty(t, body.RequestID)
+}
@@ -70,13 +70,13 @@ func gzipMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(respWrtr http.ResponseWriter, req *http.Request) {
 		origRespWrtr := respWrtr
 
+		var compWrtr *compressWriter
 		acceptEncoding := req.Header.Get("Accept-Encoding")
 		supportsGzip := strings.Contains(acceptEncoding, "gzip")
 		if supportsGzip {
 			respWrtr.Header().Set("Content-Encoding", "gzip")
-			compWrtr := newCompressWriter(respWrtr)
+			compWrtr = newCompressWriter(respWrtr)
 			origRespWrtr = compWrtr
-			defer compWrtr.Close()
 		}
 
 		contentEncoding := req.Header.Get("Content-Encoding")
@@ -92,5 +92,10 @@ func gzipMiddleware(next http.HandlerFunc) http.HandlerFunc {
 		}
 
 		next.ServeHTTP(origRespWrtr, req)
+		// не через defer: при панике в хендлере хвост gzip ушел бы со статусом 200,
+		// и recoveryMiddleware уже не смог бы ответить 500
+		if compWrtr != nil {
+			compWrtr.Close()
+		}
 	}
 }
@@ -2,28 +2,48 @@ package server
 
 import (
 	"bytes"
+	"crypto/rsa"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"prayago-metricsalert/internal/alerts"
 	"prayago-metricsalert/internal/logger"
+	"prayago-metricsalert/internal/metrics"
 	"prayago-metricsalert/internal/storage"
+	"strconv"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 )
 
 type (
 	Metric = storage.Metric
+	Sample = storage.Sample
 )
 
-func GetRouter(store storage.Storager) http.Handler {
+// RouterOptions -- настройки роутера, не связанные с хранилищем
+type RouterOptions struct {
+	Key        string          // общий с агентом ключ подписи HashSHA256, пустой -- запросы не подписываются
+	PrivateKey *rsa.PrivateKey // ключ для тела, зашифрованного агентом, nil -- тело не шифруется
+}
+
+func GetRouter(store storage.Storager, alerter alerts.Alerter, opts RouterOptions) http.Handler {
 	router := chi.NewRouter()
+	router.Use(requestIDMiddleware)
 	router.Use(HTTPHandlerWithLogger)
+	router.Use(recoveryMiddleware)
 	router.Get("/", gzipMiddleware(
 		func(res http.ResponseWriter, req *http.Request) {
 			getAllMetrics(store, res, req)
 		},
 	))
+	router.Get("/metrics", gzipMiddleware(
+		func(res http.ResponseWriter, req *http.Request) {
+			getPrometheusMetrics(store, res, req)
+		},
+	))
 	router.Get("/ping",
 		func(res http.ResponseWriter, req *http.Request) {
 			ping(store, res, req)
@@ -34,31 +54,53 @@ func GetRouter(store storage.Storager) http.Handler {
 			getMetric(store, res, req)
 		},
 	)
-	router.Post("/update/{mtype}/{mname}/{mvalue}",
+	router.Get("/history/{mtype}/{mname}", gzipMiddleware(
+		func(res http.ResponseWriter, req *http.Request) {
+			getHistory(store, res, req)
+		},
+	))
+	router.Post("/update/{mtype}/{mname}/{mvalue}", forbidUnsigned(opts.Key,
 		func(res http.ResponseWriter, req *http.Request) {
 			updateMetric(store, res, req)
 		},
-	)
-	router.Post("/update/", gzipMiddleware(enforceContentTypeJSON(
+	))
+	router.Post("/update/", decryptMiddleware(opts.PrivateKey, gzipMiddleware(enforceContentTypeJSON(hashMiddleware(opts.Key,
 		func(res http.ResponseWriter, req *http.Request) {
 			updateMetricJSON(store, res, req)
 		},
-	)))
-	router.Post("/updates/", gzipMiddleware(enforceContentTypeJSON(
+	)))))
+	router.Post("/updates/", decryptMiddleware(opts.PrivateKey, gzipMiddleware(enforceContentTypeJSON(hashMiddleware(opts.Key,
 		func(res http.ResponseWriter, req *http.Request) {
 			updatesBatch(store, res, req)
 		},
-	)))
+	)))))
 	router.Post("/value/", gzipMiddleware(enforceContentTypeJSON(
 		func(res http.ResponseWriter, req *http.Request) {
 			getMetricJSON(store, res, req)
 		},
 	)))
 
+	router.Get("/alerts", gzipMiddleware(
+		func(res http.ResponseWriter, req *http.Request) {
+			getAlerts(alerter, res, req)
+		},
+	))
+	router.Get("/alerts/failed", gzipMiddleware(
+		func(res http.ResponseWriter, req *http.Request) {
+			getFailedDeliveries(alerter, res, req)
+		},
+	))
+
 	return router
 }
 
-func getAllMetrics(store storage.Storager, res http.ResponseWriter, _ *http.Request) {
+func getAllMetrics(store storage.Storager, res http.ResponseWriter, req *http.Request) {
+	filter, err := metrics.ParseLabels(req.URL.Query().Get("labels"))
+	if err != nil {
+		textError(res, req, http.StatusBadRequest, err.Error())
+		return
+	}
+
 	res.Header().Set("Content-Type", "text/html; charset=utf-8")
 	html := fmt.Sprintf("%s%s%s",
 		`
@@ -69,27 +111,38 @@ func getAllMetrics(store storage.Storager, res http.ResponseWriter, _ *http.Requ
         <title>Metrics</title>
     </head>
     <body>
-`, store.GetAllMetricsAsString(),
+`, store.GetAllMetricsAsString(filter),
 		`   </body>
 </html>`)
 	io.WriteString(res, html)
 }
 
-func ping(store storage.Storager, res http.ResponseWriter, _ *http.Request) {
+func ping(store storage.Storager, res http.ResponseWriter, req *http.Request) {
 	if store.Ping() {
 		res.WriteHeader(http.StatusOK)
 		return
 	}
 
-	http.Error(res, "No database connection", http.StatusInternalServerError)
+	textError(res, req, http.StatusInternalServerError, "No database connection")
 }
 
 func getMetric(store storage.Storager, res http.ResponseWriter, req *http.Request) {
 	mName := chi.URLParam(req, "mname")
+	labels, err := metrics.ParseLabels(req.URL.Query().Get("labels"))
+	if err != nil {
+		textError(res, req, http.StatusBadRequest, err.Error())
+		return
+	}
 
-	value, err := store.GetMetricValue(mName)
+	value, err := store.GetMetricValue(metrics.SeriesKey(mName, labels))
+	if err != nil && len(labels) == 0 {
+		var metric *Metric
+		if metric, err = soleSeries(store, chi.URLParam(req, "mtype"), mName, err); err == nil {
+			value = metric.GetValue()
+		}
+	}
 	if err != nil {
-		http.Error(res, err.Error(), http.StatusNotFound)
+		textError(res, req, http.StatusNotFound, err.Error())
 		return
 	}
 
@@ -98,22 +151,108 @@ func getMetric(store storage.Storager, res http.ResponseWriter, req *http.Reques
 	io.WriteString(res, fmt.Sprintf("%v", value))
 }
 
+type history struct {
+	ID      string         `json:"id"`
+	MType   string         `json:"type"`
+	Labels  metrics.Labels `json:"labels,omitempty"`
+	Samples []Sample       `json:"samples"`
+}
+
+func getHistory(store storage.Storager, res http.ResponseWriter, req *http.Request) {
+	mType := chi.URLParam(req, "mtype")
+	mName := chi.URLParam(req, "mname")
+	labels, err := metrics.ParseLabels(req.URL.Query().Get("labels"))
+	if err != nil {
+		textError(res, req, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	from, err := parseTimeParam(req.URL.Query().Get("from"))
+	if err != nil {
+		textError(res, req, http.StatusBadRequest, fmt.Sprintf("wrong from: %v", err))
+		return
+	}
+	to, err := parseTimeParam(req.URL.Query().Get("to"))
+	if err != nil {
+		textError(res, req, http.StatusBadRequest, fmt.Sprintf("wrong to: %v", err))
+		return
+	}
+
+	metric, err := store.GetMetric(metrics.SeriesKey(mName, labels))
+	if err != nil {
+		textError(res, req, http.StatusNotFound, err.Error())
+		return
+	}
+	if metric.MType != mType {
+		textError(res, req, http.StatusNotFound, "metric not found")
+		return
+	}
+
+	samples, err := store.GetHistory(mName, labels, from, to)
+	if errors.Is(err, storage.ErrHistoryDisabled) {
+		textError(res, req, http.StatusNotImplemented, err.Error())
+		return
+	}
+	if err != nil {
+		textError(res, req, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	historyMarshalled, err := json.Marshal(history{ID: mName, MType: mType, Labels: labels, Samples: samples})
+	if err != nil {
+		textError(res, req, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	res.Write(historyMarshalled)
+}
+
+// время в from/to принимаем в RFC3339 или в секундах unix time, пустое -- без ограничения
+func parseTimeParam(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+
+	return time.Parse(time.RFC3339, value)
+}
+
 func updateMetric(store storage.Storager, res http.ResponseWriter, req *http.Request) {
 	var mname string
 	if mname = chi.URLParam(req, "mname"); mname == "" {
-		http.Error(res, "empty metric name", http.StatusNotFound)
+		textError(res, req, http.StatusNotFound, "empty metric name")
 		return
 	}
 
 	mvalueStr := chi.URLParam(req, "mvalue")
 	if mvalueStr == "" {
-		http.Error(res, "empty metric value", http.StatusBadRequest)
+		textError(res, req, http.StatusBadRequest, "empty metric value")
+		return
+	}
+
+	labels, err := metrics.ParseLabels(req.URL.Query().Get("labels"))
+	if err != nil {
+		textError(res, req, http.StatusBadRequest, err.Error())
 		return
 	}
 
 	mtype := chi.URLParam(req, "mtype")
-	if _, err := store.UpdateMetricValue(mtype, mname, mvalueStr); err != nil {
-		http.Error(res, err.Error(), http.StatusBadRequest)
+	if err := metrics.ValidateSeries(mname, mtype, labels); err != nil {
+		textError(res, req, http.StatusBadRequest, err.Error())
+		return
+	}
+	if _, err := metrics.ParseValue(mname, mtype, mvalueStr); err != nil {
+		textError(res, req, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if _, err := store.UpdateMetricValue(mtype, mname, labels, mvalueStr); err != nil {
+		textError(res, req, http.StatusBadRequest, err.Error())
 		return
 	}
 
@@ -125,76 +264,253 @@ func updateMetricJSON(store storage.Storager, res http.ResponseWriter, req *http
 	var buf bytes.Buffer
 	_, err := buf.ReadFrom(req.Body)
 	if err != nil {
-		http.Error(res, err.Error(), http.StatusBadRequest)
+		jsonError(res, req, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	var metric Metric
-	if err = json.Unmarshal(buf.Bytes(), &metric); err != nil {
-		http.Error(res, "could not unmarshall JSON", http.StatusBadRequest)
+	metric, err := decodeMetric(buf.Bytes())
+	if err != nil {
+		jsonError(res, req, http.StatusBadRequest, err.Error())
 		return
 	}
 
 	updatedMetric, err := store.UpdateMetric(metric)
 	if err != nil {
-		http.Error(res, err.Error(), http.StatusBadRequest)
+		jsonError(res, req, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	sendJSONedMetric(updatedMetric, res)
+	sendJSONedMetric(updatedMetric, res, req)
+}
+
+const (
+	batchItemAccepted = "accepted"
+	batchItemRejected = "rejected"
+)
+
+// batchItemResult -- итог одной метрики пачки в ответе /updates/,
+// у принятой метрики значение после обновления, у отклоненной -- причина
+type batchItemResult struct {
+	ID        string             `json:"id"`
+	MType     string             `json:"type"`
+	Labels    metrics.Labels     `json:"labels,omitempty"`
+	Status    string             `json:"status"`
+	Delta     *int64             `json:"delta,omitempty"`
+	Value     *float64           `json:"value,omitempty"`
+	Histogram *metrics.Histogram `json:"histogram,omitempty"`
+	Summary   *metrics.Summary   `json:"summary,omitempty"`
+	Error     string             `json:"error,omitempty"`
 }
 
+func newBatchItemResult(metric Metric, result storage.BatchResult) batchItemResult {
+	item := batchItemResult{
+		ID:     metric.ID,
+		MType:  metric.MType,
+		Labels: metric.Labels,
+		Status: batchItemAccepted,
+	}
+	if result.Err != nil {
+		item.Status = batchItemRejected
+		item.Error = result.Err.Error()
+		return item
+	}
+
+	item.Delta = result.Metric.Delta
+	item.Value = result.Metric.Value
+	item.Histogram = result.Metric.Histogram
+	item.Summary = result.Metric.Summary
+
+	return item
+}
+
+// updatesBatch отвечает массивом итогов в порядке метрик запроса.
+// Обычно годные метрики применяются, а негодные отклоняются по одной, ответ 200.
+// С ?strict=true любая негодная метрика отклоняет всю пачку, ответ 400.
+// Ответ 503 -- хранилище не смогло применить строгую пачку и не применило из нее ничего,
+// пачку можно повторить. Итоги по метрикам есть в ответе всегда: метрики, которые уже
+// применены, не должны повторяться.
 func updatesBatch(store storage.Storager, res http.ResponseWriter, req *http.Request) {
+	strict := false
+	if param := req.URL.Query().Get("strict"); param != "" {
+		var err error
+		if strict, err = strconv.ParseBool(param); err != nil {
+			jsonError(res, req, http.StatusBadRequest, "wrong strict parameter")
+			return
+		}
+	}
+
+	status := http.StatusOK
 	var buf bytes.Buffer
 	_, err := buf.ReadFrom(req.Body)
 	if err != nil {
 		logger.LogSugar.Errorln("updatesBatch() err:", err)
-		http.Error(res, err.Error(), http.StatusBadRequest)
+		jsonError(res, req, http.StatusBadRequest, err.Error())
 		return
 	}
-	var metrics = make([]Metric, 0)
-	if err = json.Unmarshal(buf.Bytes(), &metrics); err != nil {
+	// метрики разбираются по одной, чтобы негодная отклонялась сама, а не вся пачка
+	var raw = make([]json.RawMessage, 0)
+	if err = json.Unmarshal(buf.Bytes(), &raw); err != nil {
 		logger.LogSugar.Errorln("updatesBatch() err:", err)
-		http.Error(res, "could not unmarshall JSON", http.StatusBadRequest)
+		jsonError(res, req, http.StatusBadRequest, "could not unmarshall JSON")
 		return
 	}
 
-	// logger.LogSugar.Infoln("updatesBatch() metrics:", metrics)
-	err = store.UpdateBatch(metrics)
+	batch := make([]Metric, len(raw))
+	results := make([]storage.BatchResult, len(raw))
+	valid := make([]Metric, 0, len(raw))
+	validIndices := make([]int, 0, len(raw))
+	for i, item := range raw {
+		batch[i], results[i].Err = decodeMetric(item)
+		if results[i].Err == nil {
+			valid = append(valid, batch[i])
+			validIndices = append(validIndices, i)
+		}
+	}
+
+	if strict && len(valid) < len(batch) {
+		for i := range results {
+			if results[i].Err == nil {
+				results[i].Err = storage.ErrBatchRejected
+			}
+		}
+	} else {
+		validResults, err := store.UpdateBatch(valid, strict)
+		if err != nil {
+			// хранилище не применило ничего, так что повтор пачки ничего не задвоит
+			logger.LogSugar.Errorln("updatesBatch() err:", err)
+			status = http.StatusServiceUnavailable
+		}
+		for j, i := range validIndices {
+			results[i] = validResults[j]
+		}
+	}
+
+	items := make([]batchItemResult, len(batch))
+	for i, result := range results {
+		items[i] = newBatchItemResult(batch[i], result)
+		if result.Err != nil {
+			logger.LogSugar.Infoln("updatesBatch() rejected", batch[i].Key(), result.Err)
+			if strict && status == http.StatusOK {
+				status = http.StatusBadRequest
+			}
+		}
+	}
+
+	body, err := json.Marshal(items)
 	if err != nil {
-		logger.LogSugar.Errorln("updatesBatch() err:", err)
-		http.Error(res, err.Error(), http.StatusBadRequest)
+		jsonError(res, req, http.StatusInternalServerError, err.Error())
 		return
 	}
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	res.Write(body)
+}
+
+// decodeMetric разбирает и проверяет метрику из JSON,
+// ошибки проверки -- *metrics.ValidationError, их хендлеры отдают с 400
+func decodeMetric(data []byte) (Metric, error) {
+	var metric Metric
+	if err := json.Unmarshal(data, &metric); err != nil {
+		// в ответе пачки пригодится то, что успело разобраться, например имя
+		if errors.Is(err, metrics.ErrInvalidMetric) {
+			return metric, err
+		}
+		return metric, errors.New("could not unmarshall JSON")
+	}
+
+	return metric, metric.Validate()
 }
 
 func getMetricJSON(store storage.Storager, res http.ResponseWriter, req *http.Request) {
 	var buf bytes.Buffer
 	_, err := buf.ReadFrom(req.Body)
 	if err != nil {
-		http.Error(res, err.Error(), http.StatusBadRequest)
+		jsonError(res, req, http.StatusBadRequest, err.Error())
 		return
 	}
 
 	var metric Metric
 	if err = json.Unmarshal(buf.Bytes(), &metric); err != nil {
-		http.Error(res, err.Error(), http.StatusBadRequest)
+		jsonError(res, req, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	updatedMetric, err := store.GetMetric(metric.ID)
+	updatedMetric, err := store.GetMetric(metric.Key())
+	if err != nil && len(metric.Labels) == 0 {
+		updatedMetric, err = soleSeries(store, metric.MType, metric.ID, err)
+	}
 	if err != nil {
-		http.Error(res, err.Error(), http.StatusNotFound)
+		jsonError(res, req, http.StatusNotFound, err.Error())
 		return
 	}
 
-	sendJSONedMetric(updatedMetric, res)
+	sendJSONedMetric(updatedMetric, res, req)
 }
 
-func sendJSONedMetric(metric *Metric, res http.ResponseWriter) {
+// soleSeries -- запрос без меток, а серии без меток нет. Агент по умолчанию ставит метку host,
+// поэтому, если у имени всего одна серия этого типа, отдаем ее. Нет ни одной -- ошибка notFound,
+// несколько -- просим выбрать метки.
+func soleSeries(store storage.Storager, mType string, name string, notFound error) (*Metric, error) {
+	var found []Metric
+	for _, metric := range store.GetAllMetrics(nil) {
+		if metric.ID == name && metric.MType == mType {
+			found = append(found, metric)
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return nil, notFound
+	case 1:
+		return &found[0], nil
+	}
+
+	return nil, fmt.Errorf("metric %s has %d series, choose one with labels", name, len(found))
+}
+
+func getAlerts(alerter alerts.Alerter, res http.ResponseWriter, req *http.Request) {
+	state := req.URL.Query().Get("state")
+	switch state {
+	case "":
+		state = alerts.StateFiring
+	case alerts.StateInactive, alerts.StatePending, alerts.StateFiring, alerts.StateResolved, alerts.StateAll:
+	default:
+		jsonError(res, req, http.StatusBadRequest, fmt.Sprintf("unsupported alert state %s", state))
+		return
+	}
+
+	alertsMarshalled, err := json.Marshal(alerter.Alerts(state))
+	if err != nil {
+		jsonError(res, req, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	res.Write(alertsMarshalled)
+}
+
+func getFailedDeliveries(alerter alerts.Alerter, res http.ResponseWriter, req *http.Request) {
+	deliveriesMarshalled, err := json.Marshal(alerter.FailedDeliveries())
+	if err != nil {
+		jsonError(res, req, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	res.Write(deliveriesMarshalled)
+}
+
+func sendJSONedMetric(metric *Metric, res http.ResponseWriter, req *http.Request) {
+	if metric == nil {
+		jsonError(res, req, http.StatusInternalServerError, "storage returned no metric")
+		return
+	}
+
 	metricMarshalled, err := json.Marshal(&metric)
 	if err != nil {
-		http.Error(res, err.Error(), http.StatusInternalServerError)
+		jsonError(res, req, http.StatusInternalServerError, err.Error())
 		return
 	}
 
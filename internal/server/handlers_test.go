@@ -1,43 +1,66 @@
 package server
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	"prayago-metricsalert/internal/alerts"
 	"prayago-metricsalert/internal/chimocker"
 	"prayago-metricsalert/internal/metrics"
+	"prayago-metricsalert/internal/storage"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 // т.к. сервер через DI получает ссылку на экземпляр Storage,
 // то объявим здесь мок Storage, чтобы не использовать настоящий инстанс в тестах
 type dummyStorage struct {
 	getMetricValueImpl func(name string) (any, error)
+	getMetricImpl      func(name string) (*Metric, error)
+	getHistoryImpl     func(name string, labels storage.Labels, from time.Time, to time.Time) ([]Sample, error)
+	allMetrics         []Metric
 }
 
-func (store dummyStorage) GetAllMetricsAsString() string {
+func (store dummyStorage) GetAllMetricsAsString(filter storage.Labels) string {
 	return ""
 }
 
-func (store dummyStorage) GetMetricValue(name string) (any, error) {
+func (store dummyStorage) GetAllMetrics(filter storage.Labels) []Metric {
+	return store.allMetrics
+}
+
+func (store dummyStorage) GetMetricValue(key string) (any, error) {
 	// если в моке есть реализация метода -- используем ее, иначе отадим пустое значение
 	if store.getMetricValueImpl != nil {
-		return store.getMetricValueImpl(name)
+		return store.getMetricValueImpl(key)
 	}
 
 	return nil, nil
 }
 
-func (store dummyStorage) GetMetric(name string) (*Metric, error) {
+func (store dummyStorage) GetMetric(key string) (*Metric, error) {
+	if store.getMetricImpl != nil {
+		return store.getMetricImpl(key)
+	}
 	return nil, nil
 }
 
-func (store dummyStorage) UpdateMetricValue(mType string, name string, value string) (*Metric, error) {
+func (store dummyStorage) GetHistory(name string, labels storage.Labels, from time.Time, to time.Time) ([]Sample, error) {
+	if store.getHistoryImpl != nil {
+		return store.getHistoryImpl(name, labels, from, to)
+	}
+	return nil, nil
+}
+
+func (store dummyStorage) UpdateMetricValue(mType string, name string, labels storage.Labels, value string) (*Metric, error) {
 	if name == "" {
 		return nil, errors.New("")
 	}
@@ -70,8 +93,31 @@ func (store dummyStorage) Ping() bool {
 	return true
 }
 
-func (store dummyStorage) UpdateBatch(metrics []Metric) error {
-	return nil
+func (store dummyStorage) UpdateBatch(batch []Metric, strict bool) ([]storage.BatchResult, error) {
+	results := make([]storage.BatchResult, len(batch))
+	for i := range batch {
+		results[i].Metric = &batch[i]
+	}
+
+	return results, nil
+}
+
+type dummyAlerter struct {
+	alerts []alerts.Alert
+}
+
+func (alerter dummyAlerter) Alerts(state string) []alerts.Alert {
+	result := make([]alerts.Alert, 0)
+	for _, alert := range alerter.alerts {
+		if state == alerts.StateAll || alert.State == state {
+			result = append(result, alert)
+		}
+	}
+	return result
+}
+
+func (alerter dummyAlerter) FailedDeliveries() []alerts.Delivery {
+	return []alerts.Delivery{}
 }
 
 func TestUpdateMetric(t *testing.T) {
@@ -134,6 +180,24 @@ func TestUpdateMetric(t *testing.T) {
 				code: http.StatusBadRequest,
 			},
 		},
+		{
+			name:   "Update not finite gauge value should return StatusBadRequest",
+			mType:  "gauge",
+			mName:  "gaugeMetric1",
+			mValue: "NaN",
+			want: want{
+				code: http.StatusBadRequest,
+			},
+		},
+		{
+			name:   "Update too long metric name should return StatusBadRequest",
+			mType:  "gauge",
+			mName:  strings.Repeat("a", metrics.MaxNameLength+1),
+			mValue: "1",
+			want: want{
+				code: http.StatusBadRequest,
+			},
+		},
 		{
 			name:   "Update wrong gauge value should return StatusBadRequest",
 			mType:  "gauge",
@@ -231,3 +295,315 @@ func TestGetMetric(t *testing.T) {
 		})
 	}
 }
+
+// агент по умолчанию шлет метку host, но метрика находится и без ?labels=,
+// пока у имени одна серия
+func TestGetMetricSoleSeries(t *testing.T) {
+	store := storage.NewStorage(storage.StorageConfig{DSN: "memory://"})
+	web1 := metrics.Labels{"host": "web1"}
+	_, err := store.UpdateMetricValue(metrics.GaugeMetric, "Alloc", web1, "1.5")
+	require.NoError(t, err)
+	_, err = store.UpdateMetricValue(metrics.CounterMetric, "PollCount", web1, "2")
+	require.NoError(t, err)
+	_, err = store.UpdateMetricValue(metrics.CounterMetric, "PollCount", metrics.Labels{"host": "web2"}, "3")
+	require.NoError(t, err)
+	router := GetRouter(store, dummyAlerter{}, RouterOptions{})
+
+	get := func(path string) (int, string) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Code, w.Body.String()
+	}
+
+	code, body := get("/value/gauge/Alloc")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "1.5", body)
+
+	code, _ = get("/value/counter/Alloc")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	// две серии -- какую отдать, не угадать
+	code, body = get("/value/counter/PollCount")
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.Contains(t, body, "2 series")
+
+	code, body = get("/value/counter/PollCount?labels=host:web2")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "3", body)
+
+	request := httptest.NewRequest(http.MethodPost, "/value/", strings.NewReader(`{"id":"Alloc","type":"gauge"}`))
+	request.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, request)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"id":"Alloc","type":"gauge","value":1.5,"labels":{"host":"web1"}}`, w.Body.String())
+}
+
+func TestGetAlerts(t *testing.T) {
+	alerter := dummyAlerter{
+		alerts: []alerts.Alert{
+			{Rule: alerts.Rule{Name: "HighAlloc"}, State: alerts.StateFiring},
+			{Rule: alerts.Rule{Name: "LowRandom"}, State: alerts.StatePending},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		query    string
+		code     int
+		contains []string
+	}{
+		{
+			name:     "Get alerts without state should return firing only",
+			query:    "",
+			code:     http.StatusOK,
+			contains: []string{"HighAlloc"},
+		},
+		{
+			name:     "Get all alerts should return every alert",
+			query:    "?state=all",
+			code:     http.StatusOK,
+			contains: []string{"HighAlloc", "LowRandom"},
+		},
+		{
+			name:  "Get alerts with unknown state should return StatusBadRequest",
+			query: "?state=burning",
+			code:  http.StatusBadRequest,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/alerts"+test.query, nil)
+			w := httptest.NewRecorder()
+
+			getAlerts(alerter, w, request)
+
+			res := w.Result()
+			defer res.Body.Close()
+			resBody, err := io.ReadAll(res.Body)
+			assert.NoError(t, err)
+			assert.Equal(t, test.code, res.StatusCode)
+			for _, s := range test.contains {
+				assert.Contains(t, string(resBody), s)
+			}
+			if test.query == "" {
+				assert.NotContains(t, string(resBody), "LowRandom")
+			}
+		})
+	}
+}
+
+func TestGetHistory(t *testing.T) {
+	gauge := metrics.NewMetric("Alloc", metrics.GaugeMetric)
+	first, second := 1.5, 2.5
+	samples := []Sample{
+		{Timestamp: time.Unix(100, 0), Value: &first},
+		{Timestamp: time.Unix(200, 0), Value: &second},
+	}
+
+	store := dummyStorage{
+		getMetricImpl: func(name string) (*Metric, error) {
+			if name == "Alloc" {
+				return &gauge, nil
+			}
+			return nil, fmt.Errorf("metric not found")
+		},
+		getHistoryImpl: func(name string, labels storage.Labels, from time.Time, to time.Time) ([]Sample, error) {
+			result := make([]Sample, 0)
+			for _, sample := range samples {
+				if (from.IsZero() || !sample.Timestamp.Before(from)) && (to.IsZero() || !sample.Timestamp.After(to)) {
+					result = append(result, sample)
+				}
+			}
+			return result, nil
+		},
+	}
+
+	tests := []struct {
+		name    string
+		mType   string
+		mName   string
+		query   string
+		code    int
+		samples int
+	}{
+		{
+			name:    "Get whole history should be StatusOK",
+			mType:   "gauge",
+			mName:   "Alloc",
+			code:    http.StatusOK,
+			samples: 2,
+		},
+		{
+			name:    "Get history from unix time should filter samples",
+			mType:   "gauge",
+			mName:   "Alloc",
+			query:   "?from=150",
+			code:    http.StatusOK,
+			samples: 1,
+		},
+		{
+			name:    "Get history to RFC3339 time should filter samples",
+			mType:   "gauge",
+			mName:   "Alloc",
+			query:   "?to=" + time.Unix(150, 0).UTC().Format(time.RFC3339),
+			code:    http.StatusOK,
+			samples: 1,
+		},
+		{
+			name:  "Get history with wrong time should return StatusBadRequest",
+			mType: "gauge",
+			mName: "Alloc",
+			query: "?from=yesterday",
+			code:  http.StatusBadRequest,
+		},
+		{
+			name:  "Get history with wrong type should return StatusNotFound",
+			mType: "counter",
+			mName: "Alloc",
+			code:  http.StatusNotFound,
+		},
+		{
+			name:  "Get history of unknown metric should return StatusNotFound",
+			mType: "gauge",
+			mName: "Unknown",
+			code:  http.StatusNotFound,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := fmt.Sprintf("/history/%s/%s%s", test.mType, test.mName, test.query)
+			request := httptest.NewRequest(http.MethodGet, path, nil)
+			w := httptest.NewRecorder()
+			urlParams := chimocker.URLParams{"mtype": test.mType, "mname": test.mName}
+			request = chimocker.WithURLParams(request, urlParams)
+
+			getHistory(store, w, request)
+
+			res := w.Result()
+			defer res.Body.Close()
+			assert.Equal(t, test.code, res.StatusCode)
+			if test.code != http.StatusOK {
+				return
+			}
+
+			var result history
+			assert.NoError(t, json.NewDecoder(res.Body).Decode(&result))
+			assert.Equal(t, test.mName, result.ID)
+			assert.Len(t, result.Samples, test.samples)
+		})
+	}
+
+	disabled := store
+	disabled.getHistoryImpl = func(name string, labels storage.Labels, from time.Time, to time.Time) ([]Sample, error) {
+		return nil, storage.ErrHistoryDisabled
+	}
+	request := httptest.NewRequest(http.MethodGet, "/history/gauge/Alloc", nil)
+	request = chimocker.WithURLParams(request, chimocker.URLParams{"mtype": "gauge", "mname": "Alloc"})
+	w := httptest.NewRecorder()
+	getHistory(disabled, w, request)
+	assert.Equal(t, http.StatusNotImplemented, w.Code)
+}
+
+func TestUpdatesBatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		code     int
+		statuses []string
+		stored   int
+	}{
+		{
+			name:     "Invalid items should be rejected one by one",
+			code:     http.StatusOK,
+			statuses: []string{batchItemAccepted, batchItemRejected, batchItemAccepted, batchItemRejected, batchItemRejected},
+			stored:   2,
+		},
+		{
+			name:     "Strict batch with invalid items should be rejected as a whole",
+			query:    "?strict=true",
+			code:     http.StatusBadRequest,
+			statuses: []string{batchItemRejected, batchItemRejected, batchItemRejected, batchItemRejected, batchItemRejected},
+			stored:   0,
+		},
+		{
+			name:  "Wrong strict parameter should return StatusBadRequest",
+			query: "?strict=maybe",
+			code:  http.StatusBadRequest,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := storage.NewStorage(storage.StorageConfig{DSN: "memory://"})
+			body := `[
+				{"id": "PollCount", "type": "counter", "delta": 2},
+				{"id": "Alloc", "type": "gauge"},
+				{"id": "RandomValue", "type": "gauge", "value": 0.5},
+				{"id": "Unknown", "type": "unknown", "value": 1},
+				{"id": "Broken", "type": "gauge", "value": "abc"}
+			]`
+			request := httptest.NewRequest(http.MethodPost, "/updates/"+test.query, strings.NewReader(body))
+			request.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+
+			updatesBatch(store, w, request)
+
+			res := w.Result()
+			defer res.Body.Close()
+			assert.Equal(t, test.code, res.StatusCode)
+			assert.Len(t, store.GetAllMetrics(nil), test.stored)
+			if test.statuses == nil {
+				return
+			}
+
+			var items []batchItemResult
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&items))
+			require.Len(t, items, len(test.statuses))
+			for i, item := range items {
+				assert.Equal(t, test.statuses[i], item.Status, item.ID)
+				if item.Status == batchItemRejected {
+					assert.NotEmpty(t, item.Error)
+				}
+			}
+			if test.statuses[0] == batchItemAccepted {
+				require.NotNil(t, items[0].Delta)
+				assert.Equal(t, int64(2), *items[0].Delta)
+			}
+		})
+	}
+}
+
+// failingBatchStorage не применяет пачку целиком, как атомарный бэкенд при ошибке базы
+type failingBatchStorage struct {
+	dummyStorage
+}
+
+func (store failingBatchStorage) UpdateBatch(batch []Metric, strict bool) ([]storage.BatchResult, error) {
+	err := errors.New("database is down")
+	results := make([]storage.BatchResult, len(batch))
+	for i := range results {
+		results[i].Err = err
+	}
+
+	return results, err
+}
+
+func TestUpdatesBatchStoreError(t *testing.T) {
+	body := `[{"id": "PollCount", "type": "counter", "delta": 2}]`
+	request := httptest.NewRequest(http.MethodPost, "/updates/?strict=true", strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+
+	updatesBatch(failingBatchStorage{}, w, request)
+
+	res := w.Result()
+	defer res.Body.Close()
+	// ничего не применено, агент может повторить пачку
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+
+	var items []batchItemResult
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&items))
+	require.Len(t, items, 1)
+	assert.Equal(t, batchItemRejected, items[0].Status)
+	assert.Equal(t, "database is down", items[0].Error)
+}
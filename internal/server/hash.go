@@ -0,0 +1,78 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"prayago-metricsalert/internal/signing"
+)
+
+// HashHeader -- HMAC-SHA256 тела по общему ключу, hex. Агент подписывает тело запроса
+// до сжатия, сервер так же подписывает свой ответ.
+const HashHeader = signing.Header
+
+// signingResponseWriter копит ответ, чтобы подписать его целиком до отправки заголовков
+type signingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *signingResponseWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+}
+
+func (w *signingResponseWriter) Write(p []byte) (int, error) {
+	return w.body.Write(p)
+}
+
+// hashMiddleware проверяет подпись запроса и подписывает ответ. Стоит после gzipMiddleware:
+// подписано несжатое тело. С пустым ключом ничего не проверяет.
+func hashMiddleware(key string, next http.HandlerFunc) http.HandlerFunc {
+	if key == "" {
+		return next
+	}
+
+	return func(res http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			jsonError(res, req, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		hash := req.Header.Get(HashHeader)
+		if hash == "" {
+			jsonError(res, req, http.StatusBadRequest, "missing "+HashHeader+" header")
+			return
+		}
+		if !signing.Verify([]byte(key), body, hash) {
+			jsonError(res, req, http.StatusBadRequest, "wrong "+HashHeader+" signature")
+			return
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+
+		signer := &signingResponseWriter{ResponseWriter: res}
+		next.ServeHTTP(signer, req)
+
+		if signer.status == 0 {
+			signer.status = http.StatusOK
+		}
+		res.Header().Set(HashHeader, signing.Sign([]byte(key), signer.body.Bytes()))
+		res.WriteHeader(signer.status)
+		res.Write(signer.body.Bytes())
+	}
+}
+
+// forbidUnsigned закрывает обновления через путь, когда задан ключ: тела у них нет,
+// подписывать нечего, а без подписи метрики менял бы любой, кто знает адрес сервера
+func forbidUnsigned(key string, next http.HandlerFunc) http.HandlerFunc {
+	if key == "" {
+		return next
+	}
+
+	return func(res http.ResponseWriter, req *http.Request) {
+		textError(res, req, http.StatusForbidden, "unsigned updates are disabled, use /update/ or /updates/ with "+HashHeader)
+	}
+}
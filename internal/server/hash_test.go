@@ -0,0 +1,80 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"prayago-metricsalert/internal/signing"
+	"prayago-metricsalert/internal/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHashMiddleware(t *testing.T) {
+	const key = "secret"
+	store := storage.NewStorage(storage.StorageConfig{DSN: "memory://"})
+	router := GetRouter(store, dummyAlerter{}, RouterOptions{Key: key})
+
+	body := []byte(`[{"id":"PollCount","type":"counter","delta":1}]`)
+	var gzipped bytes.Buffer
+	gzipper := gzip.NewWriter(&gzipped)
+	gzipper.Write(body)
+	gzipper.Close()
+
+	tests := []struct {
+		name string
+		hash string
+		code int
+	}{
+		{name: "Signed batch should be StatusOK", hash: signing.Sign([]byte(key), body), code: http.StatusOK},
+		{name: "Unsigned batch should return StatusBadRequest", code: http.StatusBadRequest},
+		{name: "Batch signed with another key should return StatusBadRequest", hash: signing.Sign([]byte("other"), body), code: http.StatusBadRequest},
+		{name: "Broken signature should return StatusBadRequest", hash: "xyz", code: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// подписано несжатое тело, а приходит сжатое
+			request := httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewReader(gzipped.Bytes()))
+			request.Header.Set("Content-Type", "application/json")
+			request.Header.Set("Content-Encoding", "gzip")
+			if test.hash != "" {
+				request.Header.Set(HashHeader, test.hash)
+			}
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, request)
+
+			res := w.Result()
+			defer res.Body.Close()
+			require.Equal(t, test.code, res.StatusCode)
+			if test.code == http.StatusOK {
+				assert.True(t, signing.Verify([]byte(key), w.Body.Bytes(), res.Header.Get(HashHeader)))
+			}
+		})
+	}
+
+	value, err := store.GetMetricValue("PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), value)
+}
+
+func TestForbidUnsignedURLUpdates(t *testing.T) {
+	store := storage.NewStorage(storage.StorageConfig{DSN: "memory://"})
+
+	request := httptest.NewRequest(http.MethodPost, "/update/counter/PollCount/1", nil)
+	w := httptest.NewRecorder()
+	GetRouter(store, dummyAlerter{}, RouterOptions{Key: "secret"}).ServeHTTP(w, request)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	_, err := store.GetMetric("PollCount")
+	assert.Error(t, err)
+
+	// без ключа все по-старому
+	request = httptest.NewRequest(http.MethodPost, "/update/counter/PollCount/1", nil)
+	w = httptest.NewRecorder()
+	GetRouter(store, dummyAlerter{}, RouterOptions{}).ServeHTTP(w, request)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
@@ -49,6 +49,7 @@ func HTTPHandlerWithLogger(next http.Handler) http.Handler {
 		duration := time.Since(start)
 
 		logger.LogSugar.Infoln(
+			"request_id", requestID(req),
 			"uri", req.RequestURI,
 			"method", req.Method,
 			"duration", duration,
@@ -0,0 +1,208 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"prayago-metricsalert/internal/logger"
+	"prayago-metricsalert/internal/metrics"
+	"prayago-metricsalert/internal/storage"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Content-Type текстового формата Prometheus
+const prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var invalidMetricNameChars = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+
+func getPrometheusMetrics(store storage.Storager, res http.ResponseWriter, req *http.Request) {
+	filter, err := metrics.ParseLabels(req.URL.Query().Get("labels"))
+	if err != nil {
+		textError(res, req, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	res.Header().Set("Content-Type", prometheusContentType)
+	res.WriteHeader(http.StatusOK)
+	writePrometheus(res, store.GetAllMetrics(filter))
+}
+
+// writePrometheus пишет метрики в text exposition format:
+// у каждого семейства одна строка # TYPE, потом все его серии.
+// Если имя, которое метрика выводит, уже занято другой метрикой -- после замены
+// недопустимых символов или суффиксом _sum/_count/_bucket, -- метрика пропускается,
+// иначе Prometheus получит одинаковые серии от разных метрик.
+func writePrometheus(w io.Writer, all []Metric) {
+	type family struct {
+		id      string
+		mType   string
+		metrics []Metric
+	}
+
+	families := make(map[string]*family)
+	owners := make(map[string]string) // имя в выводе -> ID метрики, которой оно принадлежит
+	names := make([]string, 0)
+	for _, metric := range all {
+		name := sanitizeMetricName(metric.ID)
+		f, present := families[name]
+		if !present {
+			if owner, taken := claimPrometheusNames(owners, metric.ID, name, metric.MType); taken {
+				logger.LogSugar.Errorf("prometheus: metric %s name %s conflicts with metric %s", metric.Key(), name, owner)
+				continue
+			}
+			f = &family{id: metric.ID, mType: metric.MType}
+			families[name] = f
+			names = append(names, name)
+		}
+		if f.id != metric.ID {
+			logger.LogSugar.Errorf("prometheus: metric %s name %s conflicts with metric %s", metric.Key(), name, f.id)
+			continue
+		}
+		// в одном семействе Prometheus не допускает разных типов
+		if f.mType != metric.MType {
+			logger.LogSugar.Errorf("prometheus: metric %s type %s conflicts with %s", metric.Key(), metric.MType, f.mType)
+			continue
+		}
+		f.metrics = append(f.metrics, metric)
+	}
+
+	for _, name := range names {
+		f := families[name]
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, f.mType)
+		for _, metric := range f.metrics {
+			writePrometheusSeries(w, name, metric)
+		}
+	}
+}
+
+// claimPrometheusNames занимает за метрикой id все имена, которые выводит ее семейство.
+// Если хоть одно уже занято, не занимает ничего и отдает ID хозяина.
+func claimPrometheusNames(owners map[string]string, id string, name string, mType string) (string, bool) {
+	seriesNames := []string{name}
+	switch mType {
+	case metrics.HistogramMetric:
+		seriesNames = []string{name + "_bucket", name + "_sum", name + "_count"}
+	case metrics.SummaryMetric:
+		seriesNames = append(seriesNames, name+"_sum", name+"_count")
+	}
+
+	for _, seriesName := range seriesNames {
+		if owner, taken := owners[seriesName]; taken && owner != id {
+			return owner, true
+		}
+	}
+	for _, seriesName := range seriesNames {
+		owners[seriesName] = id
+	}
+
+	return "", false
+}
+
+func writePrometheusSeries(w io.Writer, name string, metric Metric) {
+	labels := exportedLabels(metric.Labels)
+	switch metric.MType {
+	case metrics.GaugeMetric:
+		writePrometheusLine(w, name, labels, "", "", formatPrometheusFloat(*metric.Value))
+	case metrics.CounterMetric:
+		writePrometheusLine(w, name, labels, "", "", strconv.FormatInt(*metric.Delta, 10))
+	case metrics.HistogramMetric:
+		h := metric.Histogram
+		cumulative := h.CumulativeCounts()
+		for i, bound := range h.Buckets {
+			writePrometheusLine(w, name+"_bucket", labels, "le", formatPrometheusFloat(bound), strconv.FormatUint(cumulative[i], 10))
+		}
+		writePrometheusLine(w, name+"_bucket", labels, "le", "+Inf", strconv.FormatUint(cumulative[len(cumulative)-1], 10))
+		writePrometheusLine(w, name+"_sum", labels, "", "", formatPrometheusFloat(h.Sum))
+		writePrometheusLine(w, name+"_count", labels, "", "", strconv.FormatUint(h.Count, 10))
+	case metrics.SummaryMetric:
+		s := metric.Summary
+		for i, q := range s.Quantiles {
+			if i < len(s.Values) {
+				writePrometheusLine(w, name, labels, "quantile", formatPrometheusFloat(q), formatPrometheusFloat(s.Values[i]))
+			}
+		}
+		writePrometheusLine(w, name+"_sum", labels, "", "", formatPrometheusFloat(s.Sum))
+		writePrometheusLine(w, name+"_count", labels, "", "", strconv.FormatUint(s.Count, 10))
+	}
+}
+
+// служебные метки экспортера. Метки пользователя с такими именами выводятся
+// с приставкой exported_, как это делает сам Prometheus при конфликте меток.
+var reservedLabels = [...]string{"le", "quantile"}
+
+func exportedLabels(labels metrics.Labels) metrics.Labels {
+	var renamed metrics.Labels
+	for _, name := range reservedLabels {
+		value, present := labels[name]
+		if !present {
+			continue
+		}
+		if renamed == nil {
+			renamed = labels.Clone()
+		}
+
+		delete(renamed, name)
+		exported := "exported_" + name
+		for {
+			if _, taken := renamed[exported]; !taken {
+				break
+			}
+			exported = "exported_" + exported
+		}
+		renamed[exported] = value
+	}
+	if renamed == nil {
+		return labels
+	}
+
+	return renamed
+}
+
+// extraName/extraValue -- служебная метка le или quantile, идет последней
+func writePrometheusLine(w io.Writer, name string, labels metrics.Labels, extraName string, extraValue string, value string) {
+	pairs := make([]string, 0, len(labels)+1)
+	for _, labelName := range labels.Names() {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labelName, escapeLabelValue(labels[labelName])))
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extraName, extraValue))
+	}
+
+	if len(pairs) == 0 {
+		fmt.Fprintf(w, "%s %s\n", name, value)
+		return
+	}
+	fmt.Fprintf(w, "%s{%s} %s\n", name, strings.Join(pairs, ","), value)
+}
+
+// имя метрики в Prometheus: [a-zA-Z_:][a-zA-Z0-9_:]*
+func sanitizeMetricName(name string) string {
+	name = invalidMetricNameChars.ReplaceAllString(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+
+	return name
+}
+
+func escapeLabelValue(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `"`, `\"`)
+	return strings.ReplaceAll(value, "\n", `\n`)
+}
+
+func formatPrometheusFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"prayago-metricsalert/internal/metrics"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetPrometheusMetrics(t *testing.T) {
+	alloc := metrics.NewMetric("Alloc", metrics.GaugeMetric)
+	*alloc.Value = 1.5e6
+
+	pollWeb1 := metrics.NewMetric("PollCount", metrics.CounterMetric)
+	*pollWeb1.Delta = 7
+	pollWeb1.Labels = metrics.Labels{"host": "web1", "dc": `eu"1`}
+	pollWeb2 := metrics.NewMetric("PollCount", metrics.CounterMetric)
+	*pollWeb2.Delta = 3
+	pollWeb2.Labels = metrics.Labels{"host": "web2"}
+
+	latency := metrics.Metric{ID: "http.latency", MType: metrics.HistogramMetric, Histogram: metrics.NewHistogram([]float64{0.1, 1})}
+	latency.Histogram.Observe(0.05)
+	latency.Histogram.Observe(0.5)
+	latency.Histogram.Observe(2)
+
+	rt := metrics.Metric{ID: "rt", MType: metrics.SummaryMetric, Summary: metrics.NewSummary([]float64{0.5})}
+	rt.Summary.Observe(1)
+	rt.Summary.Observe(3)
+
+	// метрика с таким же именем, но другим типом в семейство не попадает
+	conflicting := metrics.NewMetric("Alloc", metrics.CounterMetric)
+	conflicting.Labels = metrics.Labels{"host": "web1"}
+
+	store := dummyStorage{allMetrics: []Metric{alloc, pollWeb1, pollWeb2, latency, rt, conflicting}}
+
+	request := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	w := httptest.NewRecorder()
+	getPrometheusMetrics(store, w, request)
+
+	res := w.Result()
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, prometheusContentType, res.Header.Get("Content-Type"))
+	assert.Equal(t, `# TYPE Alloc gauge
+Alloc 1.5e+06
+# TYPE PollCount counter
+PollCount{dc="eu\"1",host="web1"} 7
+PollCount{host="web2"} 3
+# TYPE http_latency histogram
+http_latency_bucket{le="0.1"} 1
+http_latency_bucket{le="1"} 2
+http_latency_bucket{le="+Inf"} 3
+http_latency_sum 2.55
+http_latency_count 3
+# TYPE rt summary
+rt{quantile="0.5"} 1
+rt_sum 4
+rt_count 2
+`, string(body))
+}
+
+func TestSanitizeMetricName(t *testing.T) {
+	assert.Equal(t, "Alloc", sanitizeMetricName("Alloc"))
+	assert.Equal(t, "http_server_requests", sanitizeMetricName("http.server-requests"))
+	assert.Equal(t, "_9lives", sanitizeMetricName("9lives"))
+	assert.Equal(t, "ns:metric", sanitizeMetricName("ns:metric"))
+}
+
+// метка пользователя le не должна спорить со служебной меткой гистограммы
+func TestPrometheusReservedLabels(t *testing.T) {
+	latency := metrics.Metric{ID: "latency", MType: metrics.HistogramMetric, Histogram: metrics.NewHistogram([]float64{1})}
+	latency.Histogram.Observe(0.5)
+	latency.Labels = metrics.Labels{"le": "user", "exported_le": "taken"}
+
+	var b strings.Builder
+	writePrometheus(&b, []Metric{latency})
+	assert.Equal(t, `# TYPE latency histogram
+latency_bucket{exported_exported_le="user",exported_le="taken",le="1"} 1
+latency_bucket{exported_exported_le="user",exported_le="taken",le="+Inf"} 1
+latency_sum{exported_exported_le="user",exported_le="taken"} 0.5
+latency_count{exported_exported_le="user",exported_le="taken"} 1
+`, b.String())
+	assert.Equal(t, metrics.Labels{"le": "user", "exported_le": "taken"}, latency.Labels)
+}
+
+// разные метрики с одним именем в Prometheus: выводится только первая
+func TestPrometheusNameCollisions(t *testing.T) {
+	dotted := metrics.NewMetric("a.b", metrics.GaugeMetric)
+	*dotted.Value = 1
+	underscored := metrics.NewMetric("a_b", metrics.GaugeMetric)
+	*underscored.Value = 2
+
+	rt := metrics.Metric{ID: "rt", MType: metrics.SummaryMetric, Summary: metrics.NewSummary([]float64{0.5})}
+	rt.Summary.Observe(1)
+	rtSum := metrics.NewMetric("rt_sum", metrics.GaugeMetric)
+	*rtSum.Value = 3
+
+	var b strings.Builder
+	writePrometheus(&b, []Metric{dotted, underscored, rt, rtSum})
+	assert.Equal(t, `# TYPE a_b gauge
+a_b 1
+# TYPE rt summary
+rt{quantile="0.5"} 1
+rt_sum 1
+rt_count 1
+`, b.String())
+}
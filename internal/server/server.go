@@ -1,43 +1,123 @@
 package server
 
 import (
+	"context"
+	"errors"
+	"net"
 	"net/http"
+	"prayago-metricsalert/internal/alerts"
+	"prayago-metricsalert/internal/encryption"
 	"prayago-metricsalert/internal/logger"
 	"prayago-metricsalert/internal/storage"
 )
 
 type Server struct {
-	config  ServerConfig
-	storage storage.Storage
+	config     ServerConfig
+	storage    storage.Storage
+	alerts     *alerts.Engine
+	httpServer *http.Server
 }
 
 func NewServer(config ServerConfig) Server {
 	logger.LogSugar.Infoln("Creating server")
-
 	storageConfig := storage.StorageConfig{
+		DSN:                config.StorageDSN,
 		FPath:              config.StorageFPath,
+		SnapshotKeep:       config.SnapshotKeep,
+		WAL:                config.WAL,
 		StoreInterval:      config.StoreInterval,
 		ShouldRestore:      config.RestoreStorageOnStart,
 		DBConnectionString: config.DBConnectionString,
+		DBPrimary:          config.DBPrimary,
+		HistorySize:        config.HistorySize,
 	}
 	storage := storage.NewStorage(storageConfig)
+
+	alertsConfig := alerts.EngineConfig{
+		RulesFPath:       config.AlertRulesFPath,
+		EvaluateInterval: config.AlertInterval,
+		Webhook: alerts.WebhookConfig{
+			URLs:        config.AlertWebhooks,
+			RetryCount:  3,
+			StopTimeout: config.ShutdownTimeout,
+		},
+	}
+	alertEngine, err := alerts.NewEngine(alertsConfig, storage)
+	if err != nil {
+		logger.LogSugar.Fatalf("Ошибка загрузки правил алертов: %v", err)
+	}
+
+	routerOptions := RouterOptions{Key: config.Key}
+	if config.CryptoKey != "" {
+		privateKey, err := encryption.LoadPrivateKey(config.CryptoKey)
+		if err != nil {
+			logger.LogSugar.Fatalf("Ошибка чтения ключа %s: %v", config.CryptoKey, err)
+		}
+		routerOptions.PrivateKey = privateKey
+	}
+
 	server := Server{
 		config,
 		storage,
+		alertEngine,
+		&http.Server{
+			Addr:    config.ServerAddress,
+			Handler: GetRouter(storage, alertEngine, routerOptions),
+		},
 	}
 
 	logger.LogSugar.Infoln("Server created")
-
 	return server
 }
 
 func (srv Server) StartServer() error {
-	logger.LogSugar.Infoln("Starting server")
-	return http.ListenAndServe(srv.config.ServerAddress, GetRouter(srv.storage))
+	listener, err := net.Listen("tcp", srv.config.ServerAddress)
+	if err != nil {
+		return err
+	}
+
+	return srv.Serve(listener)
 }
 
-func (srv Server) Stop() {
+// Serve отдает nil, если сервер остановлен через Shutdown
+func (srv Server) Serve(listener net.Listener) error {
+	logger.LogSugar.Infoln("Starting server on", listener.Addr())
+	srv.alerts.Start()
+
+	err := srv.httpServer.Serve(listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+
+	return err
+}
+
+// Shutdown перестает принимать запросы и ждет уже начатые, но не дольше ShutdownTimeout,
+// потом сохраняет снимок памяти и закрывает базу. Принятое до Shutdown обновление не теряется.
+func (srv Server) Shutdown(ctx context.Context) error {
 	logger.LogSugar.Infoln("Server stopping", srv.config)
-	srv.storage.SaveData()
+
+	// не дождавшиеся запросы могут успеть обновить хранилище уже после снимка,
+	// поэтому таймаут стоит держать больше самого долгого запроса
+	if srv.config.ShutdownTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, srv.config.ShutdownTimeout)
+		defer cancel()
+	}
+	httpErr := srv.httpServer.Shutdown(ctx)
+	if httpErr != nil {
+		logger.LogSugar.Errorln("Server stopped with unfinished requests:", httpErr)
+	}
+
+	// правила больше не проверяются, и закрытое хранилище не погасит алерты,
+	// а досылка вебхуков идет уже после снимка и не задерживает его
+	srv.alerts.Stop()
+	storageErr := srv.storage.Close()
+	if storageErr != nil {
+		logger.LogSugar.Errorln("Error closing storage:", storageErr)
+	}
+	srv.alerts.StopNotifier()
+
 	logger.LogSugar.Infoln("Server stopped")
+	return errors.Join(httpErr, storageErr)
 }
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"prayago-metricsalert/internal/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// каждое обновление, на которое сервер ответил 200, есть в снимке после Shutdown,
+// включая запрос, который еще читался, когда пришел сигнал
+func TestShutdownKeepsAcceptedUpdates(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "storage.json")
+	srv := NewServer(ServerConfig{
+		StorageFPath:          fpath,
+		StoreInterval:         time.Hour, // снимок только при остановке
+		RestoreStorageOnStart: true,
+		ShutdownTimeout:       5 * time.Second,
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(listener)
+	}()
+	url := "http://" + listener.Addr().String()
+
+	var accepted atomic.Int64
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				resp, err := http.Post(url+"/update/counter/PollCount/1", "text/plain", nil)
+				if err != nil {
+					return
+				}
+				resp.Body.Close()
+				if resp.StatusCode == http.StatusOK {
+					accepted.Add(1)
+				}
+			}
+		}()
+	}
+
+	// медленный клиент: заголовки и половина тела пришли до остановки
+	body := `{"id":"PollCount","type":"counter","delta":1000}`
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = fmt.Fprintf(conn, "POST /update/ HTTP/1.1\r\nHost: test\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n%s",
+		len(body), body[:10])
+	require.NoError(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- srv.Shutdown(context.Background())
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	_, err = conn.Write([]byte(body[10:]))
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	require.NoError(t, <-shutdown)
+	require.NoError(t, <-served)
+	wg.Wait()
+	require.NotZero(t, accepted.Load())
+
+	restored := storage.NewStorage(storage.StorageConfig{
+		FPath:         fpath,
+		ShouldRestore: true,
+	})
+	value, err := restored.GetMetricValue("PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, accepted.Load()+1000, value)
+}
+
+// зависший вебхук не мешает остановке: снимок пишется до досылки уведомлений,
+// а досылка ограничена ShutdownTimeout
+func TestShutdownWithHungWebhook(t *testing.T) {
+	release := make(chan struct{})
+	arrived := make(chan struct{}, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		arrived <- struct{}{}
+		<-release
+	}))
+	defer receiver.Close()
+	defer close(release)
+
+	dir := t.TempDir()
+	rulesPath := filepath.Join(dir, "rules.json")
+	require.NoError(t, os.WriteFile(rulesPath, []byte(`[{"name":"HighAlloc","metric":"Alloc","op":">","threshold":1}]`), 0666))
+	fpath := filepath.Join(dir, "storage.json")
+	srv := NewServer(ServerConfig{
+		StorageFPath:          fpath,
+		StoreInterval:         time.Hour,
+		RestoreStorageOnStart: true,
+		AlertRulesFPath:       rulesPath,
+		AlertInterval:         10 * time.Millisecond,
+		AlertWebhooks:         []string{receiver.URL},
+		ShutdownTimeout:       200 * time.Millisecond,
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(listener)
+	}()
+
+	resp, err := http.Post("http://"+listener.Addr().String()+"/update/gauge/Alloc/5", "text/plain", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	<-arrived
+
+	start := time.Now()
+	require.NoError(t, srv.Shutdown(context.Background()))
+	require.NoError(t, <-served)
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	restored := storage.NewStorage(storage.StorageConfig{FPath: fpath, ShouldRestore: true})
+	value, err := restored.GetMetricValue("Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, 5.0, value)
+}
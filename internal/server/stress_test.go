@@ -0,0 +1,93 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"prayago-metricsalert/internal/metrics"
+	"prayago-metricsalert/internal/storage"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// гонки тут ловит go test -race: хендлеры, сохранение по интервалу и журнал
+// работают с одним настоящим хранилищем одновременно
+func TestConcurrentUpdatesAndReads(t *testing.T) {
+	store := storage.NewStorage(storage.StorageConfig{
+		DSN:           "file://" + filepath.Join(t.TempDir(), "storage.json"),
+		StoreInterval: 10 * time.Millisecond,
+		HistorySize:   10,
+	})
+	// сохранение по интервалу должно остановиться раньше, чем удалится t.TempDir()
+	t.Cleanup(func() {
+		store.Close()
+	})
+	srv := httptest.NewServer(GetRouter(store, dummyAlerter{}, RouterOptions{}))
+	defer srv.Close()
+
+	const workers = 8
+	const iterations = 50
+
+	post := func(path string, body []byte) {
+		contentType := "application/json"
+		if body == nil {
+			contentType = "text/plain"
+		}
+		resp, err := http.Post(srv.URL+path, contentType, bytes.NewReader(body))
+		if !assert.NoError(t, err) {
+			return
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode, path)
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				post("/update/counter/PollCount/1", nil)
+				post(fmt.Sprintf("/update/gauge/Alloc/%d?labels=worker:w%d", i, w), nil)
+
+				delta := int64(1)
+				value := float64(i)
+				batch, _ := json.Marshal([]Metric{
+					{ID: "PollCount", MType: metrics.CounterMetric, Delta: &delta},
+					{ID: "RandomValue", MType: metrics.GaugeMetric, Value: &value},
+				})
+				post("/updates/", batch)
+
+				query, _ := json.Marshal(Metric{ID: "PollCount", MType: metrics.CounterMetric})
+				resp, err := http.Post(srv.URL+"/value/", "application/json", bytes.NewReader(query))
+				if assert.NoError(t, err) {
+					io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+				}
+
+				resp, err = http.Get(srv.URL + "/")
+				if assert.NoError(t, err) {
+					io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	// ни одно прибавление счетчика не потерялось
+	value, err := store.GetMetricValue("PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2*workers*iterations), value)
+	assert.Len(t, store.GetAllMetrics(metrics.Labels{"worker": "w0"}), 1)
+}
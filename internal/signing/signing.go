@@ -0,0 +1,29 @@
+// Package signing -- подпись тел запросов и ответов общим ключом агента и сервера:
+// HMAC-SHA256 несжатого тела в hex, в заголовке Header.
+package signing
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+const Header = "HashSHA256"
+
+func Sign(key []byte, body []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify сравнивает подпись за постоянное время, негодный hex -- неверная подпись
+func Verify(key []byte, body []byte, hash string) bool {
+	expected, err := hex.DecodeString(hash)
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
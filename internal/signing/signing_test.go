@@ -0,0 +1,22 @@
+package signing
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignVerify(t *testing.T) {
+	key := []byte("secret")
+	body := []byte(`{"id":"Alloc","type":"gauge","value":1.5}`)
+
+	hash := Sign(key, body)
+	// echo -n '{"id":"Alloc","type":"gauge","value":1.5}' | openssl dgst -sha256 -hmac secret
+	assert.Equal(t, "b3118cff0fb3d67339808392074eff855892d70721e9545269f5d82948d3becf", hash)
+	assert.True(t, Verify(key, body, hash))
+
+	assert.False(t, Verify([]byte("other"), body, hash))
+	assert.False(t, Verify(key, append(body, ' '), hash))
+	assert.False(t, Verify(key, body, "not hex"))
+	assert.False(t, Verify(key, body, ""))
+}
@@ -0,0 +1,113 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"prayago-metricsalert/internal/logger"
+	"prayago-metricsalert/internal/metrics"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Metric = metrics.Metric
+type Sample = metrics.Sample
+type Labels = metrics.Labels
+
+var (
+	ErrMetricNotFound  = errors.New("metric not found")
+	ErrHistoryDisabled = errors.New("metrics history is disabled")
+)
+
+// Backend -- место, где на самом деле лежат метрики.
+// Метрики ищутся по ключу серии, см. metrics.SeriesKey.
+// UpdateMetric и UpdateMetricValue сами сливают новое значение со старым:
+// gauge заменяется, counter прибавляется, histogram и summary объединяются.
+type Backend interface {
+	GetAllMetrics(filter Labels) []Metric
+	GetMetric(key string) (*Metric, error)
+	UpdateMetricValue(mType string, name string, labels Labels, value string) (*Metric, error)
+	UpdateMetric(metric Metric) (*Metric, error)
+	GetHistory(name string, labels Labels, from time.Time, to time.Time) ([]Sample, error)
+	SaveData()
+	Ping() bool
+	Close() error
+}
+
+// BatchUpdater -- бэкенд, который применяет пачку целиком или не применяет ничего.
+// Каждая метрика в пачке один раз, повторы уже слиты. Обновленные метрики -- в порядке пачки.
+// Без BatchUpdater строгая пачка применяется по одной метрике после пробной проверки.
+type BatchUpdater interface {
+	UpdateBatch(batch []Metric) ([]Metric, error)
+}
+
+// Restorer -- бэкенд, в который можно вернуть метрику из другого хранилища как есть.
+// RestoreMetric кладет метрику, только если ее еще нет, и не сливает значения:
+// два одновременных восстановления одной метрики не прибавят счетчик дважды.
+type Restorer interface {
+	RestoreMetric(metric Metric) (bool, error)
+}
+
+// Options -- настройки, общие для всех бэкендов, все остальное передается в DSN
+type Options struct {
+	StoreInterval time.Duration
+	ShouldRestore bool
+	HistorySize   int // 0 -- история не нужна
+}
+
+// Factory создает бэкенд по DSN вида scheme://...
+type Factory func(dsn string, opts Options) (Backend, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]Factory)
+)
+
+// Register регистрирует бэкенд для схемы DSN, обычно вызывается из init() пакета бэкенда,
+// так что стороннему бэкенду достаточно, чтобы его пакет был импортирован
+func Register(scheme string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if _, present := registry[scheme]; present {
+		panic(fmt.Sprintf("storage backend %s is already registered", scheme))
+	}
+	registry[scheme] = factory
+}
+
+func Schemes() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	schemes := make([]string, 0, len(registry))
+	for scheme := range registry {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+
+	return schemes
+}
+
+func Open(dsn string, opts Options) (Backend, error) {
+	scheme, _, found := strings.Cut(dsn, "://")
+	if !found {
+		return nil, fmt.Errorf("storage DSN %q has no scheme", dsn)
+	}
+
+	registryMu.RLock()
+	factory, present := registry[scheme]
+	registryMu.RUnlock()
+	if !present {
+		return nil, fmt.Errorf("unknown storage backend %q, known: %s", scheme, strings.Join(Schemes(), ", "))
+	}
+
+	logger.LogSugar.Infof("Opening storage backend %s", scheme)
+	return factory(dsn, opts)
+}
+
+// DSNPath отдает то, что после scheme://, для file:// и sqlite:// это путь к файлу
+func DSNPath(dsn string) string {
+	_, path, _ := strings.Cut(dsn, "://")
+	return path
+}
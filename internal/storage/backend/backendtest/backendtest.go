@@ -0,0 +1,256 @@
+// Package backendtest -- общие тесты, которые должен проходить любой бэкенд хранилища.
+// Бэкенд открывается через реестр по DSN, так что тест бэкенда сводится к
+//
+//	backendtest.Run(t, backendtest.Suite{DSN: func(t *testing.T) string { ... }})
+package backendtest
+
+import (
+	"testing"
+	"time"
+
+	"prayago-metricsalert/internal/metrics"
+	"prayago-metricsalert/internal/storage/backend"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type Suite struct {
+	// DSN отдает DSN пустого хранилища, для каждого теста свой
+	DSN func(t *testing.T) string
+	// Persistent -- переживают ли данные Close и повторное открытие по тому же DSN
+	Persistent bool
+}
+
+func Run(t *testing.T, suite Suite) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, open func(opts backend.Options) backend.Backend)
+	}{
+		{"GaugeAndCounter", testGaugeAndCounter},
+		{"Distribution", testDistribution},
+		{"Labels", testLabels},
+		{"NotFound", testNotFound},
+		{"Errors", testErrors},
+		{"History", testHistory},
+		{"Batch", testBatch},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dsn := suite.DSN(t)
+			tt.test(t, func(opts backend.Options) backend.Backend {
+				return open(t, dsn, opts)
+			})
+		})
+	}
+
+	if suite.Persistent {
+		t.Run("Reopen", func(t *testing.T) {
+			testReopen(t, suite.DSN(t))
+		})
+	}
+}
+
+func open(t *testing.T, dsn string, opts backend.Options) backend.Backend {
+	t.Helper()
+
+	b, err := backend.Open(dsn, opts)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		b.Close()
+	})
+
+	return b
+}
+
+func testGaugeAndCounter(t *testing.T, open func(opts backend.Options) backend.Backend) {
+	b := open(backend.Options{})
+	require.True(t, b.Ping())
+
+	metric, err := b.UpdateMetricValue(metrics.GaugeMetric, "Alloc", nil, "1.5")
+	require.NoError(t, err)
+	assert.Equal(t, 1.5, metric.GetValue())
+	_, err = b.UpdateMetricValue(metrics.GaugeMetric, "Alloc", nil, "2.5")
+	require.NoError(t, err)
+
+	_, err = b.UpdateMetricValue(metrics.CounterMetric, "PollCount", nil, "2")
+	require.NoError(t, err)
+	delta := int64(3)
+	metric, err = b.UpdateMetric(metrics.Metric{ID: "PollCount", MType: metrics.CounterMetric, Delta: &delta})
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), metric.GetValue())
+
+	gauge, err := b.GetMetric("Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, metrics.GaugeMetric, gauge.MType)
+	assert.Equal(t, 2.5, gauge.GetValue())
+
+	counter, err := b.GetMetric("PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), counter.GetValue())
+}
+
+func testDistribution(t *testing.T, open func(opts backend.Options) backend.Backend) {
+	b := open(backend.Options{})
+
+	histogram := metrics.NewHistogram([]float64{0.1, 1})
+	histogram.Observe(0.05)
+	_, err := b.UpdateMetric(metrics.Metric{ID: "latency", MType: metrics.HistogramMetric, Histogram: histogram})
+	require.NoError(t, err)
+	_, err = b.UpdateMetricValue(metrics.HistogramMetric, "latency", nil, "5")
+	require.NoError(t, err)
+
+	metric, err := b.GetMetric("latency")
+	require.NoError(t, err)
+	require.NotNil(t, metric.Histogram)
+	assert.Equal(t, []uint64{1, 0, 1}, metric.Histogram.Counts)
+	assert.Equal(t, uint64(2), metric.Histogram.Count)
+
+	_, err = b.UpdateMetricValue(metrics.SummaryMetric, "rt", nil, "0.25")
+	require.NoError(t, err)
+	metric, err = b.GetMetric("rt")
+	require.NoError(t, err)
+	require.NotNil(t, metric.Summary)
+	assert.Equal(t, uint64(1), metric.Summary.Count)
+}
+
+func testLabels(t *testing.T, open func(opts backend.Options) backend.Backend) {
+	b := open(backend.Options{})
+	web1 := metrics.Labels{"host": "web1"}
+	web2 := metrics.Labels{"host": "web2"}
+
+	_, err := b.UpdateMetricValue(metrics.CounterMetric, "PollCount", web1, "2")
+	require.NoError(t, err)
+	_, err = b.UpdateMetricValue(metrics.CounterMetric, "PollCount", web2, "5")
+	require.NoError(t, err)
+	_, err = b.UpdateMetricValue(metrics.CounterMetric, "PollCount", web1, "1")
+	require.NoError(t, err)
+	_, err = b.UpdateMetricValue(metrics.GaugeMetric, "Alloc", web1, "1")
+	require.NoError(t, err)
+
+	metric, err := b.GetMetric(metrics.SeriesKey("PollCount", web1))
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), metric.GetValue())
+	assert.Equal(t, web1, metric.Labels)
+
+	_, err = b.GetMetric("PollCount")
+	assert.ErrorIs(t, err, backend.ErrMetricNotFound)
+
+	all := b.GetAllMetrics(nil)
+	keys := make([]string, 0, len(all))
+	for _, metric := range all {
+		keys = append(keys, metric.Key())
+	}
+	assert.Equal(t, []string{`Alloc{host="web1"}`, `PollCount{host="web1"}`, `PollCount{host="web2"}`}, keys)
+
+	filtered := b.GetAllMetrics(web2)
+	require.Len(t, filtered, 1)
+	assert.Equal(t, int64(5), filtered[0].GetValue())
+}
+
+func testNotFound(t *testing.T, open func(opts backend.Options) backend.Backend) {
+	b := open(backend.Options{})
+
+	_, err := b.GetMetric("Unknown")
+	assert.ErrorIs(t, err, backend.ErrMetricNotFound)
+	assert.Empty(t, b.GetAllMetrics(nil))
+}
+
+func testErrors(t *testing.T, open func(opts backend.Options) backend.Backend) {
+	b := open(backend.Options{})
+
+	_, err := b.UpdateMetricValue("unknown", "Alloc", nil, "1")
+	assert.Error(t, err)
+	_, err = b.UpdateMetricValue(metrics.GaugeMetric, "Alloc", nil, "abc")
+	assert.Error(t, err)
+	_, err = b.UpdateMetricValue(metrics.GaugeMetric, "Alloc", metrics.Labels{"bad-name": "x"}, "1")
+	assert.Error(t, err)
+	_, err = b.UpdateMetric(metrics.Metric{MType: metrics.GaugeMetric})
+	assert.Error(t, err)
+
+	// неудачное обновление не должно оставлять после себя метрику
+	_, err = b.GetMetric("Alloc")
+	assert.ErrorIs(t, err, backend.ErrMetricNotFound)
+}
+
+// testBatch -- только для бэкендов с BatchUpdater: пачка применяется вся или никак
+func testBatch(t *testing.T, open func(opts backend.Options) backend.Backend) {
+	b := open(backend.Options{})
+	updater, ok := b.(backend.BatchUpdater)
+	if !ok {
+		t.Skip("backend has no BatchUpdater")
+	}
+
+	delta := int64(2)
+	value := 1.5
+	counter := metrics.Metric{ID: "PollCount", MType: metrics.CounterMetric, Delta: &delta}
+	gauge := metrics.Metric{ID: "Alloc", MType: metrics.GaugeMetric, Value: &value, Labels: metrics.Labels{"host": "web1"}}
+	_, err := b.UpdateMetric(counter)
+	require.NoError(t, err)
+
+	updated, err := updater.UpdateBatch([]metrics.Metric{gauge, counter})
+	require.NoError(t, err)
+	require.Len(t, updated, 2)
+	assert.Equal(t, 1.5, updated[0].GetValue())
+	assert.Equal(t, int64(4), updated[1].GetValue())
+
+	// Alloc уже gauge: пачка отклонена целиком, счетчик не прибавился
+	wrongType := metrics.Metric{ID: "Alloc", MType: metrics.CounterMetric, Delta: &delta, Labels: metrics.Labels{"host": "web1"}}
+	_, err = updater.UpdateBatch([]metrics.Metric{counter, wrongType})
+	assert.Error(t, err)
+
+	stored, err := b.GetMetric("PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), stored.GetValue())
+}
+
+func testHistory(t *testing.T, open func(opts backend.Options) backend.Backend) {
+	b := open(backend.Options{HistorySize: 10})
+	start := time.Now().Add(-time.Second)
+
+	_, err := b.UpdateMetricValue(metrics.CounterMetric, "PollCount", nil, "2")
+	require.NoError(t, err)
+	_, err = b.UpdateMetricValue(metrics.CounterMetric, "PollCount", nil, "3")
+	require.NoError(t, err)
+
+	samples, err := b.GetHistory("PollCount", nil, time.Time{}, time.Time{})
+	require.NoError(t, err)
+	require.Len(t, samples, 2)
+	assert.Equal(t, int64(2), *samples[0].Delta)
+	assert.Equal(t, int64(5), *samples[1].Delta)
+
+	samples, err = b.GetHistory("PollCount", nil, start, time.Now().Add(time.Second))
+	require.NoError(t, err)
+	assert.Len(t, samples, 2)
+
+	samples, err = b.GetHistory("PollCount", nil, time.Now().Add(time.Hour), time.Time{})
+	require.NoError(t, err)
+	assert.Empty(t, samples)
+
+	_, err = b.GetHistory("Unknown", nil, time.Time{}, time.Time{})
+	assert.Error(t, err)
+
+	disabled := open(backend.Options{})
+	_, err = disabled.GetHistory("PollCount", nil, time.Time{}, time.Time{})
+	assert.ErrorIs(t, err, backend.ErrHistoryDisabled)
+}
+
+func testReopen(t *testing.T, dsn string) {
+	b, err := backend.Open(dsn, backend.Options{ShouldRestore: true})
+	require.NoError(t, err)
+	_, err = b.UpdateMetricValue(metrics.CounterMetric, "PollCount", nil, "2")
+	require.NoError(t, err)
+	_, err = b.UpdateMetricValue(metrics.GaugeMetric, "Alloc", metrics.Labels{"host": "web1"}, "1.5")
+	require.NoError(t, err)
+	require.NoError(t, b.Close())
+
+	b = open(t, dsn, backend.Options{ShouldRestore: true})
+	metric, err := b.GetMetric("PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), metric.GetValue())
+
+	metric, err = b.GetMetric(`Alloc{host="web1"}`)
+	require.NoError(t, err)
+	assert.Equal(t, 1.5, metric.GetValue())
+}
@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+
+	"prayago-metricsalert/internal/storage/backend"
+)
+
+// ErrBatchRejected -- элемент годный, но строгая пачка отклонена из-за других элементов
+var ErrBatchRejected = errors.New("batch rejected: another item is invalid")
+
+// BatchResult -- итог обновления одной метрики пачки, results[i] относится к batch[i].
+// Повторы одной метрики в пачке сливаются в одно обновление, и у всех повторов
+// один и тот же итог: значение метрики после всей пачки.
+type BatchResult struct {
+	Metric *Metric
+	Err    error
+}
+
+// mergedMetric -- метрика, слитая из всех ее повторов в пачке
+type mergedMetric struct {
+	metric  Metric
+	indices []int // какие элементы пачки в нее вошли
+}
+
+// mergeBatch сливает повторы: counter складывается, gauge берется последний,
+// histogram и summary объединяются. Ошибки отдельных элементов пишутся в results,
+// остальная пачка от них не страдает.
+func mergeBatch(batch []Metric, results []BatchResult) []*mergedMetric {
+	var merged []*mergedMetric
+	byKey := make(map[string]*mergedMetric, len(batch))
+	for i, metric := range batch {
+		if err := metric.Validate(); err != nil {
+			results[i].Err = err
+			continue
+		}
+
+		current, present := byKey[metric.Key()]
+		if !present {
+			current = &mergedMetric{metric: metric.Clone()}
+			byKey[metric.Key()] = current
+			merged = append(merged, current)
+		} else {
+			if current.metric.MType != metric.MType {
+				results[i].Err = fmt.Errorf("metric %s is both %s and %s in one batch",
+					metric.Key(), current.metric.MType, metric.MType)
+				continue
+			}
+			if err := current.metric.UpdateValueNum(metric.GetValue()); err != nil {
+				results[i].Err = err
+				continue
+			}
+		}
+		current.indices = append(current.indices, i)
+	}
+
+	return merged
+}
+
+func (m *mergedMetric) setErr(err error, results []BatchResult) {
+	if err == nil {
+		return
+	}
+	for _, i := range m.indices {
+		results[i].Err = err
+	}
+}
+
+// checkUpdate -- пробное обновление копии текущей метрики, хранилище не меняется.
+// Между проверкой и обновлением метрику может изменить другой запрос,
+// но тип и бакеты у существующей метрики не меняются, так что проверка остается верной.
+func (st Storage) checkUpdate(metric Metric) error {
+	current, err := st.backend.GetMetric(metric.Key())
+	if errors.Is(err, backend.ErrMetricNotFound) {
+		empty := metric.Empty()
+		current, err = &empty, nil
+	}
+	if err != nil {
+		return err
+	}
+	if current.MType != metric.MType {
+		return fmt.Errorf("metric %s is %s, not %s", metric.Key(), current.MType, metric.MType)
+	}
+
+	return current.UpdateValueNum(metric.GetValue())
+}
+
+// rejectBatch отклоняет всю пачку, если хоть один элемент с ошибкой
+func rejectBatch(results []BatchResult) bool {
+	rejected := false
+	for _, result := range results {
+		if result.Err != nil {
+			rejected = true
+			break
+		}
+	}
+	if !rejected {
+		return false
+	}
+
+	for i := range results {
+		if results[i].Err == nil {
+			results[i].Err = ErrBatchRejected
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+
+	"prayago-metricsalert/internal/metrics"
+	"prayago-metricsalert/internal/storage/backend"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func gauge(name string, value float64) Metric {
+	return Metric{ID: name, MType: metrics.GaugeMetric, Value: &value}
+}
+
+func TestUpdateBatchMergesDuplicates(t *testing.T) {
+	dbstore := &dummyDB{metrics: map[string]Metric{}}
+	storage := newTestStorage(t, dbstore, false)
+
+	batch := []Metric{
+		counter("PollCount", 1, nil),
+		gauge("Alloc", 1),
+		counter("PollCount", 2, nil),
+		gauge("Alloc", 2),
+		counter("PollCount", 3, Labels{"host": "web1"}),
+	}
+	results, err := storage.UpdateBatch(batch, false)
+	require.NoError(t, err)
+	require.Len(t, results, len(batch))
+
+	// у всех повторов один итог: значение после всей пачки
+	for _, i := range []int{0, 2} {
+		require.NoError(t, results[i].Err)
+		assert.Equal(t, int64(3), results[i].Metric.GetValue())
+	}
+	for _, i := range []int{1, 3} {
+		require.NoError(t, results[i].Err)
+		assert.Equal(t, 2.0, results[i].Metric.GetValue())
+	}
+
+	// счетчик прибавлен ровно один раз
+	value, err := storage.GetMetricValue("PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), value)
+
+	// в базу пачка ушла одним вызовом и без повторов
+	require.Len(t, dbstore.batches, 1)
+	assert.Len(t, dbstore.batches[0], 3)
+	assert.Equal(t, int64(3), *dbstore.metrics["PollCount"].Delta)
+}
+
+func TestUpdateBatchItemErrors(t *testing.T) {
+	dbstore := &dummyDB{metrics: map[string]Metric{}}
+	storage := newTestStorage(t, dbstore, false)
+
+	batch := []Metric{
+		counter("PollCount", 1, nil),
+		{ID: "Alloc", MType: metrics.GaugeMetric},
+		gauge("PollCount", 1),
+		{ID: "Unknown", MType: "unknown"},
+	}
+	results, err := storage.UpdateBatch(batch, false)
+	require.NoError(t, err)
+
+	require.NoError(t, results[0].Err)
+	assert.Equal(t, int64(1), results[0].Metric.GetValue())
+	for _, result := range results[1:] {
+		assert.Error(t, result.Err)
+		assert.Nil(t, result.Metric)
+	}
+
+	// ошибочные элементы не мешают остальной пачке
+	assert.Len(t, storage.GetAllMetrics(nil), 1)
+	require.Len(t, dbstore.batches, 1)
+	assert.Len(t, dbstore.batches[0], 1)
+}
+
+func TestUpdateBatchStrict(t *testing.T) {
+	dbstore := &dummyDB{metrics: map[string]Metric{}}
+	storage := newTestStorage(t, dbstore, false)
+	_, err := storage.UpdateMetric(counter("PollCount", 1, nil))
+	require.NoError(t, err)
+
+	// сама по себе метрика верная, но в хранилище PollCount -- counter
+	batch := []Metric{
+		gauge("Alloc", 1),
+		gauge("PollCount", 1),
+	}
+	results, err := storage.UpdateBatch(batch, true)
+	require.NoError(t, err)
+	assert.ErrorIs(t, results[0].Err, ErrBatchRejected)
+	assert.Error(t, results[1].Err)
+	assert.NotErrorIs(t, results[1].Err, ErrBatchRejected)
+
+	_, err = storage.GetMetric("Alloc")
+	assert.Error(t, err)
+	assert.Empty(t, dbstore.batches)
+
+	results, err = storage.UpdateBatch(batch[:1], true)
+	require.NoError(t, err)
+	require.NoError(t, results[0].Err)
+	assert.Len(t, dbstore.batches, 1)
+}
+
+// копия в базу не удалась, но память уже обновлена -- пачка считается примененной
+func TestUpdateBatchDBCopyFails(t *testing.T) {
+	dbstore := &dummyDB{metrics: map[string]Metric{}, err: errors.New("connection refused")}
+	storage := newTestStorage(t, dbstore, false)
+
+	for _, strict := range []bool{false, true} {
+		results, err := storage.UpdateBatch([]Metric{counter("PollCount", 1, nil)}, strict)
+		require.NoError(t, err)
+		require.NoError(t, results[0].Err)
+	}
+
+	value, err := storage.GetMetricValue("PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), value)
+}
+
+// countingBackend считает обращения к бэкенду: у SQL бэкенда каждое -- отдельная транзакция
+type countingBackend struct {
+	backend.Backend
+	updates  int
+	batches  int
+	batchErr error
+}
+
+func (b *countingBackend) UpdateMetric(metric Metric) (*Metric, error) {
+	b.updates++
+	return b.Backend.UpdateMetric(metric)
+}
+
+func (b *countingBackend) UpdateBatch(batch []Metric) ([]Metric, error) {
+	b.batches++
+	if b.batchErr != nil {
+		return nil, b.batchErr
+	}
+	return b.Backend.(backend.BatchUpdater).UpdateBatch(batch)
+}
+
+// нестрогая пачка уходит в бэкенд одной транзакцией, негодные элементы в нее не попадают
+func TestUpdateBatchOneTransaction(t *testing.T) {
+	storage := newTestStorage(t, &dummyDB{metrics: map[string]Metric{}}, false)
+	counting := &countingBackend{Backend: storage.backend}
+	storage.backend = counting
+
+	batch := []Metric{
+		counter("PollCount", 1, nil),
+		gauge("Alloc", 1),
+		gauge("PollCount", 1),
+		counter("PollCount", 2, nil),
+	}
+	results, err := storage.UpdateBatch(batch, false)
+	require.NoError(t, err)
+	assert.Equal(t, 1, counting.batches)
+	assert.Zero(t, counting.updates)
+	require.NoError(t, results[0].Err)
+	assert.Equal(t, int64(3), results[0].Metric.GetValue())
+	require.NoError(t, results[1].Err)
+	assert.Error(t, results[2].Err)
+
+	// пачка не прошла -- обновляем по одной метрике
+	counting.batchErr = errors.New("deadlock detected")
+	results, err = storage.UpdateBatch(batch[:2], false)
+	require.NoError(t, err)
+	assert.Equal(t, 2, counting.batches)
+	assert.Equal(t, 2, counting.updates)
+	require.NoError(t, results[0].Err)
+	assert.Equal(t, int64(4), results[0].Metric.GetValue())
+}
@@ -3,9 +3,12 @@ package db
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"prayago-metricsalert/internal/logger"
 	"prayago-metricsalert/internal/metrics"
+	"prayago-metricsalert/internal/storage/backend"
 	"strings"
 	"time"
 
@@ -13,9 +16,11 @@ import (
 )
 
 type Metric = metrics.Metric
+type Sample = metrics.Sample
 
 type DBStorageConfig struct {
 	ConnectionString string
+	History          bool // писать ли каждое обновление в metric_samples
 }
 
 type DBStorage struct {
@@ -25,8 +30,12 @@ type DBStorage struct {
 
 type DBStorager interface {
 	Ping() bool
+	GetAllMetrics() ([]Metric, error)
+	GetMetric(name string, labels metrics.Labels) (*Metric, error)
 	UpdateMetric(metric Metric)
 	UpdateBatch(metrics []Metric) error
+	GetHistory(name string, labels metrics.Labels, from time.Time, to time.Time) ([]Sample, error)
+	Close() error
 }
 
 func NewDBStorage(config DBStorageConfig) DBStorage {
@@ -37,7 +46,9 @@ func NewDBStorage(config DBStorageConfig) DBStorage {
 		logger.LogSugar.Errorf("Ошибка подключения к БД: %v\r\n", err)
 	}
 
-	createMetricsTable(db)
+	if err := migrate(db); err != nil {
+		logger.LogSugar.Errorf("Ошибка миграции БД: %v", err)
+	}
 
 	dbstorage := DBStorage{
 		config,
@@ -47,8 +58,8 @@ func NewDBStorage(config DBStorageConfig) DBStorage {
 	return dbstorage
 }
 
-func (dbs DBStorage) Close() {
-	dbs.db.Close()
+func (dbs DBStorage) Close() error {
+	return dbs.db.Close()
 }
 
 func (dbs DBStorage) Ping() bool {
@@ -62,145 +73,267 @@ func (dbs DBStorage) Ping() bool {
 	return true
 }
 
-func (dbs DBStorage) UpdateMetric(metric Metric) {
-	logger.LogSugar.Infoln("UpdateMetric: metric=", metric)
+func (dbs DBStorage) GetAllMetrics() ([]Metric, error) {
+	rows, err := dbs.db.Query(selectMetricsQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-	var result sql.Result
-	var err error
-	if metric.ISGauge() {
-		result, err = doUpdateGauge(dbs.db, metric)
-	} else {
-		result, err = doUpdateCounter(dbs.db, metric)
+	var all []Metric
+	for rows.Next() {
+		metric, err := scanMetric(rows)
+		if err != nil {
+			return nil, err
+		}
+		if hasValue(metric) {
+			all = append(all, metric)
+		}
 	}
 
+	return all, rows.Err()
+}
+
+func (dbs DBStorage) GetMetric(name string, labels metrics.Labels) (*Metric, error) {
+	return selectMetric(dbs.db, name, labels)
+}
+
+func selectMetric(db *sql.DB, name string, labels metrics.Labels) (*Metric, error) {
+	metric, err := scanMetric(db.QueryRow(
+		selectMetricsQuery+"WHERE name = $1 AND labels = $2",
+		name, labelsJSON(labels),
+	))
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !hasValue(metric)) {
+		return nil, backend.ErrMetricNotFound
+	}
 	if err != nil {
+		return nil, err
+	}
+
+	return &metric, nil
+}
+
+func (dbs DBStorage) UpdateMetric(metric Metric) {
+	logger.LogSugar.Infoln("UpdateMetric: metric=", metric)
+
+	if err := dbs.UpdateBatch([]Metric{metric}); err != nil {
 		logger.LogSugar.Errorln("UpdateMetric: err=", err)
-	} else {
-		logger.LogSugar.Infoln("UpdateMetric: result=", result)
 	}
 }
 
-var updateGaugeMetricQuery = `
-INSERT INTO metrics (name, type, gauge)
-VALUES ($1, $2, $3)
-ON CONFLICT(name)
-DO UPDATE SET
-  type = EXCLUDED.type,
-  gauge = EXCLUDED.gauge;
-`
+// execer -- то общее, что есть у *sql.DB и *sql.Tx
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
 
-func doUpdateGauge(db *sql.DB, metric Metric) (sql.Result, error) {
-	return db.Exec(
-		updateGaugeMetricQuery,
-		metric.ID, metric.MType, metric.GetValueField(),
-	)
+type querier interface {
+	Query(query string, args ...any) (*sql.Rows, error)
 }
 
-var updateCounterMetricQuery = `
-INSERT INTO metrics (name, type, counter)
-VALUES ($1, $2, $3)
-ON CONFLICT(name)
-DO UPDATE SET
-  type = EXCLUDED.type,
-  counter = EXCLUDED.counter;
+// метки храним JSON'ом: json.Marshal сортирует ключи, поэтому строка однозначна
+// и годится в первичный ключ
+func labelsJSON(labels metrics.Labels) string {
+	if len(labels) == 0 {
+		return "{}"
+	}
+
+	data, _ := json.Marshal(labels)
+	return string(data)
+}
+
+var selectSamplesQuery = `
+SELECT ts, type, gauge, counter
+FROM metric_samples
+WHERE name = $1 AND labels = $2 AND ts >= $3 AND ts <= $4
+ORDER BY ts, id;
 `
 
-func doUpdateCounter(db *sql.DB, metric Metric) (sql.Result, error) {
-	return db.Exec(
-		updateCounterMetricQuery,
-		metric.ID, metric.MType, metric.GetDeltaField(),
-	)
+// GetHistory отдает значения метрики из интервала [from, to], нулевое время -- без ограничения
+func (dbs DBStorage) GetHistory(name string, labels metrics.Labels, from time.Time, to time.Time) ([]Sample, error) {
+	return querySamples(dbs.db, name, labels, from, to)
+}
+
+func querySamples(db querier, name string, labels metrics.Labels, from time.Time, to time.Time) ([]Sample, error) {
+	if to.IsZero() {
+		to = time.Now()
+	}
+
+	rows, err := db.Query(selectSamplesQuery, name, labelsJSON(labels), from.UTC(), to.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	samples := make([]Sample, 0)
+	for rows.Next() {
+		var sample Sample
+		var mType string
+		var gauge sql.NullFloat64
+		var counter sql.NullInt64
+		if err := rows.Scan(&sample.Timestamp, &mType, &gauge, &counter); err != nil {
+			return nil, err
+		}
+		// для histogram и summary в gauge лежит сумма, а в counter -- количество наблюдений
+		isDistribution := mType == metrics.HistogramMetric || mType == metrics.SummaryMetric
+		if gauge.Valid {
+			if isDistribution {
+				sample.Sum = &gauge.Float64
+			} else {
+				sample.Value = &gauge.Float64
+			}
+		}
+		if counter.Valid {
+			if isDistribution {
+				count := uint64(counter.Int64)
+				sample.Count = &count
+			} else {
+				sample.Delta = &counter.Int64
+			}
+		}
+		samples = append(samples, sample)
+	}
+
+	return samples, rows.Err()
 }
 
-func (dbs DBStorage) UpdateBatch(metrics []Metric) error {
-	// logger.LogSugar.Infoln("UpdateBatch: metrics=", metrics)
-	return BulkInsert(dbs.db, metrics)
+func distributionJSON(metric Metric) (string, error) {
+	var data []byte
+	var err error
+	if metric.MType == metrics.HistogramMetric {
+		data, err = json.Marshal(metric.Histogram)
+	} else {
+		data, err = json.Marshal(metric.Summary)
+	}
+
+	return string(data), err
 }
 
-func BulkInsert(db *sql.DB, metrics []Metric) error {
-	tx, err := db.Begin()
+// UpdateBatch пишет значения метрик, уже слитые с прежними, поэтому просто заменяет строки.
+// Одна и та же метрика дважды в одном INSERT ... ON CONFLICT postgres не дает обновить,
+// так что из повторов берем последнее значение.
+func (dbs DBStorage) UpdateBatch(batch []Metric) error {
+	batch = lastByKey(batch)
+	if len(batch) == 0 {
+		return nil
+	}
+
+	tx, err := dbs.db.Begin()
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	for _, metric := range metrics {
-		var query string
-		var queryArgs []interface{}
-
-		if metric.ISGauge() {
-			query = updateGaugeMetricQuery
-			queryArgs = append(queryArgs, metric.ID)
-			queryArgs = append(queryArgs, metric.MType)
-			queryArgs = append(queryArgs, metric.GetValueField())
-		} else {
-			query = updateCounterMetricQuery
-			queryArgs = append(queryArgs, metric.ID)
-			queryArgs = append(queryArgs, metric.MType)
-			queryArgs = append(queryArgs, metric.GetDeltaField())
+	if err := upsertMetrics(tx, batch); err != nil {
+		return err
+	}
+	if dbs.config.History {
+		if err := insertSamples(tx, batch); err != nil {
+			return err
 		}
+	}
 
-		_, err := tx.ExecContext(context.TODO(), query, queryArgs...)
+	return tx.Commit()
+}
 
-		if err != nil {
-			tx.Rollback()
-			return err
+func lastByKey(batch []Metric) []Metric {
+	positions := make(map[string]int, len(batch))
+	unique := make([]Metric, 0, len(batch))
+	for _, metric := range batch {
+		if i, present := positions[metric.Key()]; present {
+			unique[i] = metric
+			continue
 		}
+		positions[metric.Key()] = len(unique)
+		unique = append(unique, metric)
 	}
 
-	return tx.Commit()
+	return unique
 }
 
-// А счастье было так возможно, пока не запустил тесты.
-// Постгря не дает модифицировать запис дважды(второе срабатывае ON CONFLICT порождает ошибку)
-// Оставлю пока на память этот код, много времени на него потратил
-func _BulkInsert(db *sql.DB, metrics []Metric) error {
-	var colCount = 4
-	valueStrings := make([]string, 0, len(metrics))
-	valueArgs := make([]interface{}, 0, len(metrics)*colCount)
-
-	// формируем VALUES($n, $n+1, $n+2, etc)
-	// и кладем значения соответстующих параметров в valueArgs
-	// для дальнейшего использования в db.Exec
-	i := 0
-	for _, metric := range metrics {
-		valueStr := "("
-		for j := 1; j <= colCount; j++ {
-			valueStr = valueStr + fmt.Sprintf("$%d", i*colCount+j)
-			if j < colCount {
-				valueStr += ", "
+// placeholders собирает ($1, $2, $3), ($4, $5, $6), ... для rows строк по cols значений
+func placeholders(rows int, cols int) string {
+	var sb strings.Builder
+	for i := 0; i < rows; i++ {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString("(")
+		for j := 1; j <= cols; j++ {
+			if j > 1 {
+				sb.WriteString(", ")
 			}
+			fmt.Fprintf(&sb, "$%d", i*cols+j)
 		}
-		valueStr = valueStr + ")"
-		valueStrings = append(valueStrings, valueStr)
+		sb.WriteString(")")
+	}
+
+	return sb.String()
+}
 
-		appendMetricFields(&valueArgs, metric)
-		i++
+func upsertMetrics(db execer, batch []Metric) error {
+	const colCount = 6
+	args := make([]any, 0, len(batch)*colCount)
+	for _, metric := range batch {
+		var distribution *string
+		if metric.IsDistribution() {
+			value, err := distributionJSON(metric)
+			if err != nil {
+				return err
+			}
+			distribution = &value
+		}
+		args = append(args,
+			metric.ID, labelsJSON(metric.Labels), metric.MType, metric.Value, metric.Delta, distribution,
+		)
 	}
-	// logger.LogSugar.Infoln("BulkInsert: valueStrings=", strings.Join(valueStrings, ","))
-	// logger.LogSugar.Infoln("BulkInsert: valueArgs=", valueArgs)
-	query := fmt.Sprintf(
-		"INSERT INTO metrics (name, type, gauge, counter) VALUES %s %s",
-		strings.Join(valueStrings, ","),
-		"ON CONFLICT(name) DO UPDATE SET type = EXCLUDED.type, gauge = EXCLUDED.gauge, counter = EXCLUDED.counter;",
-	)
-	// logger.LogSugar.Infoln("BulkInsert: query=", query)
 
-	result, err := db.Exec(query, valueArgs...)
-	if err != nil {
-		logger.LogSugar.Errorln("UpdateMetric: err=", err)
-	} else {
-		logger.LogSugar.Infoln("UpdateMetric: result=", result)
+	query := fmt.Sprintf(`
+INSERT INTO metrics (name, labels, type, gauge, counter, distribution)
+VALUES %s
+ON CONFLICT(name, labels)
+DO UPDATE SET
+  type = EXCLUDED.type,
+  gauge = EXCLUDED.gauge,
+  counter = EXCLUDED.counter,
+  distribution = EXCLUDED.distribution;
+`, placeholders(len(batch), colCount))
+
+	_, err := db.Exec(query, args...)
+	return err
+}
+
+// время пишем сами и в UTC: у sqlite нет своего типа для времени,
+// и сравнение ts в GetHistory там строковое
+func insertSamples(db execer, batch []Metric) error {
+	const colCount = 6
+	ts := time.Now().UTC()
+	args := make([]any, 0, len(batch)*colCount)
+	for _, metric := range batch {
+		appendMetricFields(&args, metric)
+		args = append(args, labelsJSON(metric.Labels), ts)
 	}
 
+	query := fmt.Sprintf(
+		"INSERT INTO metric_samples (name, type, gauge, counter, labels, ts) VALUES %s;",
+		placeholders(len(batch), colCount),
+	)
+
+	_, err := db.Exec(query, args...)
 	return err
 }
 
+// для histogram и summary в истории только сумма и количество наблюдений
 func appendMetricFields(args *[]interface{}, metric Metric) {
 	*args = append(*args, metric.ID)
 	*args = append(*args, metric.MType)
-	if metric.ISGauge() {
+	switch {
+	case metric.ISGauge():
 		*args = append(*args, metric.GetValueField(), nil)
-	} else {
+	case metric.Histogram != nil:
+		*args = append(*args, metric.Histogram.Sum, int64(metric.Histogram.Count))
+	case metric.Summary != nil:
+		*args = append(*args, metric.Summary.Sum, int64(metric.Summary.Count))
+	default:
 		*args = append(*args, nil, metric.GetDeltaField())
 	}
 }
@@ -1,18 +1,41 @@
 package db
 
+import (
+	"errors"
+	"prayago-metricsalert/internal/metrics"
+	"prayago-metricsalert/internal/storage/backend"
+	"time"
+)
+
 type DummyDB struct{}
 
 func NewDummyDB() DummyDB {
 	return DummyDB{}
 }
 
+func (db DummyDB) Close() error {
+	return nil
+}
+
 func (db DummyDB) Ping() bool {
 	return false
 }
 
+func (db DummyDB) GetAllMetrics() ([]Metric, error) {
+	return nil, nil
+}
+
+func (db DummyDB) GetMetric(name string, labels metrics.Labels) (*Metric, error) {
+	return nil, backend.ErrMetricNotFound
+}
+
 func (db DummyDB) UpdateMetric(metric Metric) {
 }
 
 func (db DummyDB) UpdateBatch(metrics []Metric) error {
 	return nil
 }
+
+func (db DummyDB) GetHistory(name string, labels metrics.Labels, from time.Time, to time.Time) ([]Sample, error) {
+	return nil, errors.New("no database connection")
+}
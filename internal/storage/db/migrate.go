@@ -0,0 +1,280 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"prayago-metricsalert/internal/logger"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// миграции лежат в migrations/ парами NNNN_name.up.sql и NNNN_name.down.sql,
+// номер задает порядок, примененные версии записываются в schema_migrations
+//
+//go:embed migrations/*.sql
+var migrationsFS embed.FS
+
+// ключ pg_advisory_lock, под которым мигрирует только одна реплика сервера
+const migrationsLockID = 7_352_001
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+type MigrationStatus struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+func loadMigrations(fsys fs.FS, dir string) ([]Migration, error) {
+	files, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, file := range files {
+		fname := file.Name()
+		base, found := strings.CutSuffix(fname, ".sql")
+		if !found || file.IsDir() {
+			continue
+		}
+
+		var direction string
+		switch {
+		case strings.HasSuffix(base, ".up"):
+			direction, base = "up", strings.TrimSuffix(base, ".up")
+		case strings.HasSuffix(base, ".down"):
+			direction, base = "down", strings.TrimSuffix(base, ".down")
+		default:
+			return nil, fmt.Errorf("migration %s: expected .up.sql or .down.sql", fname)
+		}
+
+		versionStr, name, found := strings.Cut(base, "_")
+		version, err := strconv.Atoi(versionStr)
+		if !found || err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s: expected NNNN_name prefix", fname)
+		}
+
+		data, err := fs.ReadFile(fsys, path.Join(dir, fname))
+		if err != nil {
+			return nil, err
+		}
+
+		migration, present := byVersion[version]
+		if !present {
+			migration = &Migration{Version: version, Name: name}
+			byVersion[version] = migration
+		} else if migration.Name != name {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, migration.Name, name)
+		}
+
+		if direction == "up" {
+			migration.Up = string(data)
+		} else {
+			migration.Down = string(data)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" || migration.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s: both up and down files are required", migration.Version, migration.Name)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// Migrations -- миграции, встроенные в бинарник
+func Migrations() ([]Migration, error) {
+	return loadMigrations(migrationsFS, "migrations")
+}
+
+type Migrator struct {
+	db         *sql.DB
+	migrations []Migration
+}
+
+func NewMigrator(db *sql.DB) (*Migrator, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{db: db, migrations: migrations}, nil
+}
+
+var createSchemaMigrationsQuery = `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+	version BIGINT PRIMARY KEY,
+	name TEXT NOT NULL,
+	applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+`
+
+// withLock выполняет f на отдельном соединении под advisory lock:
+// блокировка в postgres живет, пока живо соединение, так что пул тут не годится
+func (m *Migrator) withLock(ctx context.Context, f func(conn *sql.Conn) error) error {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationsLockID); err != nil {
+		return err
+	}
+	defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", migrationsLockID)
+
+	if _, err := conn.ExecContext(ctx, createSchemaMigrationsQuery); err != nil {
+		return err
+	}
+
+	return f(conn)
+}
+
+func appliedMigrations(ctx context.Context, conn *sql.Conn) (map[int]time.Time, error) {
+	rows, err := conn.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+
+	return applied, rows.Err()
+}
+
+// Up применяет все еще не примененные миграции по порядку, каждую в своей транзакции
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	var done []Migration
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range m.migrations {
+			if _, present := applied[migration.Version]; present {
+				continue
+			}
+
+			err := runInTx(ctx, conn, migration.Up,
+				"INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", migration.Version, migration.Name)
+			if err != nil {
+				return fmt.Errorf("migration %d_%s up: %w", migration.Version, migration.Name, err)
+			}
+			logger.LogSugar.Infof("Migration %d_%s applied", migration.Version, migration.Name)
+			done = append(done, migration)
+		}
+
+		return nil
+	})
+
+	return done, err
+}
+
+// Down откатывает steps последних примененных миграций
+func (m *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+	var done []Migration
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for i := len(m.migrations) - 1; i >= 0 && len(done) < steps; i-- {
+			migration := m.migrations[i]
+			if _, present := applied[migration.Version]; !present {
+				continue
+			}
+
+			err := runInTx(ctx, conn, migration.Down,
+				"DELETE FROM schema_migrations WHERE version = $1", migration.Version)
+			if err != nil {
+				return fmt.Errorf("migration %d_%s down: %w", migration.Version, migration.Name, err)
+			}
+			logger.LogSugar.Infof("Migration %d_%s reverted", migration.Version, migration.Name)
+			done = append(done, migration)
+		}
+
+		return nil
+	})
+
+	return done, err
+}
+
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	var statuses []MigrationStatus
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range m.migrations {
+			appliedAt, present := applied[migration.Version]
+			statuses = append(statuses, MigrationStatus{
+				Migration: migration,
+				Applied:   present,
+				AppliedAt: appliedAt,
+			})
+		}
+
+		return nil
+	})
+
+	return statuses, err
+}
+
+// runInTx выполняет SQL миграции и запись о ней в schema_migrations атомарно
+func runInTx(ctx context.Context, conn *sql.Conn, migrationSQL string, bookkeeping string, args ...any) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, migrationSQL); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, bookkeeping, args...); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// migrate доводит схему до последней версии при старте сервера
+func migrate(db *sql.DB) error {
+	migrator, err := NewMigrator(db)
+	if err != nil {
+		return err
+	}
+
+	_, err = migrator.Up(context.Background())
+	return err
+}
@@ -0,0 +1,87 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmbeddedMigrations(t *testing.T) {
+	migrations, err := Migrations()
+	require.NoError(t, err)
+	require.NotEmpty(t, migrations)
+
+	// номера идут подряд, без дыр: так проще заметить потерянный файл
+	for i, migration := range migrations {
+		assert.Equal(t, i+1, migration.Version)
+		assert.NotEmpty(t, migration.Name)
+	}
+}
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := loadMigrations(fstest.MapFS{
+		"m/0002_b.up.sql":   {Data: []byte("UP 2")},
+		"m/0002_b.down.sql": {Data: []byte("DOWN 2")},
+		"m/0001_a.up.sql":   {Data: []byte("UP 1")},
+		"m/0001_a.down.sql": {Data: []byte("DOWN 1")},
+		"m/README.md":       {Data: []byte("ignored")},
+	}, "m")
+	require.NoError(t, err)
+	assert.Equal(t, []Migration{
+		{Version: 1, Name: "a", Up: "UP 1", Down: "DOWN 1"},
+		{Version: 2, Name: "b", Up: "UP 2", Down: "DOWN 2"},
+	}, migrations)
+
+	_, err = loadMigrations(fstest.MapFS{"m/0001_a.up.sql": {Data: []byte("UP")}}, "m")
+	assert.Error(t, err, "down file is missing")
+
+	_, err = loadMigrations(fstest.MapFS{"m/a.up.sql": {Data: []byte("UP")}}, "m")
+	assert.Error(t, err, "no version")
+
+	_, err = loadMigrations(fstest.MapFS{"m/0001_a.sql": {Data: []byte("UP")}}, "m")
+	assert.Error(t, err, "no direction")
+}
+
+// см. TestPostgresBackend: нужна настоящая база в TEST_DATABASE_DSN
+func TestMigratorUpDown(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN is not set")
+	}
+
+	db, err := sql.Open("pgx", dsn)
+	require.NoError(t, err)
+	defer db.Close()
+	_, err = db.Exec("DROP TABLE IF EXISTS metrics, metric_samples, schema_migrations;")
+	require.NoError(t, err)
+
+	migrator, err := NewMigrator(db)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	done, err := migrator.Up(ctx)
+	require.NoError(t, err)
+	assert.Len(t, done, len(migrator.migrations))
+
+	done, err = migrator.Up(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, done)
+
+	done, err = migrator.Down(ctx, len(migrator.migrations))
+	require.NoError(t, err)
+	assert.Len(t, done, len(migrator.migrations))
+
+	statuses, err := migrator.Status(ctx)
+	require.NoError(t, err)
+	for _, status := range statuses {
+		assert.False(t, status.Applied)
+	}
+
+	_, err = migrator.Up(ctx)
+	require.NoError(t, err)
+}
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS metrics (
+    name VARCHAR(50) NOT NULL,
+    type VARCHAR(20) NOT NULL,
+    gauge DOUBLE PRECISION,
+    counter BIGINT,
+    PRIMARY KEY (name)
+);
@@ -0,0 +1,5 @@
+-- серии с метками без колонки labels не различить, их приходится удалить
+DELETE FROM metrics WHERE labels <> '{}';
+ALTER TABLE metrics DROP CONSTRAINT IF EXISTS metrics_pkey;
+ALTER TABLE metrics DROP COLUMN IF EXISTS labels;
+ALTER TABLE metrics ADD PRIMARY KEY (name);
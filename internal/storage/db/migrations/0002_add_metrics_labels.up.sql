@@ -0,0 +1,4 @@
+-- метрика определяется именем вместе с метками
+ALTER TABLE metrics ADD COLUMN IF NOT EXISTS labels TEXT NOT NULL DEFAULT '{}';
+ALTER TABLE metrics DROP CONSTRAINT IF EXISTS metrics_pkey;
+ALTER TABLE metrics ADD PRIMARY KEY (name, labels);
@@ -0,0 +1,2 @@
+DELETE FROM metrics WHERE type IN ('histogram', 'summary');
+ALTER TABLE metrics DROP COLUMN IF EXISTS distribution;
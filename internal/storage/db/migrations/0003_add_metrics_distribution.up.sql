@@ -0,0 +1,2 @@
+-- histogram и summary целиком в JSON
+ALTER TABLE metrics ADD COLUMN IF NOT EXISTS distribution TEXT;
@@ -0,0 +1,12 @@
+-- история значений: только дописываем, ничего не обновляем
+CREATE TABLE IF NOT EXISTS metric_samples (
+    id BIGSERIAL PRIMARY KEY,
+    name VARCHAR(50) NOT NULL,
+    labels TEXT NOT NULL DEFAULT '{}',
+    type VARCHAR(20) NOT NULL,
+    gauge DOUBLE PRECISION,
+    counter BIGINT,
+    ts TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+ALTER TABLE metric_samples ADD COLUMN IF NOT EXISTS labels TEXT NOT NULL DEFAULT '{}';
+CREATE INDEX IF NOT EXISTS metric_samples_name_ts_idx ON metric_samples (name, ts);
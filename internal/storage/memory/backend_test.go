@@ -0,0 +1,25 @@
+package memory
+
+import (
+	"path/filepath"
+	"testing"
+
+	"prayago-metricsalert/internal/storage/backend/backendtest"
+)
+
+func TestMemoryBackend(t *testing.T) {
+	backendtest.Run(t, backendtest.Suite{
+		DSN: func(t *testing.T) string {
+			return "memory://"
+		},
+	})
+}
+
+func TestFileBackend(t *testing.T) {
+	backendtest.Run(t, backendtest.Suite{
+		DSN: func(t *testing.T) string {
+			return "file://" + filepath.Join(t.TempDir(), "storage.json")
+		},
+		Persistent: true,
+	})
+}
@@ -0,0 +1,91 @@
+package memory
+
+import (
+	"sync"
+	"time"
+
+	"prayago-metricsalert/internal/metrics"
+)
+
+type Sample = metrics.Sample
+
+// ringBuffer хранит последние len(samples) значений метрики,
+// самое старое перезаписывается самым новым
+type ringBuffer struct {
+	samples []Sample
+	next    int
+	full    bool
+}
+
+func newRingBuffer(size int) *ringBuffer {
+	return &ringBuffer{samples: make([]Sample, size)}
+}
+
+func (rb *ringBuffer) push(sample Sample) {
+	rb.samples[rb.next] = sample
+	rb.next = (rb.next + 1) % len(rb.samples)
+	if rb.next == 0 {
+		rb.full = true
+	}
+}
+
+// ordered отдает значения от старых к новым
+func (rb *ringBuffer) ordered() []Sample {
+	if !rb.full {
+		return rb.samples[:rb.next]
+	}
+
+	ordered := make([]Sample, 0, len(rb.samples))
+	ordered = append(ordered, rb.samples[rb.next:]...)
+	return append(ordered, rb.samples[:rb.next]...)
+}
+
+type history struct {
+	size int
+
+	mu      sync.RWMutex
+	buffers map[string]*ringBuffer
+}
+
+func newHistory(size int) *history {
+	return &history{
+		size:    size,
+		buffers: make(map[string]*ringBuffer),
+	}
+}
+
+func (h *history) record(metric Metric, ts time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	buffer, present := h.buffers[metric.Key()]
+	if !present {
+		buffer = newRingBuffer(h.size)
+		h.buffers[metric.Key()] = buffer
+	}
+	buffer.push(metrics.NewSample(metric, ts))
+}
+
+// get отдает значения метрики из интервала [from, to], нулевое время -- без ограничения
+func (h *history) get(key string, from time.Time, to time.Time) []Sample {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	samples := make([]Sample, 0)
+	buffer, present := h.buffers[key]
+	if !present {
+		return samples
+	}
+
+	for _, sample := range buffer.ordered() {
+		if !from.IsZero() && sample.Timestamp.Before(from) {
+			continue
+		}
+		if !to.IsZero() && sample.Timestamp.After(to) {
+			continue
+		}
+		samples = append(samples, sample)
+	}
+
+	return samples
+}
@@ -0,0 +1,90 @@
+package memory
+
+import (
+	"testing"
+	"time"
+
+	"prayago-metricsalert/internal/metrics"
+	"prayago-metricsalert/internal/storage/backend"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistoryKeepsLastSamples(t *testing.T) {
+	h := newHistory(3)
+	gauge := metrics.NewMetric("Alloc", metrics.GaugeMetric)
+	start := time.Unix(1000, 0)
+
+	for i := 0; i < 5; i++ {
+		*gauge.Value = float64(i)
+		h.record(gauge, start.Add(time.Duration(i)*time.Second))
+	}
+
+	samples := h.get("Alloc", time.Time{}, time.Time{})
+	require.Len(t, samples, 3)
+	for i, sample := range samples {
+		assert.Equal(t, float64(i+2), *sample.Value)
+		assert.Equal(t, start.Add(time.Duration(i+2)*time.Second), sample.Timestamp)
+	}
+
+	samples = h.get("Alloc", start.Add(3*time.Second), start.Add(3*time.Second))
+	require.Len(t, samples, 1)
+	assert.Equal(t, 3.0, *samples[0].Value)
+
+	assert.Empty(t, h.get("Unknown", time.Time{}, time.Time{}))
+}
+
+func TestMemStorageHistory(t *testing.T) {
+	ms := NewMemStorage(MemStorageConfig{StoreInterval: time.Hour, HistorySize: 10})
+
+	_, err := ms.UpdateMetricValue(metrics.CounterMetric, "PollCount", nil, "2")
+	require.NoError(t, err)
+	_, err = ms.UpdateMetricValue(metrics.CounterMetric, "PollCount", nil, "3")
+	require.NoError(t, err)
+
+	samples, err := ms.GetHistory("PollCount", nil, time.Time{}, time.Time{})
+	require.NoError(t, err)
+	require.Len(t, samples, 2)
+	assert.Equal(t, int64(2), *samples[0].Delta)
+	assert.Equal(t, int64(5), *samples[1].Delta)
+
+	_, err = ms.GetHistory("Unknown", nil, time.Time{}, time.Time{})
+	assert.Error(t, err)
+
+	disabled := NewMemStorage(MemStorageConfig{StoreInterval: time.Hour})
+	_, err = disabled.GetHistory("PollCount", nil, time.Time{}, time.Time{})
+	assert.ErrorIs(t, err, backend.ErrHistoryDisabled)
+}
+
+func TestMemStorageLabeledSeries(t *testing.T) {
+	ms := NewMemStorage(MemStorageConfig{StoreInterval: time.Hour})
+	web1 := metrics.Labels{"host": "web1"}
+	web2 := metrics.Labels{"host": "web2"}
+
+	_, err := ms.UpdateMetricValue(metrics.CounterMetric, "PollCount", web1, "2")
+	require.NoError(t, err)
+	_, err = ms.UpdateMetricValue(metrics.CounterMetric, "PollCount", web2, "5")
+	require.NoError(t, err)
+	_, err = ms.UpdateMetricValue(metrics.CounterMetric, "PollCount", web1, "1")
+	require.NoError(t, err)
+
+	value, err := ms.GetMetricValue(metrics.SeriesKey("PollCount", web1))
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), value)
+
+	metric, err := ms.GetMetric(metrics.SeriesKey("PollCount", web2))
+	require.NoError(t, err)
+	assert.Equal(t, web2, metric.Labels)
+
+	_, err = ms.GetMetric("PollCount")
+	assert.Error(t, err)
+
+	filtered := ms.GetAllMetrics(web2)
+	require.Len(t, filtered, 1)
+	assert.Equal(t, web2, filtered[0].Labels)
+	assert.Equal(t, int64(5), *filtered[0].Delta)
+
+	_, err = ms.UpdateMetricValue(metrics.CounterMetric, "PollCount", metrics.Labels{"bad-name": "x"}, "1")
+	assert.Error(t, err)
+}
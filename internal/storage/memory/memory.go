@@ -4,151 +4,480 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/url"
 	"os"
 	"prayago-metricsalert/internal/logger"
 	"prayago-metricsalert/internal/metrics"
+	"prayago-metricsalert/internal/storage/backend"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
 type Metric = metrics.Metric
 
+func init() {
+	// memory:// -- только в памяти, file://path/to/storage.json -- с сохранением в файл
+	backend.Register("memory", func(dsn string, opts backend.Options) (backend.Backend, error) {
+		return NewMemStorage(MemStorageConfig{
+			HistorySize: opts.HistorySize,
+		}), nil
+	})
+	// file://path/to/storage.json?keep=5&wal=false
+	// keep -- сколько последних снимков хранить, wal -- вести ли журнал обновлений между снимками
+	backend.Register("file", func(dsn string, opts backend.Options) (backend.Backend, error) {
+		fpath, query, _ := strings.Cut(backend.DSNPath(dsn), "?")
+		if fpath == "" {
+			return nil, errors.New("file storage DSN has no path")
+		}
+
+		params, err := url.ParseQuery(query)
+		if err != nil {
+			return nil, err
+		}
+		keep := DefaultSnapshotKeep
+		if keepStr := params.Get("keep"); keepStr != "" {
+			if keep, err = strconv.Atoi(keepStr); err != nil || keep < 1 {
+				return nil, fmt.Errorf("wrong snapshot keep %q", keepStr)
+			}
+		}
+
+		useWAL := true
+		if walStr := params.Get("wal"); walStr != "" {
+			if useWAL, err = strconv.ParseBool(walStr); err != nil {
+				return nil, fmt.Errorf("wrong wal %q", walStr)
+			}
+		}
+
+		return NewMemStorage(MemStorageConfig{
+			FPath:         fpath,
+			SnapshotKeep:  keep,
+			WAL:           useWAL,
+			StoreInterval: opts.StoreInterval,
+			ShouldRestore: opts.ShouldRestore,
+			HistorySize:   opts.HistorySize,
+		}), nil
+	})
+}
+
 type MemStorageConfig struct {
-	FPath         string
+	FPath         string // пустой путь -- ничего не сохраняем на диск
+	SnapshotKeep  int    // сколько последних снимков хранить, 0 -- DefaultSnapshotKeep
+	WAL           bool   // журнал обновлений между снимками в FPath.wal
 	StoreInterval time.Duration
 	ShouldRestore bool
+	HistorySize   int // сколько последних значений каждой метрики помнить, 0 -- история не нужна
 }
 
 type MemStorage struct {
 	config  MemStorageConfig
-	storage map[string]Metric
+	storage *shardedMap
+	history *history
+	saveMu  *sync.Mutex // SaveData по интервалу идет в своей горутине, снимки не должны перемешаться
+	wal     *wal
+	compact chan struct{}   // будит сжатие журнала, см. persist
+	stop    chan struct{}   // закрывается в Close, останавливает фоновые горутины
+	workers *sync.WaitGroup // фоновые горутины, Close их дожидается
+	closed  *sync.Once
 }
 
 func runStoreInteval(ms MemStorage) {
-	time.AfterFunc(time.Millisecond*300, func() {
+	ms.workers.Add(1)
+	go func() {
+		defer ms.workers.Done()
+		ticker := time.NewTicker(ms.config.StoreInterval)
+		defer ticker.Stop()
 		for {
-			time.Sleep(ms.config.StoreInterval)
-			go ms.SaveData()
+			select {
+			case <-ms.stop:
+				return
+			case <-ticker.C:
+				ms.SaveData()
+			}
 		}
-	})
+	}()
 }
 
-func NewMemStorage(config MemStorageConfig) MemStorage {
-	var storage = make(map[string]Metric, 0)
+// runCompaction -- единственная горутина, которая сжимает журнал снимком.
+// Сколько бы обновлений ни заметили, что журнал вырос, снимок пишется один.
+func runCompaction(ms MemStorage) {
+	ms.workers.Add(1)
+	go func() {
+		defer ms.workers.Done()
+		for {
+			select {
+			case <-ms.stop:
+				return
+			case <-ms.compact:
+				ms.SaveData()
+			}
+		}
+	}()
+}
 
+func NewMemStorage(config MemStorageConfig) MemStorage {
 	logger.LogSugar.Infof("MemStorage created, config: %v", config)
 
+	if config.SnapshotKeep <= 0 {
+		config.SnapshotKeep = DefaultSnapshotKeep
+	}
+
 	memStorage := MemStorage{
 		config:  config,
-		storage: storage,
+		storage: newShardedMap(),
+		saveMu:  &sync.Mutex{},
+		compact: make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		workers: &sync.WaitGroup{},
+		closed:  &sync.Once{},
 	}
 
-	if config.ShouldRestore {
+	if config.HistorySize > 0 {
+		memStorage.history = newHistory(config.HistorySize)
+	}
+
+	if config.FPath != "" && config.ShouldRestore {
 		memStorage.restoreData()
 	}
 
-	if config.StoreInterval > 0 {
+	if config.FPath != "" && config.WAL {
+		memStorage.wal = memStorage.openWAL()
+	}
+	if memStorage.wal != nil {
+		runCompaction(memStorage)
+	}
+
+	if config.FPath != "" && config.StoreInterval > 0 {
 		runStoreInteval(memStorage)
 	}
 
 	return memStorage
 }
 
-func (ms MemStorage) GetAllMetricsAsString() string {
-	s := ""
-	for _, metric := range ms.storage {
-		s += fmt.Sprintf("%s|%s|%s|\r\n", metric.ID, metric.MType, metric.GetValueStr())
+// GetAllMetrics отдает метрики, у которых есть все метки из filter, отсортированные по ключу
+func (ms MemStorage) GetAllMetrics(filter metrics.Labels) []Metric {
+	all := make([]Metric, 0)
+	for _, metric := range ms.storage.all() {
+		if metric.Labels.Matches(filter) {
+			all = append(all, metric)
+		}
 	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].Key() < all[j].Key()
+	})
 
-	return s
+	return all
 }
 
-func (ms MemStorage) GetMetricValue(name string) (any, error) {
-	if metric, present := ms.storage[name]; present {
+// key -- ключ серии, см. metrics.SeriesKey
+func (ms MemStorage) GetMetricValue(key string) (any, error) {
+	if metric, present := ms.storage.get(key); present {
 		return metric.GetValue(), nil
 	}
 
-	return nil, errors.New("metric not found")
+	return nil, backend.ErrMetricNotFound
 }
 
-func (ms MemStorage) GetMetric(name string) (*Metric, error) {
-	if metric, present := ms.storage[name]; present {
+func (ms MemStorage) GetMetric(key string) (*Metric, error) {
+	if metric, present := ms.storage.get(key); present {
 		return &metric, nil
 	}
 
-	return nil, errors.New("metric not found")
+	return nil, backend.ErrMetricNotFound
 }
 
-func (ms MemStorage) UpdateMetricValue(mType string, name string, value string) (*Metric, error) {
-	if mType != metrics.GaugeMetric && mType != metrics.CounterMetric {
-		return nil, fmt.Errorf("unsupported metric type %s", mType)
+func (ms MemStorage) UpdateMetricValue(mType string, name string, labels metrics.Labels, value string) (*Metric, error) {
+	if err := metrics.ValidateSeries(name, mType, labels); err != nil {
+		return nil, err
 	}
 
-	metric, present := ms.storage[name]
-	if !present {
-		metric = metrics.NewMetric(name, mType)
-		ms.storage[name] = metric
+	// новую метрику кладем только после удачного обновления, иначе останется нулевая
+	return ms.update(metrics.SeriesKey(name, labels), func(current *Metric) (Metric, error) {
+		metric := metrics.NewMetric(name, mType)
+		metric.Labels = labels.Clone()
+		if current != nil {
+			metric = *current
+		}
+
+		err := metric.UpdateValueStr(value)
+		return metric, err
+	})
+}
+
+func (ms MemStorage) UpdateMetric(metric Metric) (*Metric, error) {
+	if err := metric.Validate(); err != nil {
+		return nil, err
+	}
+
+	// новая метрика обновляется так же, как старая, только начиная с нуля
+	return ms.update(metric.Key(), func(current *Metric) (Metric, error) {
+		stored := metric.Empty()
+		if current != nil {
+			stored = *current
+		}
+
+		err := stored.UpdateValueNum(metric.GetValue())
+		return stored, err
+	})
+}
+
+// RestoreMetric кладет метрику, только если ее нет, проверка и запись -- под одной блокировкой.
+// История не пишется: это не обновление, а значение, которое уже было.
+func (ms MemStorage) RestoreMetric(metric Metric) (bool, error) {
+	if err := metric.Validate(); err != nil {
+		return false, err
+	}
+
+	restored := false
+	var walSeq uint64
+	_, err := ms.storage.update(metric.Key(), func(current *Metric) (Metric, error) {
+		if current != nil {
+			return *current, nil
+		}
+
+		if ms.wal != nil {
+			var err error
+			if walSeq, err = ms.wal.write(metric); err != nil {
+				logger.LogSugar.Errorf("error writing WAL: %v", err)
+				return metric, err
+			}
+		}
+		restored = true
+		return metric.Clone(), nil
+	})
+	if err != nil || !restored {
+		return false, err
+	}
+
+	ms.persist(walSeq)
+
+	return true, nil
+}
+
+// UpdateBatch применяет пачку целиком: все ее части хранилища блокируются разом,
+// и если хоть одна метрика не обновилась или журнал не записался, не меняется ничего
+func (ms MemStorage) UpdateBatch(batch []Metric) ([]Metric, error) {
+	keys := make([]string, len(batch))
+	for i, metric := range batch {
+		if err := metric.Validate(); err != nil {
+			return nil, err
+		}
+		keys[i] = metric.Key()
 	}
 
-	if err := metric.UpdateValueStr(value); err != nil {
+	var walSeq uint64
+	updated, err := ms.storage.updateAll(keys, func(current []*Metric) ([]Metric, error) {
+		updated := make([]Metric, len(batch))
+		for i, metric := range batch {
+			stored := metric.Empty()
+			if current[i] != nil {
+				stored = *current[i]
+			}
+			if err := stored.UpdateValueNum(metric.GetValue()); err != nil {
+				return nil, err
+			}
+			updated[i] = stored
+		}
+
+		if ms.wal != nil {
+			var err error
+			if walSeq, err = ms.wal.write(updated...); err != nil {
+				logger.LogSugar.Errorf("error writing WAL: %v", err)
+				return nil, err
+			}
+		}
+		for _, metric := range updated {
+			ms.recordHistory(metric)
+		}
+
+		return updated, nil
+	})
+	if err != nil {
 		return nil, err
 	}
 
-	if ms.config.StoreInterval == 0 {
-		ms.SaveData()
+	ms.persist(walSeq)
+
+	return updated, nil
+}
+
+// update меняет метрику под блокировкой ее части хранилища и там же пишет историю и журнал,
+// чтобы они шли в порядке обновлений. fsync журнала и снимок без журнала -- уже без блокировки.
+// Если журнал не записался, не меняется ничего и update возвращает ошибку. Если не прошел
+// fsync, обновление уже в памяти: update сообщает об успехе, а ошибку пишет в лог,
+// иначе клиент повторит обновление и счетчик прибавится дважды.
+func (ms MemStorage) update(key string, apply func(current *Metric) (Metric, error)) (*Metric, error) {
+	var walSeq uint64
+	updated, err := ms.storage.update(key, func(current *Metric) (Metric, error) {
+		metric, err := apply(current)
+		if err != nil {
+			return metric, err
+		}
+
+		if ms.wal != nil {
+			if walSeq, err = ms.wal.write(metric); err != nil {
+				logger.LogSugar.Errorf("error writing WAL: %v", err)
+				return metric, err
+			}
+		}
+		ms.recordHistory(metric)
+
+		return metric, nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return &metric, nil
+	ms.persist(walSeq)
+
+	return &updated, nil
 }
 
-func (ms MemStorage) UpdateMetric(metric Metric) (*Metric, error) {
-	if metric.MType != metrics.GaugeMetric && metric.MType != metrics.CounterMetric {
-		return nil, fmt.Errorf("unsupported metric type %s", metric.MType)
+// persist дожидается, пока обновление сохранится: с журналом -- fsync журнала,
+// без журнала при StoreInterval == 0 -- снимок целиком. Обновление к этому времени
+// уже в памяти, так что ошибки сохранения только пишутся в лог, см. update.
+func (ms MemStorage) persist(walSeq uint64) {
+	if ms.wal == nil {
+		if ms.config.StoreInterval == 0 {
+			ms.SaveData()
+		}
+		return
 	}
 
-	if metric.ID == "" {
-		return nil, fmt.Errorf("metric name is empty")
+	if err := ms.wal.wait(walSeq); err != nil {
+		logger.LogSugar.Errorf("error syncing WAL, the update is in memory only until the next snapshot: %v", err)
 	}
 
-	oldMetric, present := ms.storage[metric.ID]
-	if !present {
-		ms.storage[metric.ID] = metric
-		return &metric, nil
+	if ms.wal.offset() > walCompactSize {
+		select {
+		case ms.compact <- struct{}{}:
+		default:
+			// сжатие уже запрошено
+		}
 	}
+}
 
-	if err := oldMetric.UpdateValueNum(metric.GetValue()); err != nil {
-		return nil, err
+// openWAL дочитывает в память журнал поверх снимка, без ShouldRestore старый журнал выбрасывается
+func (ms MemStorage) openWAL() *wal {
+	fpath := walPath(ms.config.FPath)
+	if !ms.config.ShouldRestore {
+		if err := os.Remove(fpath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logger.LogSugar.Errorf("error removing WAL: %v", err)
+		}
 	}
 
-	if ms.config.StoreInterval == 0 {
-		ms.SaveData()
+	replayed := 0
+	w, err := openWAL(fpath, func(metric Metric) {
+		ms.storage.set(metric.Key(), metric)
+		replayed++
+	})
+	if err != nil {
+		logger.LogSugar.Errorf("error opening WAL, working without it: %v", err)
+		return nil
+	}
+	logger.LogSugar.Infof("Memstorage replayed %d WAL records", replayed)
+
+	return w
+}
+
+func (ms MemStorage) GetHistory(name string, labels metrics.Labels, from time.Time, to time.Time) ([]Sample, error) {
+	if ms.history == nil {
+		return nil, backend.ErrHistoryDisabled
+	}
+
+	key := metrics.SeriesKey(name, labels)
+	if _, present := ms.storage.get(key); !present {
+		return nil, backend.ErrMetricNotFound
 	}
 
-	return &oldMetric, nil
+	return ms.history.get(key, from, to), nil
+}
+
+func (ms MemStorage) recordHistory(metric Metric) {
+	if ms.history != nil {
+		ms.history.record(metric, time.Now())
+	}
 }
 
 func (ms MemStorage) SaveData() {
+	if ms.config.FPath == "" {
+		return
+	}
+
 	logger.LogSugar.Infof("Memstorage saving, config %v", ms.config)
 	logger.LogSugar.Infoln("Memstorage saving to file", ms.config.FPath)
 
-	data, err := json.Marshal(ms.storage)
+	ms.saveMu.Lock()
+	defer ms.saveMu.Unlock()
+
+	// запомненная до снимка часть журнала в снимок точно попала,
+	// ее после снимка и выкидываем
+	var walOffset int64
+	if ms.wal != nil {
+		walOffset = ms.wal.offset()
+	}
+
+	data, err := json.Marshal(ms.storage.snapshot())
 	if err != nil {
 		logger.LogSugar.Errorf("error JSONing metrics: %v", err)
+		return
 	}
 
-	if err := os.WriteFile(ms.config.FPath, data, 0666); err != nil {
+	if err := writeSnapshot(ms.config.FPath, data, ms.config.SnapshotKeep); err != nil {
 		logger.LogSugar.Errorf("error saving file: %v", err)
+		return
+	}
+
+	if ms.wal != nil {
+		if err := ms.wal.truncateBefore(walOffset); err != nil {
+			logger.LogSugar.Errorf("error truncating WAL: %v", err)
+		}
 	}
 }
 
+// память всегда доступна
+func (ms MemStorage) Ping() bool {
+	return true
+}
+
+// Close дожидается сохранения по интервалу и сжатия журнала, если они идут, и пишет последний снимок.
+// Обновления после Close не попадут ни в снимок, ни в журнал.
+func (ms MemStorage) Close() error {
+	var err error
+	ms.closed.Do(func() {
+		close(ms.stop)
+		ms.workers.Wait()
+
+		ms.SaveData()
+		if ms.wal != nil {
+			err = ms.wal.close()
+		}
+	})
+
+	return err
+}
+
 func (ms MemStorage) restoreData() {
 	logger.LogSugar.Infoln("Memstorage restoring data from file", ms.config.FPath)
 
-	data, err := os.ReadFile(ms.config.FPath)
-	if err != nil {
-		logger.LogSugar.Errorf("error reading file: %v", err)
-	}
+	// разбираем в отдельную map, чтобы наполовину разобранный снимок не попал в хранилище
+	err := readSnapshot(ms.config.FPath, ms.config.SnapshotKeep, func(payload []byte) error {
+		restored := make(map[string]Metric)
+		if err := json.Unmarshal(payload, &restored); err != nil {
+			return err
+		}
+		for key, metric := range restored {
+			ms.storage.set(key, metric)
+		}
+		return nil
+	})
 
-	if err := json.Unmarshal(data, &ms.storage); err != nil {
-		logger.LogSugar.Errorf("error parsing JSONing metrics: %v", err)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		logger.LogSugar.Infoln("Memstorage has no snapshot yet, starting empty")
+	case err != nil:
+		logger.LogSugar.Errorf("no usable snapshot, starting empty: %v", err)
 	}
 }
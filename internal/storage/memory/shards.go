@@ -0,0 +1,151 @@
+package memory
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+)
+
+// shardCount -- на сколько частей с отдельными блокировками делится хранилище,
+// обновления разных метрик почти никогда не ждут друг друга
+const shardCount = 32
+
+type shard struct {
+	mu      sync.RWMutex
+	metrics map[string]Metric
+}
+
+// shardedMap отдает и принимает только копии метрик: у метрики значения лежат
+// по указателям, и отданная наружу метрика иначе менялась бы вместе с хранилищем
+type shardedMap struct {
+	shards [shardCount]*shard
+}
+
+func newShardedMap() *shardedMap {
+	sm := &shardedMap{}
+	for i := range sm.shards {
+		sm.shards[i] = &shard{metrics: make(map[string]Metric)}
+	}
+
+	return sm
+}
+
+func (sm *shardedMap) shard(key string) *shard {
+	return sm.shards[shardIndex(key)]
+}
+
+func shardIndex(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % shardCount)
+}
+
+func (sm *shardedMap) get(key string) (Metric, bool) {
+	s := sm.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	metric, present := s.metrics[key]
+	if !present {
+		return Metric{}, false
+	}
+
+	return metric.Clone(), true
+}
+
+func (sm *shardedMap) set(key string, metric Metric) {
+	s := sm.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.metrics[key] = metric.Clone()
+}
+
+// update под блокировкой отдает в apply копию метрики (nil, если ее нет) и сохраняет,
+// что apply вернул. Если apply вернул ошибку, хранилище не меняется.
+func (sm *shardedMap) update(key string, apply func(current *Metric) (Metric, error)) (Metric, error) {
+	s := sm.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var current *Metric
+	if metric, present := s.metrics[key]; present {
+		clone := metric.Clone()
+		current = &clone
+	}
+
+	updated, err := apply(current)
+	if err != nil {
+		return Metric{}, err
+	}
+	s.metrics[key] = updated
+
+	return updated.Clone(), nil
+}
+
+// updateAll -- update для нескольких метрик разом, ключи не повторяются. Части хранилища
+// блокируются по возрастанию номеров, так что два updateAll не ждут друг друга по кругу.
+// Если apply вернул ошибку, не меняется ни одна метрика.
+func (sm *shardedMap) updateAll(keys []string, apply func(current []*Metric) ([]Metric, error)) ([]Metric, error) {
+	indices := make([]int, 0, len(keys))
+	seen := make(map[int]bool, len(keys))
+	for _, key := range keys {
+		if i := shardIndex(key); !seen[i] {
+			seen[i] = true
+			indices = append(indices, i)
+		}
+	}
+	sort.Ints(indices)
+	for _, i := range indices {
+		sm.shards[i].mu.Lock()
+		defer sm.shards[i].mu.Unlock()
+	}
+
+	current := make([]*Metric, len(keys))
+	for i, key := range keys {
+		if metric, present := sm.shard(key).metrics[key]; present {
+			clone := metric.Clone()
+			current[i] = &clone
+		}
+	}
+
+	updated, err := apply(current)
+	if err != nil {
+		return nil, err
+	}
+
+	clones := make([]Metric, len(keys))
+	for i, key := range keys {
+		sm.shard(key).metrics[key] = updated[i]
+		clones[i] = updated[i].Clone()
+	}
+
+	return clones, nil
+}
+
+func (sm *shardedMap) all() []Metric {
+	var all []Metric
+	for _, s := range sm.shards {
+		s.mu.RLock()
+		for _, metric := range s.metrics {
+			all = append(all, metric.Clone())
+		}
+		s.mu.RUnlock()
+	}
+
+	return all
+}
+
+// snapshot -- копия всего хранилища для SaveData, блокируется по одной части за раз
+func (sm *shardedMap) snapshot() map[string]Metric {
+	snapshot := make(map[string]Metric)
+	for _, s := range sm.shards {
+		s.mu.RLock()
+		for key, metric := range s.metrics {
+			snapshot[key] = metric.Clone()
+		}
+		s.mu.RUnlock()
+	}
+
+	return snapshot
+}
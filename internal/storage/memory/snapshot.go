@@ -0,0 +1,135 @@
+package memory
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"prayago-metricsalert/internal/fileutil"
+	"prayago-metricsalert/internal/logger"
+	"strings"
+)
+
+// Снимок -- строка заголовка и JSON с метриками:
+//
+//	metrics-snapshot v1 sha256:<hex от JSON>
+//	{"Alloc":{...},...}
+//
+// Пишется во временный файл рядом, fsync и rename, так что файл либо старый, либо новый целиком.
+// Прошлые снимки сдвигаются в storage.json.1, storage.json.2 и т.д.
+const (
+	snapshotMagic   = "metrics-snapshot"
+	snapshotVersion = "v1"
+
+	DefaultSnapshotKeep = 3
+)
+
+var errSnapshotCorrupted = errors.New("snapshot is corrupted")
+
+func encodeSnapshot(payload []byte) []byte {
+	sum := sha256.Sum256(payload)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s sha256:%s\n", snapshotMagic, snapshotVersion, hex.EncodeToString(sum[:]))
+	buf.Write(payload)
+
+	return buf.Bytes()
+}
+
+// decodeSnapshot проверяет заголовок и контрольную сумму и отдает JSON.
+// Файл без заголовка -- снимок старого формата, его отдаем как есть.
+func decodeSnapshot(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(snapshotMagic+" ")) {
+		if len(bytes.TrimSpace(data)) == 0 {
+			return nil, errSnapshotCorrupted
+		}
+		return data, nil
+	}
+
+	header, payload, found := bytes.Cut(data, []byte("\n"))
+	if !found {
+		return nil, errSnapshotCorrupted
+	}
+
+	fields := strings.Fields(string(header))
+	if len(fields) != 3 {
+		return nil, errSnapshotCorrupted
+	}
+	if fields[1] != snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %s", fields[1])
+	}
+
+	expected, found := strings.CutPrefix(fields[2], "sha256:")
+	if !found {
+		return nil, errSnapshotCorrupted
+	}
+	sum := sha256.Sum256(payload)
+	if hex.EncodeToString(sum[:]) != expected {
+		return nil, errSnapshotCorrupted
+	}
+
+	return payload, nil
+}
+
+// snapshotPath -- i-й снимок, 0 -- текущий
+func snapshotPath(fpath string, i int) string {
+	if i == 0 {
+		return fpath
+	}
+
+	return fmt.Sprintf("%s.%d", fpath, i)
+}
+
+func writeSnapshot(fpath string, payload []byte, keep int) error {
+	if keep < 1 {
+		keep = 1
+	}
+
+	// сдвигаем старые снимки, когда новый уже на диске, самый старый затирается
+	return fileutil.WriteAtomic(fpath, encodeSnapshot(payload), func() error {
+		for i := keep - 1; i > 0; i-- {
+			err := os.Rename(snapshotPath(fpath, i-1), snapshotPath(fpath, i))
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// readSnapshot передает в load JSON самого свежего целого снимка из keep последних.
+// Снимок, который не прочитался, не сошелся по контрольной сумме или не разобрался load,
+// пропускаем и берем предыдущий.
+func readSnapshot(fpath string, keep int, load func(payload []byte) error) error {
+	if keep < 1 {
+		keep = 1
+	}
+
+	var lastErr error = os.ErrNotExist
+	for i := 0; i < keep; i++ {
+		spath := snapshotPath(fpath, i)
+		data, err := os.ReadFile(spath)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err == nil {
+			var payload []byte
+			if payload, err = decodeSnapshot(data); err == nil {
+				err = load(payload)
+			}
+		}
+		if err == nil {
+			if i > 0 {
+				logger.LogSugar.Warnf("Snapshot %s is missing or broken, restored from %s", fpath, spath)
+			}
+			return nil
+		}
+
+		logger.LogSugar.Errorf("error reading snapshot %s: %v", spath, err)
+		lastErr = err
+	}
+
+	return lastErr
+}
@@ -0,0 +1,128 @@
+package memory
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"prayago-metricsalert/internal/metrics"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshotEncodeDecode(t *testing.T) {
+	payload := []byte(`{"Alloc":{"id":"Alloc","type":"gauge","value":1}}`)
+	data := encodeSnapshot(payload)
+
+	decoded, err := decodeSnapshot(data)
+	require.NoError(t, err)
+	assert.Equal(t, payload, decoded)
+
+	// снимок старого формата, без заголовка
+	decoded, err = decodeSnapshot(payload)
+	require.NoError(t, err)
+	assert.Equal(t, payload, decoded)
+
+	corrupted := append([]byte{}, data...)
+	corrupted[len(corrupted)-2] = '2'
+	_, err = decodeSnapshot(corrupted)
+	assert.ErrorIs(t, err, errSnapshotCorrupted)
+
+	// файл обрезан при записи
+	_, err = decodeSnapshot(data[:len(data)-10])
+	assert.ErrorIs(t, err, errSnapshotCorrupted)
+
+	_, err = decodeSnapshot(nil)
+	assert.Error(t, err)
+}
+
+func TestSnapshotRetention(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "storage.json")
+	for _, payload := range []string{`{"n":1}`, `{"n":2}`, `{"n":3}`, `{"n":4}`} {
+		require.NoError(t, writeSnapshot(fpath, []byte(payload), 3))
+	}
+
+	for i, expected := range []string{`{"n":4}`, `{"n":3}`, `{"n":2}`} {
+		data, err := os.ReadFile(snapshotPath(fpath, i))
+		require.NoError(t, err)
+		payload, err := decodeSnapshot(data)
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(payload))
+	}
+	assert.NoFileExists(t, snapshotPath(fpath, 3))
+
+	// временные файлы не остаются
+	files, err := filepath.Glob(fpath + ".tmp-*")
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestRestoreFallsBackToPreviousSnapshot(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "storage.json")
+	config := MemStorageConfig{FPath: fpath, SnapshotKeep: 3, StoreInterval: time.Hour, ShouldRestore: true}
+
+	ms := NewMemStorage(config)
+	_, err := ms.UpdateMetricValue(metrics.CounterMetric, "PollCount", nil, "2")
+	require.NoError(t, err)
+	ms.SaveData()
+	_, err = ms.UpdateMetricValue(metrics.CounterMetric, "PollCount", nil, "3")
+	require.NoError(t, err)
+	ms.SaveData()
+
+	restored := NewMemStorage(config)
+	value, err := restored.GetMetricValue("PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), value)
+
+	// последний снимок испорчен -- берем предыдущий
+	require.NoError(t, os.WriteFile(fpath, []byte("metrics-snapshot v1 sha256:00\n{"), 0666))
+	restored = NewMemStorage(config)
+	value, err = restored.GetMetricValue("PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), value)
+
+	// последнего снимка нет вовсе, например упали между сдвигом и rename
+	require.NoError(t, os.Remove(fpath))
+	restored = NewMemStorage(config)
+	value, err = restored.GetMetricValue("PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), value)
+}
+
+func TestRestoreWithoutSnapshots(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "storage.json")
+	require.NoError(t, os.WriteFile(fpath, []byte("not a snapshot"), 0666))
+
+	ms := NewMemStorage(MemStorageConfig{FPath: fpath, StoreInterval: time.Hour, ShouldRestore: true})
+	assert.Empty(t, ms.GetAllMetrics(nil))
+}
+
+// сумма гистограммы не должна стать +Inf: такой снимок не записать в JSON,
+// и хранилище перестало бы сохраняться совсем
+func TestSnapshotSurvivesHistogramOverflow(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "storage.json")
+	config := MemStorageConfig{FPath: fpath, SnapshotKeep: 1, ShouldRestore: true}
+
+	ms := NewMemStorage(config)
+	_, err := ms.UpdateMetricValue(metrics.HistogramMetric, "lat", nil, "1e308")
+	require.NoError(t, err)
+	_, err = ms.UpdateMetricValue(metrics.HistogramMetric, "lat", nil, "1e308")
+	assert.Error(t, err)
+	_, err = ms.UpdateMetricValue(metrics.SummaryMetric, "rt", nil, "1e308")
+	require.NoError(t, err)
+	_, err = ms.UpdateMetricValue(metrics.SummaryMetric, "rt", nil, "1e308")
+	assert.Error(t, err)
+	_, err = ms.UpdateMetricValue(metrics.GaugeMetric, "g", nil, "1")
+	require.NoError(t, err)
+	require.NoError(t, ms.Close())
+
+	restored := NewMemStorage(config)
+	value, err := restored.GetMetricValue("g")
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, value)
+	histogram, err := restored.GetMetric(metrics.SeriesKey("lat", nil))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), histogram.Histogram.Count)
+}
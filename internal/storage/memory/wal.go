@@ -0,0 +1,266 @@
+package memory
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"prayago-metricsalert/internal/fileutil"
+	"prayago-metricsalert/internal/logger"
+	"strconv"
+	"sync"
+)
+
+// wal -- журнал обновлений между снимками. В журнал пишется не само обновление,
+// а метрика целиком после него, так что повторное применение записи ничего не портит:
+// счетчик не прибавится дважды, если запись уже попала в снимок.
+//
+// Строка журнала -- crc32 от JSON в hex, пробел и JSON метрики. Недописанная при падении
+// строка не сойдется по crc32, на ней чтение журнала останавливается.
+//
+// wait возвращается только после fsync. Пока один вызов ждет fsync, остальные
+// дописывают свои записи через write, и следующий fsync покрывает их все разом.
+type wal struct {
+	fpath string
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	file    *os.File
+	size    int64  // сколько байт в журнале
+	written uint64 // номер последней записи
+	synced  uint64 // номер последней записи, прошедшей fsync
+	syncing bool
+}
+
+// если журнал вырос больше, снимок пишется, не дожидаясь StoreInterval, var -- для тестов
+var walCompactSize int64 = 16 << 20
+
+func walPath(fpath string) string {
+	return fpath + ".wal"
+}
+
+// openWAL читает журнал, отдает записи в apply и открывает его на дозапись.
+// Все после последней целой записи отрезается, иначе новые записи окажутся за мусором.
+func openWAL(fpath string, apply func(metric Metric)) (*wal, error) {
+	file, err := os.OpenFile(fpath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := replayWAL(file, apply)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := file.Truncate(size); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	w := &wal{
+		fpath: fpath,
+		file:  file,
+		size:  size,
+	}
+	w.cond = sync.NewCond(&w.mu)
+
+	return w, nil
+}
+
+// replayWAL отдает размер целой части журнала
+func replayWAL(r io.Reader, apply func(metric Metric)) (int64, error) {
+	reader := bufio.NewReader(r)
+	var size int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				logger.LogSugar.Warnf("WAL has a torn record at %d, dropping it", size)
+			}
+			return size, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		metric, err := decodeWALRecord(line)
+		if err != nil {
+			logger.LogSugar.Warnf("WAL record at %d is broken, dropping the rest: %v", size, err)
+			return size, nil
+		}
+		apply(metric)
+		size += int64(len(line))
+	}
+}
+
+func encodeWALRecord(metric Metric) ([]byte, error) {
+	data, err := json.Marshal(metric)
+	if err != nil {
+		return nil, err
+	}
+
+	record := make([]byte, 0, len(data)+10)
+	record = fmt.Appendf(record, "%08x ", crc32.ChecksumIEEE(data))
+	record = append(record, data...)
+	return append(record, '\n'), nil
+}
+
+func decodeWALRecord(line []byte) (Metric, error) {
+	var metric Metric
+
+	checksum, data, found := bytes.Cut(bytes.TrimSuffix(line, []byte("\n")), []byte(" "))
+	if !found {
+		return metric, errors.New("no checksum")
+	}
+	expected, err := strconv.ParseUint(string(checksum), 16, 32)
+	if err != nil {
+		return metric, err
+	}
+	if crc32.ChecksumIEEE(data) != uint32(expected) {
+		return metric, errors.New("checksum mismatch")
+	}
+
+	err = json.Unmarshal(data, &metric)
+	return metric, err
+}
+
+// write только дописывает записи, без fsync. Хранилище зовет его под блокировкой метрики,
+// чтобы записи одной метрики шли в журнале в том же порядке, что и обновления,
+// а fsync ждет уже без блокировки. Записи нескольких метрик уходят в файл одним Write.
+func (w *wal) write(metrics ...Metric) (uint64, error) {
+	var record []byte
+	for _, metric := range metrics {
+		encoded, err := encodeWALRecord(metric)
+		if err != nil {
+			return 0, err
+		}
+		record = append(record, encoded...)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, err := w.file.Write(record); err != nil {
+		return 0, err
+	}
+	w.size += int64(len(record))
+	w.written++
+
+	return w.written, nil
+}
+
+// wait ждет, пока запись seq пройдет fsync
+func (w *wal) wait(seq uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for w.synced < seq {
+		if w.syncing {
+			w.cond.Wait()
+			continue
+		}
+
+		// fsync за всю группу делает тот, кто пришел первым
+		w.syncing = true
+		target := w.written
+		w.mu.Unlock()
+		err := w.file.Sync()
+		w.mu.Lock()
+		w.syncing = false
+		w.cond.Broadcast()
+		if err != nil {
+			return err
+		}
+		if target > w.synced {
+			w.synced = target
+		}
+	}
+
+	return nil
+}
+
+func (w *wal) offset() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.size
+}
+
+// truncateBefore выкидывает записи до offset, они уже есть в снимке.
+// То, что дописали, пока писался снимок, переносим в новый журнал.
+func (w *wal) truncateBefore(offset int64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// дожидаемся fsync, который идет без блокировки, файл сейчас будет заменен
+	for w.syncing {
+		w.cond.Wait()
+	}
+
+	if offset >= w.size {
+		if err := w.file.Truncate(0); err != nil {
+			return err
+		}
+		w.size = 0
+		return w.file.Sync()
+	}
+
+	tail := make([]byte, w.size-offset)
+	if _, err := w.file.ReadAt(tail, offset); err != nil {
+		return err
+	}
+
+	tmpPath := w.fpath + ".tmp"
+	if err := writeFileSync(tmpPath, tail); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, w.fpath); err != nil {
+		return err
+	}
+	if err := fileutil.SyncDir(filepath.Dir(w.fpath)); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(w.fpath, os.O_RDWR|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	w.file.Close()
+	w.file = file
+	w.size = int64(len(tail))
+
+	return nil
+}
+
+func writeFileSync(fpath string, data []byte) error {
+	file, err := os.Create(fpath)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+func (w *wal) close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for w.syncing {
+		w.cond.Wait()
+	}
+
+	return w.file.Close()
+}
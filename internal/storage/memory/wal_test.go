@@ -0,0 +1,210 @@
+package memory
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"prayago-metricsalert/internal/metrics"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWALReplayAfterCrash(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "storage.json")
+	config := MemStorageConfig{FPath: fpath, StoreInterval: time.Hour, ShouldRestore: true, WAL: true}
+
+	ms := NewMemStorage(config)
+	_, err := ms.UpdateMetricValue(metrics.CounterMetric, "PollCount", nil, "2")
+	require.NoError(t, err)
+	ms.SaveData()
+	_, err = ms.UpdateMetricValue(metrics.CounterMetric, "PollCount", nil, "3")
+	require.NoError(t, err)
+	_, err = ms.UpdateMetricValue(metrics.GaugeMetric, "Alloc", metrics.Labels{"host": "web1"}, "1.5")
+	require.NoError(t, err)
+	// падаем: ни SaveData, ни Close
+
+	restored := NewMemStorage(config)
+	value, err := restored.GetMetricValue("PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), value)
+	value, err = restored.GetMetricValue(`Alloc{host="web1"}`)
+	require.NoError(t, err)
+	assert.Equal(t, 1.5, value)
+
+	// повторный запуск на том же журнале не прибавляет счетчик еще раз
+	restored = NewMemStorage(config)
+	value, err = restored.GetMetricValue("PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), value)
+}
+
+func TestWALTruncatedBySaveData(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "storage.json")
+	ms := NewMemStorage(MemStorageConfig{FPath: fpath, StoreInterval: time.Hour, WAL: true})
+
+	_, err := ms.UpdateMetricValue(metrics.CounterMetric, "PollCount", nil, "2")
+	require.NoError(t, err)
+	info, err := os.Stat(walPath(fpath))
+	require.NoError(t, err)
+	assert.NotZero(t, info.Size())
+
+	ms.SaveData()
+	info, err = os.Stat(walPath(fpath))
+	require.NoError(t, err)
+	assert.Zero(t, info.Size())
+}
+
+func TestWALKeepsRecordsAfterOffset(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "metrics.wal")
+	w, err := openWAL(fpath, func(Metric) {})
+	require.NoError(t, err)
+
+	// так пишет хранилище: write под блокировкой метрики, потом wait до fsync
+	first := metrics.NewMetric("first", metrics.GaugeMetric)
+	seq, err := w.write(first)
+	require.NoError(t, err)
+	require.NoError(t, w.wait(seq))
+	offset := w.offset()
+	second := metrics.NewMetric("second", metrics.GaugeMetric)
+	seq, err = w.write(second)
+	require.NoError(t, err)
+	require.NoError(t, w.wait(seq))
+
+	// снимок покрыл только первую запись
+	require.NoError(t, w.truncateBefore(offset))
+	third := metrics.NewMetric("third", metrics.GaugeMetric)
+	fourth := metrics.NewMetric("fourth", metrics.CounterMetric)
+	seq, err = w.write(third, fourth)
+	require.NoError(t, err)
+	require.NoError(t, w.wait(seq))
+	require.NoError(t, w.close())
+
+	var replayed []string
+	w, err = openWAL(fpath, func(metric Metric) {
+		replayed = append(replayed, metric.ID)
+	})
+	require.NoError(t, err)
+	defer w.close()
+	assert.Equal(t, []string{"second", "third", "fourth"}, replayed)
+}
+
+func TestWALDropsTornRecord(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "metrics.wal")
+	w, err := openWAL(fpath, func(Metric) {})
+	require.NoError(t, err)
+	seq, err := w.write(metrics.NewMetric("Alloc", metrics.GaugeMetric))
+	require.NoError(t, err)
+	require.NoError(t, w.wait(seq))
+	require.NoError(t, w.close())
+
+	// запись оборвалась на середине
+	record, err := encodeWALRecord(metrics.NewMetric("PollCount", metrics.CounterMetric))
+	require.NoError(t, err)
+	file, err := os.OpenFile(fpath, os.O_WRONLY|os.O_APPEND, 0666)
+	require.NoError(t, err)
+	_, err = file.Write(record[:len(record)/2])
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	var replayed []string
+	w, err = openWAL(fpath, func(metric Metric) {
+		replayed = append(replayed, metric.ID)
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Alloc"}, replayed)
+
+	// следующая запись идет сразу за последней целой, а не за мусором
+	seq, err = w.write(metrics.NewMetric("RandomValue", metrics.GaugeMetric))
+	require.NoError(t, err)
+	require.NoError(t, w.wait(seq))
+	require.NoError(t, w.close())
+
+	replayed = nil
+	w, err = openWAL(fpath, func(metric Metric) {
+		replayed = append(replayed, metric.ID)
+	})
+	require.NoError(t, err)
+	defer w.close()
+	assert.Equal(t, []string{"Alloc", "RandomValue"}, replayed)
+}
+
+func TestWALConcurrentWrites(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "metrics.wal")
+	w, err := openWAL(fpath, func(Metric) {})
+	require.NoError(t, err)
+
+	const writers = 50
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			seq, err := w.write(metrics.NewMetric("m"+strconv.Itoa(i), metrics.GaugeMetric))
+			if assert.NoError(t, err) {
+				assert.NoError(t, w.wait(seq))
+			}
+		}(i)
+	}
+	wg.Wait()
+	require.NoError(t, w.close())
+
+	replayed := make(map[string]bool)
+	w, err = openWAL(fpath, func(metric Metric) {
+		replayed[metric.ID] = true
+	})
+	require.NoError(t, err)
+	defer w.close()
+	assert.Len(t, replayed, writers)
+}
+
+// журнал вырос: снимок пишет одна фоновая горутина, и после Close она уже ничего не пишет
+func TestWALCompactionStopsOnClose(t *testing.T) {
+	compactSize := walCompactSize
+	walCompactSize = 0
+	t.Cleanup(func() {
+		walCompactSize = compactSize
+	})
+
+	dir := t.TempDir()
+	ms := NewMemStorage(MemStorageConfig{FPath: filepath.Join(dir, "storage.json"), StoreInterval: time.Hour, WAL: true})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				_, err := ms.UpdateMetricValue(metrics.CounterMetric, "PollCount", nil, "1")
+				assert.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+	require.NoError(t, ms.Close())
+
+	listing := func() map[string]time.Time {
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		files := make(map[string]time.Time, len(entries))
+		for _, entry := range entries {
+			info, err := entry.Info()
+			require.NoError(t, err)
+			files[entry.Name()] = info.ModTime()
+		}
+		return files
+	}
+	closed := listing()
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, closed, listing())
+
+	restored := NewMemStorage(MemStorageConfig{FPath: filepath.Join(dir, "storage.json"), ShouldRestore: true, WAL: true})
+	value, err := restored.GetMetricValue("PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(400), value)
+	require.NoError(t, restored.Close())
+}
@@ -0,0 +1,63 @@
+package sqlite
+
+import (
+	"database/sql"
+	"errors"
+	"prayago-metricsalert/internal/storage/backend"
+	"prayago-metricsalert/internal/storage/db"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func init() {
+	// sqlite://path/to/metrics.db, sqlite://:memory: -- база в памяти
+	backend.Register("sqlite", func(dsn string, opts backend.Options) (backend.Backend, error) {
+		fpath := backend.DSNPath(dsn)
+		if fpath == "" {
+			return nil, errors.New("sqlite storage DSN has no path")
+		}
+
+		return db.OpenSQLBackend(Dialect, fpath, opts)
+	})
+}
+
+// sqlite пишет по одному, поэтому держим одно соединение: транзакции просто
+// встают в очередь вместо "database is locked", а :memory: база не теряется
+// между соединениями
+var Dialect = db.Dialect{
+	DriverName:   "sqlite3",
+	CreateTables: createTables,
+	MaxOpenConns: 1,
+}
+
+func createTables(conn *sql.DB, history bool) error {
+	_, err := conn.Exec(`
+		CREATE TABLE IF NOT EXISTS metrics (
+			name VARCHAR(50) NOT NULL,
+			labels TEXT NOT NULL DEFAULT '{}',
+			type VARCHAR(20) NOT NULL,
+			gauge DOUBLE PRECISION,
+			counter BIGINT,
+			distribution TEXT,
+			PRIMARY KEY (name, labels)
+		);
+	`)
+	if err != nil || !history {
+		return err
+	}
+
+	_, err = conn.Exec(`
+		CREATE TABLE IF NOT EXISTS metric_samples (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name VARCHAR(50) NOT NULL,
+			labels TEXT NOT NULL DEFAULT '{}',
+			type VARCHAR(20) NOT NULL,
+			gauge DOUBLE PRECISION,
+			counter BIGINT,
+			ts TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS metric_samples_name_ts_idx ON metric_samples (name, ts);
+	`)
+
+	return err
+}
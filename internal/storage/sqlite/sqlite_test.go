@@ -0,0 +1,17 @@
+package sqlite
+
+import (
+	"path/filepath"
+	"testing"
+
+	"prayago-metricsalert/internal/storage/backend/backendtest"
+)
+
+func TestSQLiteBackend(t *testing.T) {
+	backendtest.Run(t, backendtest.Suite{
+		DSN: func(t *testing.T) string {
+			return "sqlite://" + filepath.Join(t.TempDir(), "metrics.db")
+		},
+		Persistent: true,
+	})
+}
@@ -1,52 +1,95 @@
 package storage
 
 import (
+	"errors"
+	"fmt"
+	"net/url"
+	"prayago-metricsalert/internal/logger"
 	"prayago-metricsalert/internal/metrics"
+	"prayago-metricsalert/internal/storage/backend"
 	"prayago-metricsalert/internal/storage/db"
-	"prayago-metricsalert/internal/storage/memory"
+	"strconv"
 	"time"
+
+	// бэкенды регистрируются в init(), см. backend.Register
+	_ "prayago-metricsalert/internal/storage/memory"
 )
 
 type Metric = metrics.Metric
+type Sample = metrics.Sample
+type Labels = metrics.Labels
+
+var ErrHistoryDisabled = backend.ErrHistoryDisabled
 
 type StorageConfig struct {
+	DSN                string // memory://, file://path, postgres://..., sqlite://path, если бэкенд подключен, см. cmd/server/sqlite.go
 	FPath              string
+	SnapshotKeep       int  // сколько снимков FPath хранить, только для старого режима
+	WAL                bool // журнал обновлений между снимками FPath, только для старого режима
 	StoreInterval      time.Duration
 	ShouldRestore      bool
 	DBConnectionString string
+	DBPrimary          bool // читать и писать только в базу DBConnectionString, без памяти
+	HistorySize        int
 }
 
+// Storage -- обертка над бэкендом, выбранным по схеме DSN.
+// Если DSN не задан, работаем по-старому: метрики в памяти с сохранением в FPath
+// и копией каждого обновления в базу DBConnectionString. Чего нет в памяти,
+// то читается из базы, так что после рестарта без файла значения не теряются.
 type Storage struct {
 	config   StorageConfig
-	memstore memory.MemStorage
+	backend  backend.Backend
+	restorer backend.Restorer // тот же бэкенд, nil -- он не умеет восстанавливать метрики
 	dbstore  db.DBStorager
 }
 
+// метрики ищутся по ключу серии: имя плюс метки, см. metrics.SeriesKey,
+// для метрики без меток ключ совпадает с именем
 type Storager interface {
-	GetAllMetricsAsString() string
-	GetMetricValue(name string) (any, error)
-	GetMetric(name string) (*Metric, error)
-	UpdateMetricValue(mType string, name string, value string) (*Metric, error)
+	GetAllMetricsAsString(filter Labels) string
+	GetAllMetrics(filter Labels) []Metric
+	GetMetricValue(key string) (any, error)
+	GetMetric(key string) (*Metric, error)
+	UpdateMetricValue(mType string, name string, labels Labels, value string) (*Metric, error)
 	UpdateMetric(metric Metric) (*Metric, error)
-	UpdateBatch(metrics []Metric) error
+	UpdateBatch(batch []Metric, strict bool) ([]BatchResult, error)
+	GetHistory(name string, labels Labels, from time.Time, to time.Time) ([]Sample, error)
 	SaveData()
 	Ping() bool
 }
 
 func NewStorage(config StorageConfig) Storage {
-	msConfig := memory.MemStorageConfig{
-		FPath:         config.FPath,
+	dsn := config.DSN
+	if dsn == "" {
+		dsn = legacyDSN(config)
+	}
+
+	opts := backend.Options{
 		StoreInterval: config.StoreInterval,
 		ShouldRestore: config.ShouldRestore,
+		HistorySize:   config.HistorySize,
+	}
+	var b backend.Backend
+	var err error
+	if config.DSN == "" && config.DBPrimary && config.DBConnectionString != "" {
+		// строка подключения бывает и вида host=... user=..., без схемы, так что мимо реестра
+		dsn = "postgres"
+		b, err = db.OpenSQLBackend(db.PostgresDialect, config.DBConnectionString, opts)
+	} else {
+		b, err = backend.Open(dsn, opts)
+	}
+	if err != nil {
+		logger.LogSugar.Fatalf("Ошибка открытия хранилища %s: %v", dsn, err)
 	}
-	memstore := memory.NewMemStorage(msConfig)
 
 	// не хочется раскидывать по коду проверки "если есть база, то пиши в нее"
 	// поэтому если база не нужна, создаю "мок", который ничего не делает, и код чище
 	var dbstore db.DBStorager
-	if config.DBConnectionString != "" {
+	if config.DSN == "" && !config.DBPrimary && config.DBConnectionString != "" {
 		dbsConfig := db.DBStorageConfig{
 			ConnectionString: config.DBConnectionString,
+			History:          config.HistorySize > 0,
 		}
 		dbstore = db.NewDBStorage(dbsConfig)
 	} else {
@@ -54,28 +97,131 @@ func NewStorage(config StorageConfig) Storage {
 	}
 
 	storage := Storage{
-		config:   config,
-		memstore: memstore,
-		dbstore:  dbstore,
+		config:  config,
+		backend: b,
+		dbstore: dbstore,
 	}
+	storage.restorer, _ = b.(backend.Restorer)
+	storage.restoreFromDB()
 
 	return storage
 }
 
-func (st Storage) GetAllMetricsAsString() string {
-	return st.memstore.GetAllMetricsAsString()
+func legacyDSN(config StorageConfig) string {
+	if config.FPath == "" {
+		return "memory://"
+	}
+
+	params := url.Values{}
+	params.Set("wal", strconv.FormatBool(config.WAL))
+	if config.SnapshotKeep > 0 {
+		params.Set("keep", strconv.Itoa(config.SnapshotKeep))
+	}
+
+	return "file://" + config.FPath + "?" + params.Encode()
+}
+
+// старый режим: база -- только копия памяти
+func (st Storage) isLegacy() bool {
+	return st.config.DSN == "" && !st.config.DBPrimary
+}
+
+// читать из базы в память имеет смысл только в старом режиме и только если
+// просили восстанавливать значения: с -r=false начинаем с нуля, как и с файлом.
+// Бэкенд старого режима -- память, она умеет RestoreMetric.
+func (st Storage) shouldReadThrough() bool {
+	return st.isLegacy() && st.config.DBConnectionString != "" && st.config.ShouldRestore && st.restorer != nil
+}
+
+// restoreFromDB при старте дополняет память метриками из базы,
+// то, что уже восстановлено из файла, не трогаем
+func (st Storage) restoreFromDB() {
+	if !st.shouldReadThrough() {
+		return
+	}
+
+	dbMetrics, err := st.dbstore.GetAllMetrics()
+	if err != nil {
+		logger.LogSugar.Errorf("Ошибка восстановления метрик из БД: %v", err)
+		return
+	}
+
+	restored := 0
+	for _, metric := range dbMetrics {
+		ok, err := st.restorer.RestoreMetric(metric)
+		if err != nil {
+			logger.LogSugar.Errorf("Ошибка восстановления метрики %s из БД: %v", metric.Key(), err)
+			continue
+		}
+		if ok {
+			restored++
+		}
+	}
+	logger.LogSugar.Infof("Restored %d metrics from DB", restored)
+}
+
+// readThrough подтягивает метрику из базы, если в памяти ее нет.
+// Нужно и перед обновлением: иначе счетчик начнется с нуля в памяти
+// и затрет в базе накопленное значение.
+func (st Storage) readThrough(key string) {
+	if !st.shouldReadThrough() {
+		return
+	}
+
+	if _, err := st.backend.GetMetric(key); !errors.Is(err, backend.ErrMetricNotFound) {
+		return
+	}
+
+	name, labels, err := metrics.ParseSeriesKey(key)
+	if err != nil {
+		return
+	}
+
+	metric, err := st.dbstore.GetMetric(name, labels)
+	if err != nil {
+		if !errors.Is(err, backend.ErrMetricNotFound) {
+			logger.LogSugar.Errorf("Ошибка чтения метрики %s из БД: %v", key, err)
+		}
+		return
+	}
+
+	// пока читали базу, метрику мог восстановить или обновить другой запрос,
+	// тогда в памяти уже значение новее, и его не трогаем
+	if _, err := st.restorer.RestoreMetric(*metric); err != nil {
+		logger.LogSugar.Errorf("Ошибка восстановления метрики %s из БД: %v", key, err)
+	}
+}
+
+func (st Storage) GetAllMetricsAsString(filter Labels) string {
+	s := ""
+	for _, metric := range st.backend.GetAllMetrics(filter) {
+		s += fmt.Sprintf("%s|%s|%s|\r\n", metric.Key(), metric.MType, metric.GetValueStr())
+	}
+
+	return s
 }
 
-func (st Storage) GetMetricValue(name string) (any, error) {
-	return st.memstore.GetMetricValue(name)
+func (st Storage) GetAllMetrics(filter Labels) []Metric {
+	return st.backend.GetAllMetrics(filter)
+}
+
+func (st Storage) GetMetricValue(key string) (any, error) {
+	metric, err := st.GetMetric(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return metric.GetValue(), nil
 }
 
-func (st Storage) GetMetric(name string) (*Metric, error) {
-	return st.memstore.GetMetric(name)
+func (st Storage) GetMetric(key string) (*Metric, error) {
+	st.readThrough(key)
+	return st.backend.GetMetric(key)
 }
 
-func (st Storage) UpdateMetricValue(mType string, name string, value string) (*Metric, error) {
-	metric, err := st.memstore.UpdateMetricValue(mType, name, value)
+func (st Storage) UpdateMetricValue(mType string, name string, labels Labels, value string) (*Metric, error) {
+	st.readThrough(metrics.SeriesKey(name, labels))
+	metric, err := st.backend.UpdateMetricValue(mType, name, labels, value)
 	if err == nil {
 		st.dbstore.UpdateMetric(*metric)
 	}
@@ -84,7 +230,8 @@ func (st Storage) UpdateMetricValue(mType string, name string, value string) (*M
 }
 
 func (st Storage) UpdateMetric(metric Metric) (*Metric, error) {
-	updatedMetric, err := st.memstore.UpdateMetric(metric)
+	st.readThrough(metric.Key())
+	updatedMetric, err := st.backend.UpdateMetric(metric)
 	if err == nil {
 		st.dbstore.UpdateMetric(*updatedMetric)
 	}
@@ -92,22 +239,113 @@ func (st Storage) UpdateMetric(metric Metric) (*Metric, error) {
 	return updatedMetric, err
 }
 
-func (st Storage) UpdateBatch(metrics []Metric) error {
-	var validMetrics []Metric
-	for _, metric := range metrics {
-		updatedMetric, err := st.UpdateMetric(metric)
+// UpdateBatch применяет каждую метрику пачки ровно один раз, см. mergeBatch,
+// и пишет копию в базу одним запросом на всю пачку. У каждой метрики свой итог:
+// примененные -- с новым значением, не примененные -- с ошибкой.
+// В строгом режиме пачка применяется, только если годятся все ее элементы,
+// иначе не меняется ничего, а у годных элементов ошибка ErrBatchRejected.
+// Бэкенд с BatchUpdater применяет годные элементы одной транзакцией. Для строгой пачки
+// ошибка UpdateBatch значит, что не применилось ничего и пачку можно повторить,
+// нестрогая же после такой ошибки обновляется по одной метрике. В остальных случаях ошибки нет.
+func (st Storage) UpdateBatch(batch []Metric, strict bool) ([]BatchResult, error) {
+	results := make([]BatchResult, len(batch))
+
+	merged := mergeBatch(batch, results)
+	valid := make([]*mergedMetric, 0, len(merged))
+	for _, m := range merged {
+		st.readThrough(m.metric.Key())
+		if err := st.checkUpdate(m.metric); err != nil {
+			m.setErr(err, results)
+			continue
+		}
+		valid = append(valid, m)
+	}
+	if strict && rejectBatch(results) {
+		return results, nil
+	}
+
+	if updater, ok := st.backend.(backend.BatchUpdater); ok && len(valid) > 0 {
+		results, err := st.updateBatchAtomic(updater, valid, results)
+		if err == nil || strict {
+			return results, err
+		}
+		logger.LogSugar.Errorf("Ошибка обновления пачки, обновляем по одной метрике: %v", err)
+	}
+
+	updated := make([]Metric, 0, len(valid))
+	for _, m := range valid {
+		metric, err := st.backend.UpdateMetric(m.metric)
+		for _, i := range m.indices {
+			results[i] = BatchResult{Metric: metric, Err: err}
+		}
 		if err == nil {
-			validMetrics = append(validMetrics, *updatedMetric)
+			updated = append(updated, *metric)
+		}
+	}
+	st.copyBatchToDB(updated)
+
+	return results, nil
+}
+
+func (st Storage) updateBatchAtomic(updater backend.BatchUpdater, merged []*mergedMetric, results []BatchResult) ([]BatchResult, error) {
+	batch := make([]Metric, len(merged))
+	for i, m := range merged {
+		batch[i] = m.metric
+	}
+
+	updated, err := updater.UpdateBatch(batch)
+	if err != nil {
+		for _, m := range merged {
+			m.setErr(err, results)
+		}
+		return results, err
+	}
+
+	for j, m := range merged {
+		for _, i := range m.indices {
+			results[i] = BatchResult{Metric: &updated[j]}
 		}
 	}
+	st.copyBatchToDB(updated)
 
-	return st.dbstore.UpdateBatch(validMetrics)
+	return results, nil
+}
+
+// copyBatchToDB -- копия в базу старого режима. Память уже обновлена, так что
+// ошибка копии, как и у UpdateMetric, только пишется в лог, а не отменяет пачку.
+func (st Storage) copyBatchToDB(updated []Metric) {
+	if err := st.dbstore.UpdateBatch(updated); err != nil {
+		logger.LogSugar.Errorf("Ошибка копирования пачки в БД: %v", err)
+	}
+}
+
+func (st Storage) GetHistory(name string, labels Labels, from time.Time, to time.Time) ([]Sample, error) {
+	if st.config.HistorySize <= 0 {
+		return nil, ErrHistoryDisabled
+	}
+
+	if st.isLegacy() && st.config.DBConnectionString != "" {
+		return st.dbstore.GetHistory(name, labels, from, to)
+	}
+
+	return st.backend.GetHistory(name, labels, from, to)
 }
 
 func (st Storage) SaveData() {
-	st.memstore.SaveData()
+	st.backend.SaveData()
 }
 
+// Close сохраняет последний снимок памяти и закрывает соединения с базой,
+// вызывается, когда новых обновлений уже не будет
+func (st Storage) Close() error {
+	return errors.Join(st.backend.Close(), st.dbstore.Close())
+}
+
+// в старом режиме /ping проверяет базу, а не память
 func (st Storage) Ping() bool {
-	return st.dbstore.Ping()
+	if st.isLegacy() {
+		return st.dbstore.Ping()
+	}
+
+	return st.backend.Ping()
 }
@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"prayago-metricsalert/internal/metrics"
+	"prayago-metricsalert/internal/storage/backend"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// dummyDB -- база из map, ключ -- ключ серии
+type dummyDB struct {
+	mu      sync.Mutex
+	metrics map[string]Metric
+	batches [][]Metric // что приходило в UpdateBatch
+	err     error      // чем заканчивается UpdateBatch, база недоступна
+}
+
+func (db *dummyDB) Close() error {
+	return nil
+}
+
+func (db *dummyDB) Ping() bool {
+	return true
+}
+
+func (db *dummyDB) GetAllMetrics() ([]Metric, error) {
+	all := make([]Metric, 0, len(db.metrics))
+	for _, metric := range db.metrics {
+		all = append(all, metric)
+	}
+
+	return all, nil
+}
+
+func (db *dummyDB) GetMetric(name string, labels Labels) (*Metric, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if metric, present := db.metrics[metrics.SeriesKey(name, labels)]; present {
+		return &metric, nil
+	}
+
+	return nil, backend.ErrMetricNotFound
+}
+
+func (db *dummyDB) UpdateMetric(metric Metric) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.metrics[metric.Key()] = metric
+}
+
+func (db *dummyDB) UpdateBatch(batch []Metric) error {
+	if db.err != nil {
+		return db.err
+	}
+	db.mu.Lock()
+	db.batches = append(db.batches, batch)
+	db.mu.Unlock()
+	for _, metric := range batch {
+		db.UpdateMetric(metric)
+	}
+
+	return nil
+}
+
+func (db *dummyDB) GetHistory(name string, labels Labels, from time.Time, to time.Time) ([]Sample, error) {
+	return nil, nil
+}
+
+func newTestStorage(t *testing.T, dbstore *dummyDB, shouldRestore bool) Storage {
+	config := StorageConfig{
+		DBConnectionString: "postgres://test",
+		ShouldRestore:      shouldRestore,
+	}
+	b, err := backend.Open("memory://", backend.Options{})
+	require.NoError(t, err)
+
+	storage := Storage{
+		config:  config,
+		backend: b,
+		dbstore: dbstore,
+	}
+	storage.restorer, _ = b.(backend.Restorer)
+	storage.restoreFromDB()
+
+	return storage
+}
+
+func counter(name string, delta int64, labels Labels) Metric {
+	return Metric{ID: name, MType: metrics.CounterMetric, Delta: &delta, Labels: labels}
+}
+
+func TestRestoreFromDB(t *testing.T) {
+	web1 := Labels{"host": "web1"}
+	dbstore := &dummyDB{metrics: map[string]Metric{
+		"PollCount":              counter("PollCount", 10, nil),
+		`PollCount{host="web1"}`: counter("PollCount", 3, web1),
+	}}
+
+	storage := newTestStorage(t, dbstore, true)
+
+	assert.Len(t, storage.GetAllMetrics(nil), 2)
+	value, err := storage.GetMetricValue(metrics.SeriesKey("PollCount", web1))
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), value)
+}
+
+func TestReadThroughOnMiss(t *testing.T) {
+	dbstore := &dummyDB{metrics: map[string]Metric{}}
+	storage := newTestStorage(t, dbstore, true)
+
+	// метрика появилась в базе уже после старта, например ее записал другой сервер
+	dbstore.metrics["PollCount"] = counter("PollCount", 10, nil)
+
+	value, err := storage.GetMetricValue("PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), value)
+
+	_, err = storage.GetMetric("Unknown")
+	assert.ErrorIs(t, err, backend.ErrMetricNotFound)
+}
+
+func TestReadThroughBeforeUpdate(t *testing.T) {
+	dbstore := &dummyDB{metrics: map[string]Metric{}}
+	storage := newTestStorage(t, dbstore, true)
+	dbstore.metrics["PollCount"] = counter("PollCount", 10, nil)
+
+	// счетчик продолжается с сохраненного в базе значения, а не с нуля
+	metric, err := storage.UpdateMetricValue(metrics.CounterMetric, "PollCount", nil, "5")
+	require.NoError(t, err)
+	assert.Equal(t, int64(15), metric.GetValue())
+	assert.Equal(t, int64(15), *dbstore.metrics["PollCount"].Delta)
+}
+
+// одновременные запросы к метрике, которой нет в памяти, берут значение из базы один раз
+func TestConcurrentReadThrough(t *testing.T) {
+	dbstore := &dummyDB{metrics: map[string]Metric{}}
+	storage := newTestStorage(t, dbstore, true)
+	dbstore.metrics["PollCount"] = counter("PollCount", 10, nil)
+
+	const updates = 50
+	var wg sync.WaitGroup
+	for i := 0; i < updates; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := storage.UpdateMetric(counter("PollCount", 1, nil))
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	value, err := storage.GetMetricValue("PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(10+updates), value)
+}
+
+func TestNoReadThroughWithoutRestore(t *testing.T) {
+	dbstore := &dummyDB{metrics: map[string]Metric{
+		"PollCount": counter("PollCount", 10, nil),
+	}}
+	storage := newTestStorage(t, dbstore, false)
+
+	assert.Empty(t, storage.GetAllMetrics(nil))
+	_, err := storage.GetMetric("PollCount")
+	assert.ErrorIs(t, err, backend.ErrMetricNotFound)
+}